@@ -88,17 +88,26 @@ type Allocation struct {
 
 // AllocationMetric is used to deserialize allocation metrics.
 type AllocationMetric struct {
-	NodesEvaluated     int
-	NodesFiltered      int
-	NodesAvailable     map[string]int
-	ClassFiltered      map[string]int
-	ConstraintFiltered map[string]int
-	NodesExhausted     int
-	ClassExhausted     map[string]int
-	DimensionExhausted map[string]int
-	Scores             map[string]float64
-	AllocationTime     time.Duration
-	CoalescedFailures  int
+	NodesEvaluated           int
+	NodesFiltered            int
+	NodesAvailable           map[string]int
+	ClassFiltered            map[string]int
+	NodesCordoned            int
+	NodesDenied              int
+	ConstraintFiltered       map[string]int
+	CheckerTimeouts          map[string]int
+	FallbackTier             int
+	NodesExhausted           int
+	NodesSkipped             int
+	ClassExhausted           map[string]int
+	DimensionExhausted       map[string]int
+	Scores                   map[string]float64
+	Reclaimable              map[string]*Resources
+	ShuffleSeed              int64
+	AllocationTime           time.Duration
+	CoalescedFailures        int
+	JobFragmentation         int
+	EligibilityEffectiveness float64
 }
 
 // AllocationListStub is used to return a subset of an allocation
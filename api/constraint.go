@@ -5,6 +5,7 @@ type Constraint struct {
 	LTarget string
 	RTarget string
 	Operand string
+	Negate  bool
 }
 
 // NewConstraint generates a new job placement constraint.
@@ -407,6 +407,7 @@ func parseConstraints(result *[]*structs.Constraint, list *ast.ObjectList) error
 			"version",
 			"regexp",
 			"distinct_hosts",
+			"negate",
 		}
 		if err := checkHCLKeys(o.Val, valid); err != nil {
 			return err
@@ -275,6 +275,26 @@ func TestParse(t *testing.T) {
 			false,
 		},
 
+		{
+			"negate-constraint.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+				Constraints: []*structs.Constraint{
+					&structs.Constraint{
+						LTarget: "$attr.kernel.version",
+						RTarget: "^3\\.",
+						Operand: structs.ConstraintRegex,
+						Negate:  true,
+					},
+				},
+			},
+			false,
+		},
+
 		{
 			"distinctHosts-constraint.hcl",
 			&structs.Job{
@@ -0,0 +1,7 @@
+job "foo" {
+    constraint {
+        attribute = "$attr.kernel.version"
+        regexp = "^3\\."
+        negate = true
+    }
+}
@@ -756,6 +756,12 @@ func TestJobDiff(t *testing.T) {
 								Old:  "",
 								New:  "baz",
 							},
+							{
+								Type: DiffTypeAdded,
+								Name: "Negate",
+								Old:  "",
+								New:  "false",
+							},
 							{
 								Type: DiffTypeAdded,
 								Name: "Operand",
@@ -780,6 +786,12 @@ func TestJobDiff(t *testing.T) {
 								Old:  "bar",
 								New:  "",
 							},
+							{
+								Type: DiffTypeDeleted,
+								Name: "Negate",
+								Old:  "false",
+								New:  "",
+							},
 							{
 								Type: DiffTypeDeleted,
 								Name: "Operand",
@@ -1065,6 +1077,12 @@ func TestTaskGroupDiff(t *testing.T) {
 								Old:  "",
 								New:  "baz",
 							},
+							{
+								Type: DiffTypeAdded,
+								Name: "Negate",
+								Old:  "",
+								New:  "false",
+							},
 							{
 								Type: DiffTypeAdded,
 								Name: "Operand",
@@ -1089,6 +1107,12 @@ func TestTaskGroupDiff(t *testing.T) {
 								Old:  "bar",
 								New:  "",
 							},
+							{
+								Type: DiffTypeDeleted,
+								Name: "Negate",
+								Old:  "false",
+								New:  "",
+							},
 							{
 								Type: DiffTypeDeleted,
 								Name: "Operand",
@@ -1819,6 +1843,12 @@ func TestTaskDiff(t *testing.T) {
 								Old:  "",
 								New:  "baz",
 							},
+							{
+								Type: DiffTypeAdded,
+								Name: "Negate",
+								Old:  "",
+								New:  "false",
+							},
 							{
 								Type: DiffTypeAdded,
 								Name: "Operand",
@@ -1843,6 +1873,12 @@ func TestTaskDiff(t *testing.T) {
 								Old:  "bar",
 								New:  "",
 							},
+							{
+								Type: DiffTypeDeleted,
+								Name: "Negate",
+								Old:  "false",
+								New:  "",
+							},
 							{
 								Type: DiffTypeDeleted,
 								Name: "Operand",
@@ -88,6 +88,10 @@ func constraintTargetEscapes(target string) bool {
 		return true
 	case strings.HasPrefix(target, "${meta.unique."):
 		return true
+	case strings.HasPrefix(target, "${topology."):
+		// Topology labels are derived by the scheduler and may be derived
+		// from unique values
+		return true
 	default:
 		return false
 	}
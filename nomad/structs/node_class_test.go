@@ -221,3 +221,14 @@ func TestNode_EscapedConstraints(t *testing.T) {
 		t.Fatalf("EscapedConstraints(%v) returned %v; want %v", constraints, act, expected)
 	}
 }
+
+func TestNode_EscapedConstraints_Topology(t *testing.T) {
+	c := &Constraint{
+		LTarget: "${topology.rack}",
+		RTarget: "r1",
+		Operand: "=",
+	}
+	if act := EscapedConstraints([]*Constraint{c}); len(act) != 1 {
+		t.Fatalf("EscapedConstraints returned %v; want %v", act, c)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -2710,9 +2711,19 @@ func (ta *TaskArtifact) Validate() error {
 }
 
 const (
-	ConstraintDistinctHosts = "distinct_hosts"
-	ConstraintRegex         = "regexp"
-	ConstraintVersion       = "version"
+	ConstraintDistinctHosts    = "distinct_hosts"
+	ConstraintDistinctProperty = "distinct_property"
+	ConstraintRegex            = "regexp"
+	ConstraintVersion          = "version"
+	ConstraintGlob             = "glob"
+	ConstraintUnits            = "units"
+	ConstraintRegexExtract     = "regexp_extract"
+	ConstraintBool             = "bool"
+	ConstraintTimeWindow       = "time_window"
+	ConstraintCIDR             = "cidr"
+	ConstraintPlatform         = "platform"
+	ConstraintPrefix           = "prefix"
+	ConstraintListLength       = "list_length"
 )
 
 // Constraints are used to restrict placement options.
@@ -2720,6 +2731,7 @@ type Constraint struct {
 	LTarget string // Left-hand target
 	RTarget string // Right-hand target
 	Operand string // Constraint operand (<=, <, =, !=, >, >=), contains, near
+	Negate  bool   // Inverts the result of the operand
 	str     string // Memoized string
 }
 
@@ -2727,7 +2739,8 @@ type Constraint struct {
 func (c *Constraint) Equal(o *Constraint) bool {
 	return c.LTarget == o.LTarget &&
 		c.RTarget == o.RTarget &&
-		c.Operand == o.Operand
+		c.Operand == o.Operand &&
+		c.Negate == o.Negate
 }
 
 func (c *Constraint) Copy() *Constraint {
@@ -2744,6 +2757,9 @@ func (c *Constraint) String() string {
 		return c.str
 	}
 	c.str = fmt.Sprintf("%s %s %s", c.LTarget, c.Operand, c.RTarget)
+	if c.Negate {
+		c.str = fmt.Sprintf("!(%s)", c.str)
+	}
 	return c.str
 }
 
@@ -2755,6 +2771,17 @@ func (c *Constraint) Validate() error {
 
 	// Perform additional validation based on operand
 	switch c.Operand {
+	case ConstraintDistinctHosts:
+		if c.Negate {
+			mErr.Errors = append(mErr.Errors, errors.New("Distinct hosts constraint can not be negated"))
+		}
+	case ConstraintDistinctProperty:
+		if c.Negate {
+			mErr.Errors = append(mErr.Errors, errors.New("Distinct property constraint can not be negated"))
+		}
+		if c.LTarget == "" {
+			mErr.Errors = append(mErr.Errors, errors.New("Distinct property constraint requires an attribute"))
+		}
 	case ConstraintRegex:
 		if _, err := regexp.Compile(c.RTarget); err != nil {
 			mErr.Errors = append(mErr.Errors, fmt.Errorf("Regular expression failed to compile: %v", err))
@@ -2763,6 +2790,16 @@ func (c *Constraint) Validate() error {
 		if _, err := version.NewConstraint(c.RTarget); err != nil {
 			mErr.Errors = append(mErr.Errors, fmt.Errorf("Version constraint is invalid: %v", err))
 		}
+	case ConstraintPlatform:
+		if c.Negate {
+			mErr.Errors = append(mErr.Errors, errors.New("Platform constraint can not be negated"))
+		}
+	case ConstraintCIDR:
+		if !strings.HasPrefix(c.RTarget, "${") {
+			if _, _, err := net.ParseCIDR(c.RTarget); err != nil {
+				mErr.Errors = append(mErr.Errors, fmt.Errorf("CIDR block is invalid: %v", err))
+			}
+		}
 	}
 	return mErr.ErrorOrNil()
 }
@@ -3084,13 +3121,34 @@ type AllocMetric struct {
 	// ClassFiltered is the number of nodes filtered by class
 	ClassFiltered map[string]int
 
+	// NodesCordoned is the number of nodes excluded because they were
+	// cordoned for the evaluation. These are not counted as filtered.
+	NodesCordoned int
+
+	// NodesDenied is the number of nodes excluded by the node allow or deny
+	// list of the evaluation. These are not counted as filtered.
+	NodesDenied int
+
 	// ConstraintFiltered is the number of failures caused by constraint
 	ConstraintFiltered map[string]int
 
+	// FallbackTier is the one-based index of the tier of fallback constraints
+	// the nodes were selected by, or zero if no tier was met by any node or
+	// no fallback constraints were set.
+	FallbackTier int
+
+	// CheckerTimeouts is the number of nodes on which each feasibility
+	// checker exceeded its timeout. Such nodes are treated as infeasible.
+	CheckerTimeouts map[string]int
+
 	// NodesExhausted is the number of nodes skipped due to being
 	// exhausted of at least one resource
 	NodesExhausted int
 
+	// NodesSkipped is the number of nodes skipped due to an error reading
+	// their state. Skipped nodes are also counted as filtered.
+	NodesSkipped int
+
 	// ClassExhausted is the number of nodes exhausted by class
 	ClassExhausted map[string]int
 
@@ -3101,6 +3159,15 @@ type AllocMetric struct {
 	// for placement. The top score is typically selected.
 	Scores map[string]float64
 
+	// Reclaimable is the resources that must be reclaimed by preempting
+	// lower priority allocations on each node that only fit the placement
+	// by doing so, keyed by node ID.
+	Reclaimable map[string]*Resources
+
+	// ShuffleSeed is the seed the nodes were shuffled with, or zero if
+	// they were shuffled randomly.
+	ShuffleSeed int64
+
 	// AllocationTime is a measure of how long the allocation
 	// attempt took. This can affect performance and SLAs.
 	AllocationTime time.Duration
@@ -3110,6 +3177,57 @@ type AllocMetric struct {
 	// This is to prevent creating many failed allocations for a
 	// single task group.
 	CoalescedFailures int
+
+	// JobFragmentation is the number of distinct nodes running allocations
+	// of the job once the placement is made. It is only tracked when
+	// consolidating the job's allocations.
+	JobFragmentation int
+
+	// EligibilityEffectiveness is the fraction of computed node class
+	// eligibility lookups during the evaluation that were resolved without
+	// running the feasibility checks.
+	EligibilityEffectiveness float64
+
+	// keyLimit is the maximum number of distinct keys tracked by each of the
+	// class, constraint, checker and dimension maps, or zero if unlimited.
+	// Further keys are counted under AllocMetricOtherKey.
+	keyLimit int
+}
+
+// AllocMetricOtherKey is the key the counts of keys beyond the key limit of an
+// AllocMetric are coalesced into.
+const AllocMetricOtherKey = "other"
+
+// SetKeyLimit sets the maximum number of distinct keys tracked by each of the
+// class, constraint, checker and dimension maps. Once a map holds the limit,
+// further keys are coalesced into AllocMetricOtherKey, so a map holds at most
+// one more key than the limit. Keys already tracked are not affected. A zero
+// limit is unlimited.
+func (a *AllocMetric) SetKeyLimit(limit int) {
+	a.keyLimit = limit
+}
+
+// incrKey increments the count of the key in the map, creating the map if
+// needed, and coalescing the key into AllocMetricOtherKey if the map holds the
+// key limit.
+func (a *AllocMetric) incrKey(m map[string]int, key string) map[string]int {
+	if m == nil {
+		m = make(map[string]int)
+	}
+	if _, ok := m[key]; !ok && a.keyLimit > 0 && a.trackedKeys(m) >= a.keyLimit {
+		key = AllocMetricOtherKey
+	}
+	m[key] += 1
+	return m
+}
+
+// trackedKeys returns the number of keys in the map, not counting
+// AllocMetricOtherKey.
+func (a *AllocMetric) trackedKeys(m map[string]int) int {
+	if _, ok := m[AllocMetricOtherKey]; ok {
+		return len(m) - 1
+	}
+	return len(m)
 }
 
 func (a *AllocMetric) Copy() *AllocMetric {
@@ -3121,9 +3239,16 @@ func (a *AllocMetric) Copy() *AllocMetric {
 	na.NodesAvailable = CopyMapStringInt(na.NodesAvailable)
 	na.ClassFiltered = CopyMapStringInt(na.ClassFiltered)
 	na.ConstraintFiltered = CopyMapStringInt(na.ConstraintFiltered)
+	na.CheckerTimeouts = CopyMapStringInt(na.CheckerTimeouts)
 	na.ClassExhausted = CopyMapStringInt(na.ClassExhausted)
 	na.DimensionExhausted = CopyMapStringInt(na.DimensionExhausted)
 	na.Scores = CopyMapStringFloat64(na.Scores)
+	if a.Reclaimable != nil {
+		na.Reclaimable = make(map[string]*Resources, len(a.Reclaimable))
+		for k, v := range a.Reclaimable {
+			na.Reclaimable[k] = v.Copy()
+		}
+	}
 	return na
 }
 
@@ -3134,32 +3259,44 @@ func (a *AllocMetric) EvaluateNode() {
 func (a *AllocMetric) FilterNode(node *Node, constraint string) {
 	a.NodesFiltered += 1
 	if node != nil && node.NodeClass != "" {
-		if a.ClassFiltered == nil {
-			a.ClassFiltered = make(map[string]int)
-		}
-		a.ClassFiltered[node.NodeClass] += 1
+		a.ClassFiltered = a.incrKey(a.ClassFiltered, node.NodeClass)
 	}
 	if constraint != "" {
-		if a.ConstraintFiltered == nil {
-			a.ConstraintFiltered = make(map[string]int)
-		}
-		a.ConstraintFiltered[constraint] += 1
+		a.ConstraintFiltered = a.incrKey(a.ConstraintFiltered, constraint)
+	}
+}
+
+func (a *AllocMetric) ReclaimNode(node *Node, resources *Resources) {
+	if a.Reclaimable == nil {
+		a.Reclaimable = make(map[string]*Resources)
 	}
+	a.Reclaimable[node.ID] = resources
+}
+
+func (a *AllocMetric) CheckerTimeout(checker string) {
+	a.CheckerTimeouts = a.incrKey(a.CheckerTimeouts, checker)
+}
+
+func (a *AllocMetric) SkipNode(node *Node) {
+	a.NodesSkipped += 1
+	a.FilterNode(node, "state error")
+}
+
+func (a *AllocMetric) CordonNode() {
+	a.NodesCordoned += 1
+}
+
+func (a *AllocMetric) DenyNode() {
+	a.NodesDenied += 1
 }
 
 func (a *AllocMetric) ExhaustedNode(node *Node, dimension string) {
 	a.NodesExhausted += 1
 	if node != nil && node.NodeClass != "" {
-		if a.ClassExhausted == nil {
-			a.ClassExhausted = make(map[string]int)
-		}
-		a.ClassExhausted[node.NodeClass] += 1
+		a.ClassExhausted = a.incrKey(a.ClassExhausted, node.NodeClass)
 	}
 	if dimension != "" {
-		if a.DimensionExhausted == nil {
-			a.DimensionExhausted = make(map[string]int)
-		}
-		a.DimensionExhausted[dimension] += 1
+		a.DimensionExhausted = a.incrKey(a.DimensionExhausted, dimension)
 	}
 }
 
@@ -658,6 +658,97 @@ func TestConstraint_Validate(t *testing.T) {
 	if !strings.Contains(mErr.Errors[0].Error(), "Malformed constraint") {
 		t.Fatalf("err: %s", err)
 	}
+
+	// Perform CIDR validation
+	c.Operand = ConstraintCIDR
+	c.RTarget = "10.0.1.0/33"
+	err = c.Validate()
+	mErr = err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "CIDR block is invalid") {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Distinct hosts can't be negated
+	c.Operand = ConstraintDistinctHosts
+	c.Negate = true
+	err = c.Validate()
+	mErr = err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "can not be negated") {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Platforms can't be negated
+	c.Operand = ConstraintPlatform
+	err = c.Validate()
+	mErr = err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "can not be negated") {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Distinct properties can't be negated and require an attribute
+	c.Operand = ConstraintDistinctProperty
+	c.LTarget = ""
+	err = c.Validate()
+	mErr = err.(*multierror.Error)
+	if len(mErr.Errors) != 2 || !strings.Contains(mErr.Errors[0].Error(), "can not be negated") ||
+		!strings.Contains(mErr.Errors[1].Error(), "requires an attribute") {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestAllocMetric_KeyLimit(t *testing.T) {
+	a := new(AllocMetric)
+	a.SetKeyLimit(1)
+	node := &Node{NodeClass: "large"}
+	other := &Node{NodeClass: "small"}
+
+	a.FilterNode(node, "a")
+	a.FilterNode(other, "b")
+	a.FilterNode(node, "c")
+	a.CheckerTimeout("driver")
+	a.CheckerTimeout("constraint")
+	a.ExhaustedNode(other, "cpu exhausted")
+	a.ExhaustedNode(node, "memory exhausted")
+
+	expected := map[string]int{"a": 1, AllocMetricOtherKey: 2}
+	if !reflect.DeepEqual(a.ConstraintFiltered, expected) {
+		t.Fatalf("bad: %#v", a.ConstraintFiltered)
+	}
+	expected = map[string]int{"large": 2, AllocMetricOtherKey: 1}
+	if !reflect.DeepEqual(a.ClassFiltered, expected) {
+		t.Fatalf("bad: %#v", a.ClassFiltered)
+	}
+	expected = map[string]int{"driver": 1, AllocMetricOtherKey: 1}
+	if !reflect.DeepEqual(a.CheckerTimeouts, expected) {
+		t.Fatalf("bad: %#v", a.CheckerTimeouts)
+	}
+	expected = map[string]int{"small": 1, AllocMetricOtherKey: 1}
+	if !reflect.DeepEqual(a.ClassExhausted, expected) {
+		t.Fatalf("bad: %#v", a.ClassExhausted)
+	}
+	expected = map[string]int{"cpu exhausted": 1, AllocMetricOtherKey: 1}
+	if !reflect.DeepEqual(a.DimensionExhausted, expected) {
+		t.Fatalf("bad: %#v", a.DimensionExhausted)
+	}
+
+	// The limit is kept by copies
+	c := a.Copy()
+	c.FilterNode(nil, "d")
+	if c.ConstraintFiltered[AllocMetricOtherKey] != 3 || a.ConstraintFiltered[AllocMetricOtherKey] != 2 {
+		t.Fatalf("bad: %#v %#v", c.ConstraintFiltered, a.ConstraintFiltered)
+	}
+}
+
+func TestConstraint_String_Negate(t *testing.T) {
+	c := &Constraint{
+		LTarget: "${attr.kernel.name}",
+		RTarget: "linux",
+		Operand: "=",
+		Negate:  true,
+	}
+	if out := c.String(); out != "!(${attr.kernel.name} = linux)" {
+		t.Fatalf("bad: %s", out)
+	}
 }
 
 func TestResource_NetIndex(t *testing.T) {
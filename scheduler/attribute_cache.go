@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// AttributeResolver derives additional attributes from a node. Resolvers may
+// be expensive so their results are cached by an AttributeCache.
+type AttributeResolver func(node *structs.Node) map[string]string
+
+// AttributeCache caches the attributes derived from nodes by a resolver. As
+// fingerprinted attributes change rarely, the cache is meant to be shared
+// across evaluations, such as through EvalContext.SetAttributeCache. Entries
+// are keyed by node ID and invalidated when the modify index of the node
+// changes or the TTL expires. Expired entries are evicted as entries are
+// stored, so the entries of removed nodes don't accumulate. It is safe for
+// concurrent use.
+type AttributeCache struct {
+	resolver AttributeResolver
+	ttl      time.Duration
+
+	// now returns the current time and is overridden in tests
+	now func() time.Time
+
+	entries map[string]*attributeCacheEntry
+	l       sync.Mutex
+
+	// nextEvict is the time expired entries are next evicted
+	nextEvict time.Time
+}
+
+// attributeCacheEntry is the cached result of resolving a node.
+type attributeCacheEntry struct {
+	modifyIndex uint64
+	expires     time.Time
+	attrs       map[string]string
+}
+
+// NewAttributeCache returns an AttributeCache that caches the results of the
+// resolver for the given TTL.
+func NewAttributeCache(resolver AttributeResolver, ttl time.Duration) *AttributeCache {
+	return &AttributeCache{
+		resolver: resolver,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]*attributeCacheEntry),
+	}
+}
+
+// Attributes returns the derived attributes of the node, resolving them if
+// there is no valid cached entry. The returned map must not be modified.
+func (c *AttributeCache) Attributes(node *structs.Node) map[string]string {
+	now := c.now()
+
+	c.l.Lock()
+	entry, ok := c.entries[node.ID]
+	if ok && entry.modifyIndex == node.ModifyIndex && now.Before(entry.expires) {
+		c.l.Unlock()
+		return entry.attrs
+	}
+	c.l.Unlock()
+
+	// Resolve without holding the lock as the resolver may be slow
+	attrs := c.resolver(node)
+
+	c.l.Lock()
+	c.entries[node.ID] = &attributeCacheEntry{
+		modifyIndex: node.ModifyIndex,
+		expires:     now.Add(c.ttl),
+		attrs:       attrs,
+	}
+	c.evictExpired(now)
+	c.l.Unlock()
+	return attrs
+}
+
+// evictExpired removes the expired entries, at most once per TTL so the cost
+// is amortized across the stored entries. The lock must be held.
+func (c *AttributeCache) evictExpired(now time.Time) {
+	if now.Before(c.nextEvict) {
+		return
+	}
+	for nodeID, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, nodeID)
+		}
+	}
+	c.nextEvict = now.Add(c.ttl)
+}
+
+// Invalidate removes the cached entry for the node.
+func (c *AttributeCache) Invalidate(nodeID string) {
+	c.l.Lock()
+	delete(c.entries, nodeID)
+	c.l.Unlock()
+}
+
+// Len returns the number of entries that have not expired.
+func (c *AttributeCache) Len() int {
+	now := c.now()
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	n := 0
+	for _, entry := range c.entries {
+		if now.Before(entry.expires) {
+			n++
+		}
+	}
+	return n
+}
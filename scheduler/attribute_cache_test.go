@@ -0,0 +1,118 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// testAttributeCache returns a cache whose resolver counts its calls and a
+// function to advance the time of the cache.
+func testAttributeCache(ttl time.Duration) (*AttributeCache, *int, func(time.Duration)) {
+	calls := 0
+	resolver := func(node *structs.Node) map[string]string {
+		calls++
+		return map[string]string{"kernel": node.Attributes["kernel.name"]}
+	}
+
+	cache := NewAttributeCache(resolver, ttl)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	advance := func(d time.Duration) { now = now.Add(d) }
+	return cache, &calls, advance
+}
+
+func TestAttributeCache_Hit(t *testing.T) {
+	cache, calls, _ := testAttributeCache(time.Minute)
+	node := mock.Node()
+
+	for i := 0; i < 3; i++ {
+		attrs := cache.Attributes(node)
+		if attrs["kernel"] != "linux" {
+			t.Fatalf("bad: %#v", attrs)
+		}
+	}
+	if *calls != 1 {
+		t.Fatalf("resolver called %d times", *calls)
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("bad: %d", cache.Len())
+	}
+}
+
+func TestAttributeCache_ModifyIndex(t *testing.T) {
+	cache, calls, _ := testAttributeCache(time.Minute)
+	node := mock.Node()
+	node.ModifyIndex = 10
+	cache.Attributes(node)
+
+	// Updating the node invalidates the entry
+	node.ModifyIndex = 11
+	node.Attributes["kernel.name"] = "darwin"
+	if attrs := cache.Attributes(node); attrs["kernel"] != "darwin" {
+		t.Fatalf("bad: %#v", attrs)
+	}
+	if *calls != 2 {
+		t.Fatalf("resolver called %d times", *calls)
+	}
+}
+
+func TestAttributeCache_TTL(t *testing.T) {
+	cache, calls, advance := testAttributeCache(time.Minute)
+	node := mock.Node()
+	cache.Attributes(node)
+
+	advance(30 * time.Second)
+	cache.Attributes(node)
+	if *calls != 1 {
+		t.Fatalf("resolver called %d times", *calls)
+	}
+
+	// The entry expires after the TTL
+	advance(time.Minute)
+	cache.Attributes(node)
+	if *calls != 2 {
+		t.Fatalf("resolver called %d times", *calls)
+	}
+}
+
+func TestAttributeCache_Invalidate(t *testing.T) {
+	cache, calls, _ := testAttributeCache(time.Minute)
+	node := mock.Node()
+	cache.Attributes(node)
+	cache.Invalidate(node.ID)
+	cache.Attributes(node)
+	if *calls != 2 {
+		t.Fatalf("resolver called %d times", *calls)
+	}
+}
+
+func TestAttributeCache_EvictExpired(t *testing.T) {
+	cache, _, advance := testAttributeCache(time.Minute)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	cache.Attributes(nodes[0])
+	cache.Attributes(nodes[1])
+
+	// Expired entries aren't counted
+	advance(30 * time.Second)
+	cache.Attributes(nodes[1])
+	advance(45 * time.Second)
+	if cache.Len() != 0 {
+		t.Fatalf("bad: %d", cache.Len())
+	}
+
+	// Expired entries, such as of removed nodes, are evicted once an entry
+	// is stored
+	cache.Attributes(nodes[1])
+	if len(cache.entries) != 1 || cache.entries[nodes[1].ID] == nil {
+		t.Fatalf("bad: %#v", cache.entries)
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("bad: %d", cache.Len())
+	}
+}
@@ -1,8 +1,17 @@
 package scheduler
 
 import (
+	"bytes"
+	"expvar"
+	"fmt"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/go-version"
 	"github.com/hashicorp/nomad/nomad/structs"
@@ -30,21 +39,77 @@ type Context interface {
 	// adding any planned placements.
 	ProposedAllocs(nodeID string) ([]*structs.Allocation, error)
 
+	// StateError records that reading the state of the node failed during
+	// the named check. The node must be skipped by the caller.
+	StateError(node *structs.Node, checker string, err error)
+
+	// ProposedAllocsForGroup returns the proposed allocations for a node
+	// that belong to the named task group.
+	ProposedAllocsForGroup(nodeID, tgName string) ([]*structs.Allocation, error)
+
+	// ReclaimableAllocs returns the proposed allocations for a node that
+	// could be preempted by an allocation of the given priority.
+	ReclaimableAllocs(nodeID string, priority int) ([]*structs.Allocation, error)
+
 	// RegexpCache is a cache of regular expressions
 	RegexpCache() map[string]*regexp.Regexp
 
 	// ConstraintCache is a cache of version constraints
 	ConstraintCache() map[string]version.Constraints
 
+	// CIDRCache is a cache of parsed CIDR blocks
+	CIDRCache() map[string]*net.IPNet
+
 	// Eligibility returns a tracker for node eligibility in the context of the
 	// eval.
 	Eligibility() *EvalEligibility
+
+	// RejectNode records that a node was rejected by the named checker for
+	// the given reason. The rejection is only retained if rejection details
+	// are enabled.
+	RejectNode(node *structs.Node, checker, reason string)
+
+	// Cordoned returns whether the node is excluded from placement for the
+	// evaluation by the cordon predicate.
+	Cordoned(node *structs.Node) bool
+
+	// ConsiderNode records that a node entered feasibility checking.
+	ConsiderNode(node *structs.Node)
+
+	// ShuffleNodes shuffles the nodes in place, deterministically if a
+	// shuffle seed is set.
+	ShuffleNodes(nodes []*structs.Node)
+
+	// TopologyLabel returns the named topology label derived from the node
+	// and whether it is set.
+	TopologyLabel(node *structs.Node, label string) (string, bool)
+
+	// NodeDenied returns whether the node is excluded from placement for the
+	// evaluation by the node allow or deny list, and the reason if it is.
+	NodeDenied(node *structs.Node) (bool, string)
+
+	// Now returns the current time as seen by the evaluation.
+	Now() time.Time
+}
+
+// NodeRejection describes why a node was found infeasible during an
+// evaluation.
+type NodeRejection struct {
+	// NodeID is the ID of the rejected node
+	NodeID string
+
+	// Checker is the name of the checker that rejected the node
+	Checker string
+
+	// Reason is the reason the checker rejected the node
+	Reason string
 }
 
 // EvalCache is used to cache certain things during an evaluation
 type EvalCache struct {
 	reCache         map[string]*regexp.Regexp
 	constraintCache map[string]version.Constraints
+	cidrCache       map[string]*net.IPNet
 }
 
 func (e *EvalCache) RegexpCache() map[string]*regexp.Regexp {
@@ -60,6 +125,75 @@ func (e *EvalCache) ConstraintCache() map[string]version.Constraints {
 	return e.constraintCache
 }
 
+func (e *EvalCache) CIDRCache() map[string]*net.IPNet {
+	if e.cidrCache == nil {
+		e.cidrCache = make(map[string]*net.IPNet)
+	}
+	return e.cidrCache
+}
+
+// evalCacheStats is the expvar map the statistics of the eval caches are
+// published under. The statistics are cumulative across evaluations.
+var evalCacheStats = expvar.NewMap("nomad.scheduler.eval_cache")
+
+var (
+	// regexpCacheStats tracks the regexp cache, which also holds globs
+	regexpCacheStats = newCacheStats("regexp")
+
+	// versionCacheStats tracks the version constraint cache
+	versionCacheStats = newCacheStats("version")
+
+	// cidrCacheStats tracks the CIDR block cache
+	cidrCacheStats = newCacheStats("cidr")
+)
+
+// cacheStats tracks the lookups of an eval cache. It is published as the
+// "<name>.hits", "<name>.misses", "<name>.stores" and "<name>.hit_rate"
+// variables of the evalCacheStats map. Caches live as long as the evaluation
+// they belong to, so stores counts the entries added rather than the size of
+// any one cache.
+type cacheStats struct {
+	hits   *expvar.Int
+	misses *expvar.Int
+	stores *expvar.Int
+}
+
+func newCacheStats(name string) *cacheStats {
+	c := &cacheStats{
+		hits:   new(expvar.Int),
+		misses: new(expvar.Int),
+		stores: new(expvar.Int),
+	}
+	evalCacheStats.Set(name+".hits", c.hits)
+	evalCacheStats.Set(name+".misses", c.misses)
+	evalCacheStats.Set(name+".stores", c.stores)
+	evalCacheStats.Set(name+".hit_rate", expvar.Func(c.hitRate))
+	return c
+}
+
+// lookup records a lookup that found an entry if hit is set.
+func (c *cacheStats) lookup(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// store records an entry added to the cache.
+func (c *cacheStats) store() {
+	c.stores.Add(1)
+}
+
+// hitRate returns the fraction of lookups that found an entry.
+func (c *cacheStats) hitRate() interface{} {
+	hits, misses := c.hits.Value(), c.misses.Value()
+	if hits+misses == 0 {
+		return 0.0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
 // EvalContext is a Context used during an Evaluation
 type EvalContext struct {
 	EvalCache
@@ -68,6 +202,64 @@ type EvalContext struct {
 	logger      *log.Logger
 	metrics     *structs.AllocMetric
 	eligibility *EvalEligibility
+
+	// rejectionDetail enables retaining the rejected nodes in rejections.
+	rejectionDetail bool
+	rejections      []NodeRejection
+
+	// cordon is an optional predicate marking nodes that should not be
+	// placed on for the evaluation.
+	cordon func(*structs.Node) bool
+
+	// allowNodes and denyNodes are optional sets of node IDs. If allowNodes
+	// is set only its nodes may be placed on and the nodes in denyNodes may
+	// never be placed on.
+	allowNodes map[string]struct{}
+	denyNodes  map[string]struct{}
+
+	// clock returns the current time. It defaults to time.Now and can be
+	// overridden for testing.
+	clock func() time.Time
+
+	// considered is the IDs of the nodes that entered feasibility checking
+	// since the last reset.
+	considered []string
+
+	// planValidator is an optional callback that can veto the plan before
+	// it is submitted.
+	planValidator func(*structs.Plan) error
+
+	// placementCap is the maximum number of placements per job for the
+	// evaluation, or zero if unlimited. placements and deferred track the
+	// placements made and deferred by job ID.
+	placementCap int
+	placements   map[string]int
+	deferred     map[string]int
+
+	// shuffleSeed seeds the shuffle of the nodes if seeded is set, making
+	// the node iteration order reproducible.
+	shuffleSeed int64
+	seeded      bool
+
+	// topologyRules derive the topology labels of nodes, unless they are
+	// derived through the attributeCache shared between evaluations. The
+	// labels are cached by node ID in topologyLabels.
+	topologyRules  []*TopologyRule
+	attributeCache *AttributeCache
+	topologyLabels map[string]map[string]string
+
+	// metricsKeyLimit bounds the number of distinct keys tracked by the
+	// maps of the metrics, or zero if unlimited.
+	metricsKeyLimit int
+
+	// failOnStateError retains the first error reading the state of a node
+	// in stateErr to fail the placement. Such nodes are always skipped.
+	failOnStateError bool
+	stateErr         error
+
+	// placementCache is an optional cache of placement results shared
+	// between evaluations.
+	placementCache *PlacementCache
 }
 
 // NewEvalContext constructs a new EvalContext
@@ -102,7 +294,114 @@ func (e *EvalContext) SetState(s State) {
 }
 
 func (e *EvalContext) Reset() {
+	e.ResetMetrics()
+	e.rejections = nil
+	e.considered = nil
+}
+
+// ResetMetrics clears only the metrics, leaving the caches, eligibility and
+// any other state of the context untouched. It is used to re-measure a phase
+// of the evaluation.
+func (e *EvalContext) ResetMetrics() {
 	e.metrics = new(structs.AllocMetric)
+	e.metrics.SetKeyLimit(e.metricsKeyLimit)
+	if e.seeded {
+		e.metrics.ShuffleSeed = e.shuffleSeed
+	}
+}
+
+// SetMetricsKeyLimit bounds the number of distinct keys, such as constraints,
+// tracked by each map of the metrics. Further keys are coalesced into
+// structs.AllocMetricOtherKey. This bounds the memory used by jobs with many
+// distinct constraints while preserving the dominant reasons. A zero limit is
+// unlimited.
+func (e *EvalContext) SetMetricsKeyLimit(limit int) {
+	e.metricsKeyLimit = limit
+	e.metrics.SetKeyLimit(limit)
+}
+
+// SetPlacementCache sets the cache placement results are reused from when an
+// unchanged job is evaluated against unchanged state. A nil cache disables
+// caching.
+func (e *EvalContext) SetPlacementCache(cache *PlacementCache) {
+	e.placementCache = cache
+}
+
+// PlacementCache returns the placement cache of the context or nil if caching
+// is disabled.
+func (e *EvalContext) PlacementCache() *PlacementCache {
+	return e.placementCache
+}
+
+// SetShuffleSeed sets the seed nodes are shuffled with so the iteration order
+// is reproducible for a given seed and set of nodes. The seed is recorded in
+// the metrics.
+func (e *EvalContext) SetShuffleSeed(seed int64) {
+	e.shuffleSeed = seed
+	e.seeded = true
+	e.metrics.ShuffleSeed = seed
+}
+
+// SetTopologyRules sets the rules deriving topology labels, such as the rack of
+// a node, which constraints can reference as "${topology.<label>}". An error is
+// returned if a rule is invalid, in which case the rules are left unchanged.
+// The rules are copied so they may be shared between evaluations.
+func (e *EvalContext) SetTopologyRules(rules []*TopologyRule) error {
+	compiled, err := compileTopologyRules(rules)
+	if err != nil {
+		return err
+	}
+	e.topologyRules = compiled
+	e.topologyLabels = nil
+	return nil
+}
+
+// SetAttributeCache sets a cache the topology labels of nodes are derived
+// through instead of the topology rules of the context, so the labels can be
+// reused across evaluations. The cache is created from the rules by
+// NewTopologyCache. A nil cache derives the labels from the topology rules.
+func (e *EvalContext) SetAttributeCache(cache *AttributeCache) {
+	e.attributeCache = cache
+	e.topologyLabels = nil
+}
+
+// TopologyLabels returns the topology labels derived from the node. The labels
+// are cached per node for the evaluation and the returned map must not be
+// modified.
+func (e *EvalContext) TopologyLabels(node *structs.Node) map[string]string {
+	if e.attributeCache == nil && len(e.topologyRules) == 0 {
+		return nil
+	}
+	if labels, ok := e.topologyLabels[node.ID]; ok {
+		return labels
+	}
+	if e.topologyLabels == nil {
+		e.topologyLabels = make(map[string]map[string]string)
+	}
+	var labels map[string]string
+	if e.attributeCache != nil {
+		labels = e.attributeCache.Attributes(node)
+	} else {
+		labels = deriveTopologyLabels(e.topologyRules, node)
+	}
+	e.topologyLabels[node.ID] = labels
+	return labels
+}
+
+func (e *EvalContext) TopologyLabel(node *structs.Node, label string) (string, bool) {
+	val, ok := e.TopologyLabels(node)[label]
+	return val, ok
+}
+
+// ShuffleNodes shuffles the nodes in place with the Fisher-Yates algorithm. If
+// a shuffle seed is set, the same nodes in the same order are always shuffled
+// to the same order.
+func (e *EvalContext) ShuffleNodes(nodes []*structs.Node) {
+	if !e.seeded {
+		shuffleNodes(nodes)
+		return
+	}
+	shuffleNodesRand(rand.New(rand.NewSource(e.shuffleSeed)), nodes)
 }
 
 func (e *EvalContext) ProposedAllocs(nodeID string) ([]*structs.Allocation, error) {
@@ -138,6 +437,128 @@ func (e *EvalContext) ProposedAllocs(nodeID string) ([]*structs.Allocation, erro
 	return proposed, nil
 }
 
+// SetFailOnStateError sets whether an error reading the state of a node, such
+// as a transient error reading its allocations, fails the placement. Such
+// nodes are always skipped, filtered with a "state error" reason and counted
+// in the metrics. If set, the first error is also retained and returned by
+// StateErr so the evaluation fails and is retried.
+func (e *EvalContext) SetFailOnStateError(fail bool) {
+	e.failOnStateError = fail
+}
+
+func (e *EvalContext) StateError(node *structs.Node, checker string, err error) {
+	e.logger.Printf("[ERR] sched.%s: failed to read state of node %q: %v", checker, node.ID, err)
+	e.metrics.SkipNode(node)
+	e.RejectNode(node, checker, fmt.Sprintf("state error: %v", err))
+	if e.failOnStateError && e.stateErr == nil {
+		e.stateErr = fmt.Errorf("failed to read state of node %q: %v", node.ID, err)
+	}
+}
+
+// StateErr returns the first error reading the state of a node if the
+// placement fails on state errors, or nil if there was none.
+func (e *EvalContext) StateErr() error {
+	return e.stateErr
+}
+
+// ProposedAllocsForGroup returns the proposed allocations for a node, as
+// returned by ProposedAllocs, that belong to the named task group. Task group
+// names are only unique within a job so callers comparing against a single
+// job must still check the job ID.
+func (e *EvalContext) ProposedAllocsForGroup(nodeID, tgName string) ([]*structs.Allocation, error) {
+	proposed, err := e.ProposedAllocs(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Filter in place as the proposed slice is freshly materialized
+	filtered := proposed[:0]
+	for _, alloc := range proposed {
+		if alloc.TaskGroup == tgName {
+			filtered = append(filtered, alloc)
+		}
+	}
+	return filtered, nil
+}
+
+// ReclaimableAllocs returns the proposed allocations for a node, as returned
+// by ProposedAllocs, that belong to jobs of a lower priority than the given
+// priority. Allocations without a job are never reclaimable.
+func (e *EvalContext) ReclaimableAllocs(nodeID string, priority int) ([]*structs.Allocation, error) {
+	proposed, err := e.ProposedAllocs(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Filter in place as the proposed slice is freshly materialized
+	filtered := proposed[:0]
+	for _, alloc := range proposed {
+		if alloc.Job != nil && alloc.Job.Priority < priority {
+			filtered = append(filtered, alloc)
+		}
+	}
+	return filtered, nil
+}
+
+// SetEligibility is used to inject an eligibility tracker, for example one
+// that was populated by a previous evaluation.
+func (e *EvalContext) SetEligibility(elig *EvalEligibility) {
+	e.eligibility = elig
+}
+
+// PlacementCost returns the cost of placing the allocation on the node given
+// the proposed allocations. The cost is measured in nodes: placing on a node
+// that has no proposed allocations costs a whole node for opening it, plus
+// the mean fraction of the node's CPU and memory the allocation consumes. An
+// infinite cost is returned if the allocation doesn't fit on the node.
+func (e *EvalContext) PlacementCost(nodeID string, alloc *structs.Allocation) (float64, error) {
+	node, err := e.state.NodeByID(nodeID)
+	if err != nil {
+		return 0, err
+	}
+	if node == nil {
+		return 0, fmt.Errorf("node %q not found", nodeID)
+	}
+
+	proposed, err := e.ProposedAllocs(nodeID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Determine the utilization before and after the placement
+	_, _, before, err := structs.AllocsFit(node, proposed, nil)
+	if err != nil {
+		return 0, err
+	}
+	fit, _, after, err := structs.AllocsFit(node, append(proposed, alloc), nil)
+	if err != nil {
+		return 0, err
+	}
+	if !fit {
+		return math.Inf(1), nil
+	}
+
+	// Determine the node availability
+	nodeCpu := float64(node.Resources.CPU)
+	nodeMem := float64(node.Resources.MemoryMB)
+	if node.Reserved != nil {
+		nodeCpu -= float64(node.Reserved.CPU)
+		nodeMem -= float64(node.Reserved.MemoryMB)
+	}
+
+	var cost float64
+	if len(proposed) == 0 {
+		cost += 1
+	}
+	if nodeCpu > 0 {
+		cost += float64(after.CPU-before.CPU) / nodeCpu / 2
+	}
+	if nodeMem > 0 {
+		cost += float64(after.MemoryMB-before.MemoryMB) / nodeMem / 2
+	}
+	return cost, nil
+}
+
 func (e *EvalContext) Eligibility() *EvalEligibility {
 	if e.eligibility == nil {
 		e.eligibility = NewEvalEligibility()
@@ -146,6 +567,167 @@ func (e *EvalContext) Eligibility() *EvalEligibility {
 	return e.eligibility
 }
 
+// SetRejectionDetail is used to enable or disable retaining the nodes
+// rejected during feasibility checking.
+func (e *EvalContext) SetRejectionDetail(enabled bool) {
+	e.rejectionDetail = enabled
+}
+
+func (e *EvalContext) RejectNode(node *structs.Node, checker, reason string) {
+	if !e.rejectionDetail || node == nil {
+		return
+	}
+
+	e.rejections = append(e.rejections, NodeRejection{
+		NodeID:  node.ID,
+		Checker: checker,
+		Reason:  reason,
+	})
+}
+
+// InfeasibleNodes returns the nodes rejected since the last Reset along with
+// the checker and reason that rejected them. Rejections are only retained if
+// enabled using SetRejectionDetail.
+func (e *EvalContext) InfeasibleNodes() []NodeRejection {
+	return e.rejections
+}
+
+// SetCordon sets a predicate that excludes matching nodes from placement for
+// the evaluation, for example nodes flagged for maintenance via their meta.
+// Unlike draining, cordoning doesn't affect existing allocations. A nil
+// predicate removes the cordon.
+func (e *EvalContext) SetCordon(cordon func(*structs.Node) bool) {
+	e.cordon = cordon
+}
+
+func (e *EvalContext) Cordoned(node *structs.Node) bool {
+	return e.cordon != nil && e.cordon(node)
+}
+
+// SetNodeAllowList restricts placement for the evaluation to the given node
+// IDs. An empty list allows all nodes.
+func (e *EvalContext) SetNodeAllowList(nodeIDs []string) {
+	e.allowNodes = nodeIDSet(nodeIDs)
+}
+
+// SetNodeDenyList excludes the given node IDs from placement for the
+// evaluation. The deny list takes precedence over the allow list.
+func (e *EvalContext) SetNodeDenyList(nodeIDs []string) {
+	e.denyNodes = nodeIDSet(nodeIDs)
+}
+
+func (e *EvalContext) NodeDenied(node *structs.Node) (bool, string) {
+	if _, ok := e.denyNodes[node.ID]; ok {
+		return true, "node deny-listed"
+	}
+	if e.allowNodes != nil {
+		if _, ok := e.allowNodes[node.ID]; !ok {
+			return true, "node not allow-listed"
+		}
+	}
+	return false, ""
+}
+
+// nodeIDSet returns the set of the node IDs or nil if there are none.
+func nodeIDSet(nodeIDs []string) map[string]struct{} {
+	if len(nodeIDs) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(nodeIDs))
+	for _, id := range nodeIDs {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+// SetClock overrides the clock time based constraints and node health are
+// evaluated against.
+func (e *EvalContext) SetClock(clock func() time.Time) {
+	e.clock = clock
+}
+
+func (e *EvalContext) Now() time.Time {
+	if e.clock == nil {
+		return time.Now()
+	}
+	return e.clock()
+}
+
+func (e *EvalContext) ConsiderNode(node *structs.Node) {
+	e.considered = append(e.considered, node.ID)
+}
+
+// ConsideredNodes returns the IDs of the nodes that entered feasibility
+// checking, before any filtering, since the context was last reset.
+func (e *EvalContext) ConsideredNodes() []string {
+	return e.considered
+}
+
+// SetPlanValidator sets a callback that is invoked with the full proposed
+// plan once placement is complete and before the plan is submitted. A non-nil
+// error vetoes the plan and aborts the evaluation so that it is retried. A nil
+// validator removes the check.
+func (e *EvalContext) SetPlanValidator(validator func(*structs.Plan) error) {
+	e.planValidator = validator
+}
+
+// ValidatePlan invokes the plan validator, if any, on the context's plan.
+func (e *EvalContext) ValidatePlan() error {
+	if e.planValidator == nil {
+		return nil
+	}
+	return e.planValidator(e.plan)
+}
+
+// SetPlacementCap sets the maximum number of allocations of a job that may be
+// placed by the evaluation. Placements beyond the cap are deferred to a
+// follow-up evaluation. A cap of zero removes the limit.
+func (e *EvalContext) SetPlacementCap(cap int) {
+	e.placementCap = cap
+}
+
+// PlacementCap returns the maximum number of placements per job, or zero if
+// unlimited.
+func (e *EvalContext) PlacementCap() int {
+	return e.placementCap
+}
+
+// AllowPlacement must be called before each placement of an allocation of the
+// job. It returns whether the placement may be attempted, recording it as
+// deferred if the job has reached the placement cap.
+func (e *EvalContext) AllowPlacement(jobID string) bool {
+	if e.placementCap <= 0 {
+		return true
+	}
+	if e.placements[jobID] >= e.placementCap {
+		if e.deferred == nil {
+			e.deferred = make(map[string]int)
+		}
+		e.deferred[jobID]++
+		return false
+	}
+	return true
+}
+
+// RecordPlacement must be called after each successful placement of an
+// allocation of the job so that only placements made count against the
+// placement cap.
+func (e *EvalContext) RecordPlacement(jobID string) {
+	if e.placementCap <= 0 {
+		return
+	}
+	if e.placements == nil {
+		e.placements = make(map[string]int)
+	}
+	e.placements[jobID]++
+}
+
+// DeferredPlacements returns the number of placements of the job deferred
+// because the placement cap was reached.
+func (e *EvalContext) DeferredPlacements(jobID string) int {
+	return e.deferred[jobID]
+}
+
 type ComputedClassFeasibility byte
 
 const (
@@ -167,6 +749,248 @@ const (
 	EvalComputedClassEscaped
 )
 
+func (c ComputedClassFeasibility) String() string {
+	switch c {
+	case EvalComputedClassUnknown:
+		return "unknown"
+	case EvalComputedClassIneligible:
+		return "ineligible"
+	case EvalComputedClassEligible:
+		return "eligible"
+	case EvalComputedClassEscaped:
+		return "escaped"
+	default:
+		return fmt.Sprintf("ComputedClassFeasibility(%d)", byte(c))
+	}
+}
+
+// FailureSummary returns a concise, human readable summary of why nodes were
+// rejected during the last placement attempt, suitable for the status
+// description of an evaluation. The causes are ordered by the number of nodes
+// they rejected, with ties broken in a fixed order, so the dominant cause
+// comes first and the summary is deterministic.
+func (e *EvalContext) FailureSummary() string {
+	m := e.metrics
+	if m.NodesEvaluated == 0 {
+		return "no nodes were evaluated"
+	}
+
+	var causes failureCauses
+	if m.NodesExhausted > 0 {
+		causes = append(causes, failureCause{m.NodesExhausted, fmt.Sprintf(
+			"resources exhausted on %s%s", pluralNodes(m.NodesExhausted), dominantReason(m.DimensionExhausted))})
+	}
+	if m.NodesFiltered > 0 {
+		causes = append(causes, failureCause{m.NodesFiltered, fmt.Sprintf(
+			"constraints filtered %s%s", pluralNodes(m.NodesFiltered), dominantReason(m.ConstraintFiltered))})
+	}
+	if m.NodesCordoned > 0 {
+		causes = append(causes, failureCause{m.NodesCordoned, fmt.Sprintf(
+			"%s cordoned", pluralNodes(m.NodesCordoned))})
+	}
+	if m.NodesDenied > 0 {
+		causes = append(causes, failureCause{m.NodesDenied, fmt.Sprintf(
+			"%s excluded by node lists", pluralNodes(m.NodesDenied))})
+	}
+
+	sort.Stable(causes)
+	summaries := make([]string, len(causes))
+	for i, c := range causes {
+		summaries[i] = c.summary
+	}
+	return strings.Join(summaries, ", ")
+}
+
+// failureCause is a cause of node rejection and the number of nodes it
+// rejected.
+type failureCause struct {
+	count   int
+	summary string
+}
+
+// failureCauses sorts failure causes by descending count.
+type failureCauses []failureCause
+
+func (f failureCauses) Len() int           { return len(f) }
+func (f failureCauses) Less(i, j int) bool { return f[i].count > f[j].count }
+func (f failureCauses) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// pluralNodes returns the count of nodes with the noun pluralized.
+func pluralNodes(n int) string {
+	if n == 1 {
+		return "1 node"
+	}
+	return fmt.Sprintf("%d nodes", n)
+}
+
+// dominantReason returns the reason with the highest count formatted for a
+// failure summary, breaking ties by the name of the reason.
+func dominantReason(reasons map[string]int) string {
+	best, max := "", 0
+	for reason, count := range reasons {
+		if count > max || count == max && reason < best {
+			best, max = reason, count
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (mostly %s)", best)
+}
+
+// ValidateJobConstraints checks the constraints of the job, its task groups
+// and tasks before scheduling so that a malformed constraint is reported
+// rather than filtering every node. Regexp, glob and version constraints are
+// compiled into the caches of the context. The first error is returned with
+// the location of the constraint.
+func (e *EvalContext) ValidateJobConstraints(job *structs.Job) error {
+	for _, c := range job.Constraints {
+		if err := validateConstraint(e, c); err != nil {
+			return fmt.Errorf("job %q constraint %q: %v", job.ID, c, err)
+		}
+	}
+	for _, tg := range job.TaskGroups {
+		for _, c := range tg.Constraints {
+			if err := validateConstraint(e, c); err != nil {
+				return fmt.Errorf("group %q constraint %q: %v", tg.Name, c, err)
+			}
+		}
+		for _, task := range tg.Tasks {
+			for _, c := range task.Constraints {
+				if err := validateConstraint(e, c); err != nil {
+					return fmt.Errorf("task %q in group %q constraint %q: %v", task.Name, tg.Name, c, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// FeasibilityWithExtraNodes returns the number of nodes each task group of the
+// job could be placed on if the extra, hypothetical, nodes were added to the
+// ready nodes in the job's datacenters. The extra nodes are not added to the
+// state and only participate in this computation. The nodes are evaluated
+// against the plan of the context using a separate context, see
+// feasibilityContext, so the metrics and eligibility of the context are left
+// untouched.
+func (e *EvalContext) FeasibilityWithExtraNodes(job *structs.Job, extra []*structs.Node) (map[string]int, error) {
+	nodes, _, err := readyNodesInDCs(e.state, job.Datacenters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ready nodes: %v", err)
+	}
+
+	// Filter the extra nodes the same way as the ready nodes
+	dcs := make(map[string]struct{}, len(job.Datacenters))
+	for _, dc := range job.Datacenters {
+		dcs[dc] = struct{}{}
+	}
+	for _, node := range extra {
+		if node.Status != structs.NodeStatusReady || node.Drain {
+			continue
+		}
+		if _, ok := dcs[node.Datacenter]; !ok {
+			continue
+		}
+		if node.ComputedClass == "" {
+			node = node.Copy()
+			if err := node.ComputeClass(); err != nil {
+				return nil, fmt.Errorf("failed to compute class of node %q: %v", node.ID, err)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	return countFeasible(e.feasibilityContext(), job, nodes)
+}
+
+// FeasibilityBatch returns the number of ready nodes each task group of each
+// job could be placed on, keyed by job ID and task group name, as
+// FeasibilityWithExtraNodes does without extra nodes. The nodes are read from
+// the state once and the caches of the context are shared by all the jobs,
+// amortizing the cost of testing many jobs. The plan is not modified.
+func (e *EvalContext) FeasibilityBatch(jobs []*structs.Job) (map[string]map[string]int, error) {
+	// Read the ready nodes of all the jobs' datacenters at once
+	var dcs []string
+	for _, job := range jobs {
+		dcs = append(dcs, job.Datacenters...)
+	}
+	nodes, _, err := readyNodesInDCs(e.state, dcs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ready nodes: %v", err)
+	}
+
+	ctx := e.feasibilityContext()
+	out := make(map[string]map[string]int, len(jobs))
+	for _, job := range jobs {
+		jobDCs := make(map[string]struct{}, len(job.Datacenters))
+		for _, dc := range job.Datacenters {
+			jobDCs[dc] = struct{}{}
+		}
+		var jobNodes []*structs.Node
+		for _, node := range nodes {
+			if _, ok := jobDCs[node.Datacenter]; ok {
+				jobNodes = append(jobNodes, node)
+			}
+		}
+
+		// Eligibility is tracked per job
+		ctx.eligibility = nil
+		counts, err := countFeasible(ctx, job, jobNodes)
+		if err != nil {
+			return nil, err
+		}
+		out[job.ID] = counts
+	}
+	return out, nil
+}
+
+// feasibilityContext returns a context for computing feasibility against the
+// plan of the context. It shares the caches, cordon, node lists, clock and
+// topology rules or attribute cache of the context but has its own metrics
+// and eligibility.
+func (e *EvalContext) feasibilityContext() *EvalContext {
+	// Create the caches so they are shared
+	e.RegexpCache()
+	e.ConstraintCache()
+	e.CIDRCache()
+
+	ctx := NewEvalContext(e.state, e.plan, e.logger)
+	ctx.EvalCache = e.EvalCache
+	ctx.cordon = e.cordon
+	ctx.allowNodes = e.allowNodes
+	ctx.denyNodes = e.denyNodes
+	ctx.clock = e.clock
+	ctx.topologyRules = e.topologyRules
+	ctx.attributeCache = e.attributeCache
+	ctx.failOnStateError = e.failOnStateError
+	return ctx
+}
+
+// countFeasible returns the number of the nodes each task group of the job
+// could be placed on. An error is returned if the state of a node can't be
+// read and the context fails on state errors.
+func countFeasible(ctx *EvalContext, job *structs.Job, nodes []*structs.Node) (map[string]int, error) {
+	stack := NewGenericStack(job.Type == structs.JobTypeBatch, ctx)
+	stack.SetJob(job)
+
+	// Select against each node on its own to count every node the task
+	// group fits on rather than only the best one
+	counts := make(map[string]int, len(job.TaskGroups))
+	for _, tg := range job.TaskGroups {
+		counts[tg.Name] = 0
+		for _, node := range nodes {
+			stack.SetNodes([]*structs.Node{node})
+			if option, _ := stack.Select(tg); option != nil {
+				counts[tg.Name]++
+			}
+		}
+	}
+	if err := ctx.StateErr(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
 // EvalEligibility tracks eligibility of nodes by computed node class over the
 // course of an evaluation.
 type EvalEligibility struct {
@@ -183,6 +1007,15 @@ type EvalEligibility struct {
 	// tgEscapedConstraints is a map of task groups to whether constraints have
 	// escaped.
 	tgEscapedConstraints map[string]bool
+
+	// decisions is the number of job and task group status lookups and
+	// resolved is the number of those that were eligible or ineligible.
+	decisions int
+	resolved  int
+
+	// classNodes is the number of nodes in the evaluation per computed node
+	// class.
+	classNodes map[string]int
 }
 
 // NewEvalEligibility returns an eligibility tracker for the context of an evaluation.
@@ -197,8 +1030,11 @@ func NewEvalEligibility() *EvalEligibility {
 // SetJob takes the job being evaluated and calculates the escaped constraints
 // at the job and task group level.
 func (e *EvalEligibility) SetJob(job *structs.Job) {
-	// Determine whether the job has escaped constraints.
-	e.jobEscaped = len(structs.EscapedConstraints(job.Constraints)) != 0
+	// Determine whether the job has escaped constraints. Job constraints
+	// referencing task group aggregates differ between the task groups so
+	// they can't be cached for the job either.
+	e.jobEscaped = len(structs.EscapedConstraints(job.Constraints)) != 0 ||
+		hasGroupAggregate(job.Constraints)
 
 	// Determine the escaped constraints per task group.
 	for _, tg := range job.TaskGroups {
@@ -262,8 +1098,70 @@ func (e *EvalEligibility) GetClasses() map[string]bool {
 	return elig
 }
 
+// Effectiveness returns the fraction of job and task group status lookups
+// that were resolved to eligible or ineligible rather than being unknown or
+// escaped. A higher value means more feasibility checks were skipped because
+// of the computed node class. Zero is returned if no lookups were made.
+func (e *EvalEligibility) Effectiveness() float64 {
+	if e.decisions == 0 {
+		return 0
+	}
+	return float64(e.resolved) / float64(e.decisions)
+}
+
+// SetClassNodeCount sets the number of nodes in the evaluation that belong to
+// the computed node class.
+func (e *EvalEligibility) SetClassNodeCount(class string, n int) {
+	if e.classNodes == nil {
+		e.classNodes = make(map[string]int)
+	}
+	e.classNodes[class] = n
+}
+
+// MostPopulousClasses returns the computed node classes with a node count,
+// ordered by descending node count and then by class. Resolving the
+// eligibility of the first classes covers the most nodes.
+func (e *EvalEligibility) MostPopulousClasses() []string {
+	classes := make([]string, 0, len(e.classNodes))
+	for class := range e.classNodes {
+		classes = append(classes, class)
+	}
+	sort.Sort(classesByNodeCount{classes, e.classNodes})
+	return classes
+}
+
+// classesByNodeCount sorts classes by descending node count and then by class.
+type classesByNodeCount struct {
+	classes []string
+	counts  map[string]int
+}
+
+func (c classesByNodeCount) Len() int      { return len(c.classes) }
+func (c classesByNodeCount) Swap(i, j int) { c.classes[i], c.classes[j] = c.classes[j], c.classes[i] }
+func (c classesByNodeCount) Less(i, j int) bool {
+	ci, cj := c.counts[c.classes[i]], c.counts[c.classes[j]]
+	if ci != cj {
+		return ci > cj
+	}
+	return c.classes[i] < c.classes[j]
+}
+
+// recordDecision tracks the status returned by a lookup for Effectiveness.
+func (e *EvalEligibility) recordDecision(status ComputedClassFeasibility) ComputedClassFeasibility {
+	e.decisions++
+	switch status {
+	case EvalComputedClassEligible, EvalComputedClassIneligible:
+		e.resolved++
+	}
+	return status
+}
+
 // JobStatus returns the eligibility status of the job.
 func (e *EvalEligibility) JobStatus(class string) ComputedClassFeasibility {
+	return e.recordDecision(e.jobStatus(class))
+}
+
+func (e *EvalEligibility) jobStatus(class string) ComputedClassFeasibility {
 	// COMPAT: Computed node class was introduced in 0.3. Clients running < 0.3
 	// will not have a computed class. The safest value to return is the escaped
 	// case, since it disables any optimization.
@@ -289,6 +1187,10 @@ func (e *EvalEligibility) SetJobEligibility(eligible bool, class string) {
 
 // TaskGroupStatus returns the eligibility status of the task group.
 func (e *EvalEligibility) TaskGroupStatus(tg, class string) ComputedClassFeasibility {
+	return e.recordDecision(e.taskGroupStatus(tg, class))
+}
+
+func (e *EvalEligibility) taskGroupStatus(tg, class string) ComputedClassFeasibility {
 	// COMPAT: Computed node class was introduced in 0.3. Clients running < 0.3
 	// will not have a computed class. The safest value to return is the escaped
 	// case, since it disables any optimization.
@@ -326,3 +1228,50 @@ func (e *EvalEligibility) SetTaskGroupEligibility(eligible bool, tg, class strin
 		e.taskGroups[tg] = map[string]ComputedClassFeasibility{class: eligibility}
 	}
 }
+
+// Dump returns a human readable representation of the eligibility decisions.
+// The escape flags of the job and each task group are listed first, followed
+// by the job and task group status recorded for each computed node class.
+// Classes and task groups are sorted so the output is deterministic.
+func (e *EvalEligibility) Dump() string {
+	groupSet := make(map[string]struct{})
+	for tg := range e.tgEscapedConstraints {
+		groupSet[tg] = struct{}{}
+	}
+	classSet := make(map[string]struct{})
+	for class := range e.job {
+		classSet[class] = struct{}{}
+	}
+	for tg, classes := range e.taskGroups {
+		groupSet[tg] = struct{}{}
+		for class := range classes {
+			classSet[class] = struct{}{}
+		}
+	}
+
+	groups := make([]string, 0, len(groupSet))
+	for tg := range groupSet {
+		groups = append(groups, tg)
+	}
+	sort.Strings(groups)
+	classes := make([]string, 0, len(classSet))
+	for class := range classSet {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	var b bytes.Buffer
+	b.WriteString("escaped:\n")
+	fmt.Fprintf(&b, "  job: %v\n", e.jobEscaped)
+	for _, tg := range groups {
+		fmt.Fprintf(&b, "  group %q: %v\n", tg, e.tgEscapedConstraints[tg])
+	}
+	for _, class := range classes {
+		fmt.Fprintf(&b, "class %q:\n", class)
+		fmt.Fprintf(&b, "  job: %v\n", e.job[class])
+		for _, tg := range groups {
+			fmt.Fprintf(&b, "  group %q: %v\n", tg, e.taskGroups[tg][class])
+		}
+	}
+	return b.String()
+}
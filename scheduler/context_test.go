@@ -1,9 +1,14 @@
 package scheduler
 
 import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/nomad/nomad/mock"
@@ -114,6 +119,284 @@ func TestEvalContext_ProposedAlloc(t *testing.T) {
 	}
 }
 
+func TestEvalContext_ReclaimableAllocs(t *testing.T) {
+	state, ctx := testContext(t)
+	node := mock.Node()
+	noErr(t, state.UpsertNode(998, node))
+
+	// Add a low and a high priority alloc
+	low := mock.Alloc()
+	low.NodeID = node.ID
+	low.Job.Priority = 20
+	high := mock.Alloc()
+	high.NodeID = node.ID
+	high.JobID = low.JobID
+	high.Job.Priority = 80
+	noErr(t, state.UpsertJobSummary(999, mock.JobSummary(low.JobID)))
+	noErr(t, state.UpsertAllocs(1000, []*structs.Allocation{low, high}))
+
+	// Plan an alloc without a job
+	planned := mock.Alloc()
+	planned.NodeID = node.ID
+	planned.Job = nil
+	ctx.Plan().NodeAllocation[node.ID] = []*structs.Allocation{planned}
+
+	reclaimable, err := ctx.ReclaimableAllocs(node.ID, 50)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reclaimable) != 1 || reclaimable[0].ID != low.ID {
+		t.Fatalf("bad: %#v", reclaimable)
+	}
+
+	// Nothing is reclaimable by an equal priority
+	reclaimable, err = ctx.ReclaimableAllocs(node.ID, 20)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reclaimable) != 0 {
+		t.Fatalf("bad: %#v", reclaimable)
+	}
+}
+
+func TestEvalContext_ShuffleNodes(t *testing.T) {
+	nodes := make([]*structs.Node, 10)
+	for i := range nodes {
+		nodes[i] = mock.Node()
+	}
+	shuffle := func(evalID string) []*structs.Node {
+		_, ctx := testContext(t)
+		ctx.SetShuffleSeed(evalShuffleSeed(evalID))
+		out := make([]*structs.Node, len(nodes))
+		copy(out, nodes)
+		ctx.ShuffleNodes(out)
+
+		// The seed is recorded in the metrics, also after a reset
+		ctx.Reset()
+		if ctx.Metrics().ShuffleSeed != evalShuffleSeed(evalID) {
+			t.Fatalf("bad: %#v", ctx.Metrics())
+		}
+		return out
+	}
+
+	// The same eval ID yields the same order
+	evalID := structs.GenerateUUID()
+	first := shuffle(evalID)
+	if !reflect.DeepEqual(first, shuffle(evalID)) {
+		t.Fatalf("shuffle not reproducible")
+	}
+	if reflect.DeepEqual(first, nodes) {
+		t.Fatalf("should not match")
+	}
+
+	// A different eval ID yields a different order
+	if reflect.DeepEqual(first, shuffle(structs.GenerateUUID())) {
+		t.Fatalf("should not match")
+	}
+
+	// Without a seed the metrics are left unset
+	_, ctx := testContext(t)
+	ctx.ShuffleNodes(nodes)
+	if ctx.Metrics().ShuffleSeed != 0 {
+		t.Fatalf("bad: %#v", ctx.Metrics())
+	}
+}
+
+func TestEvalContext_ProposedAllocsForGroup(t *testing.T) {
+	state, ctx := testContext(t)
+	node := mock.Node()
+	noErr(t, state.UpsertNode(998, node))
+
+	// Add existing allocations of two groups and a terminal one
+	job := mock.Job()
+	web := mock.Alloc()
+	web.NodeID = node.ID
+	web.JobID = job.ID
+	web.TaskGroup = "web"
+	evicted := mock.Alloc()
+	evicted.NodeID = node.ID
+	evicted.JobID = job.ID
+	evicted.TaskGroup = "web"
+	cache := mock.Alloc()
+	cache.NodeID = node.ID
+	cache.JobID = job.ID
+	cache.TaskGroup = "cache"
+	stopped := mock.Alloc()
+	stopped.NodeID = node.ID
+	stopped.JobID = job.ID
+	stopped.TaskGroup = "web"
+	stopped.DesiredStatus = structs.AllocDesiredStatusStop
+	noErr(t, state.UpsertJobSummary(999, mock.JobSummary(job.ID)))
+	noErr(t, state.UpsertAllocs(1000, []*structs.Allocation{web, evicted, cache, stopped}))
+
+	// Evict one web alloc, update the other in place and plan a new one of
+	// each group
+	plan := ctx.Plan()
+	plan.NodeUpdate[node.ID] = []*structs.Allocation{evicted}
+	updated := web.Copy()
+	planned := mock.Alloc()
+	planned.NodeID = node.ID
+	planned.TaskGroup = "web"
+	plannedCache := mock.Alloc()
+	plannedCache.NodeID = node.ID
+	plannedCache.TaskGroup = "cache"
+	plan.NodeAllocation[node.ID] = []*structs.Allocation{updated, planned, plannedCache}
+
+	proposed, err := ctx.ProposedAllocsForGroup(node.ID, "web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ids := make(map[string]*structs.Allocation)
+	for _, alloc := range proposed {
+		ids[alloc.ID] = alloc
+	}
+	if len(proposed) != 2 || ids[web.ID] != updated || ids[planned.ID] == nil {
+		t.Fatalf("bad: %#v", proposed)
+	}
+
+	proposed, err = ctx.ProposedAllocsForGroup(node.ID, "cache")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(proposed) != 2 {
+		t.Fatalf("bad: %#v", proposed)
+	}
+
+	proposed, err = ctx.ProposedAllocsForGroup(node.ID, "db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(proposed) != 0 {
+		t.Fatalf("bad: %#v", proposed)
+	}
+}
+
+func TestEvalCache_Stats(t *testing.T) {
+	stats, ok := expvar.Get("nomad.scheduler.eval_cache").(*expvar.Map)
+	if !ok {
+		t.Fatalf("eval cache stats not published")
+	}
+	value := func(name string) int64 {
+		v, ok := stats.Get(name).(*expvar.Int)
+		if !ok {
+			t.Fatalf("missing %q in %s", name, stats)
+		}
+		return v.Value()
+	}
+
+	hits, misses, stores := value("regexp.hits"), value("regexp.misses"), value("regexp.stores")
+	cidrMisses := value("cidr.misses")
+
+	// The first lookup misses and caches the regexp, the second hits
+	_, ctx := testContext(t)
+	for i := 0; i < 2; i++ {
+		if !checkRegexpConstraint(ctx, "foobar", "^foo") {
+			t.Fatalf("should match")
+		}
+	}
+	if value("regexp.hits") != hits+1 || value("regexp.misses") != misses+1 || value("regexp.stores") != stores+1 {
+		t.Fatalf("bad: %s", stats)
+	}
+
+	// A new eval has its own cache
+	_, ctx = testContext(t)
+	checkCIDRConstraint(ctx, "10.0.1.5", "10.0.1.0/24")
+	if value("cidr.misses") != cidrMisses+1 {
+		t.Fatalf("bad: %s", stats)
+	}
+
+	rate, ok := stats.Get("regexp.hit_rate").(expvar.Func)
+	if !ok {
+		t.Fatalf("missing hit rate in %s", stats)
+	}
+	if r := rate().(float64); r <= 0 || r > 1 {
+		t.Fatalf("bad hit rate: %v", r)
+	}
+}
+
+func TestEvalContext_ResetMetrics(t *testing.T) {
+	_, ctx := testContext(t)
+	node := mock.Node()
+	ctx.SetRejectionDetail(true)
+	ctx.Metrics().EvaluateNode()
+	ctx.Metrics().FilterNode(node, "constraint")
+	ctx.RejectNode(node, "constraint", "constraint")
+	ctx.ConsiderNode(node)
+	ctx.Eligibility().SetJobEligibility(true, node.ComputedClass)
+	if !checkRegexpConstraint(ctx, "linux", "^lin") {
+		t.Fatalf("regexp should match")
+	}
+
+	ctx.ResetMetrics()
+	if !reflect.DeepEqual(ctx.Metrics(), new(structs.AllocMetric)) {
+		t.Fatalf("metrics not reset: %#v", ctx.Metrics())
+	}
+
+	// The rest of the context survives
+	if _, ok := ctx.RegexpCache()["^lin"]; !ok {
+		t.Fatalf("regexp cache cleared")
+	}
+	if ctx.Eligibility().JobStatus(node.ComputedClass) != EvalComputedClassEligible {
+		t.Fatalf("eligibility cleared")
+	}
+	if len(ctx.InfeasibleNodes()) != 1 || len(ctx.ConsideredNodes()) != 1 {
+		t.Fatalf("node state cleared")
+	}
+
+	// A full reset clears the node state
+	ctx.Reset()
+	if len(ctx.InfeasibleNodes()) != 0 || len(ctx.ConsideredNodes()) != 0 {
+		t.Fatalf("node state not cleared")
+	}
+}
+
+func TestEvalContext_SetEligibility(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[1].Attributes["rack"] = "r1"
+	nodes[1].ComputeClass()
+
+	// Mark the first node's class as ineligible and the second's task group
+	// as eligible even though neither would be by running the checks.
+	job := mock.Job()
+	job.TaskGroups[0].Constraints = []*structs.Constraint{
+		&structs.Constraint{
+			LTarget: "${attr.kernel.name}",
+			RTarget: "windows",
+			Operand: "=",
+		},
+	}
+	elig := NewEvalEligibility()
+	elig.SetJobEligibility(false, nodes[0].ComputedClass)
+	elig.SetJobEligibility(true, nodes[1].ComputedClass)
+	elig.SetTaskGroupEligibility(true, job.TaskGroups[0].Name, nodes[1].ComputedClass)
+
+	ctx.SetEligibility(elig)
+	if ctx.Eligibility() != elig {
+		t.Fatalf("Eligibility() didn't return the injected tracker")
+	}
+
+	stack := NewSystemStack(ctx)
+	stack.SetNodes(nodes)
+	stack.SetJob(job)
+
+	option, _ := stack.Select(job.TaskGroups[0])
+	if option == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if option.Node != nodes[1] {
+		t.Fatalf("bad: %#v", option)
+	}
+
+	met := ctx.Metrics()
+	if met.ConstraintFiltered["computed class ineligible"] != 1 || len(met.ConstraintFiltered) != 1 {
+		t.Fatalf("bad: %#v", met)
+	}
+}
+
 func TestEvalEligibility_JobStatus(t *testing.T) {
 	e := NewEvalEligibility()
 	cc := "v1:100"
@@ -237,3 +520,697 @@ func TestEvalEligibility_GetClasses(t *testing.T) {
 		t.Fatalf("GetClasses() returned %#v; want %#v", actClasses, expClasses)
 	}
 }
+
+func TestEvalEligibility_Effectiveness(t *testing.T) {
+	// No lookups
+	e := NewEvalEligibility()
+	if eff := e.Effectiveness(); eff != 0 {
+		t.Fatalf("Effectiveness() returned %v; want 0", eff)
+	}
+
+	// Fully resolved
+	e.SetJobEligibility(true, "v1:1")
+	e.SetJobEligibility(false, "v1:2")
+	e.SetTaskGroupEligibility(true, "foo", "v1:1")
+	e.JobStatus("v1:1")
+	e.JobStatus("v1:2")
+	e.TaskGroupStatus("foo", "v1:1")
+	if eff := e.Effectiveness(); eff != 1 {
+		t.Fatalf("Effectiveness() returned %v; want 1", eff)
+	}
+
+	// Partially resolved
+	e = NewEvalEligibility()
+	e.SetJobEligibility(true, "v1:1")
+	e.JobStatus("v1:1")
+	e.JobStatus("v1:2")
+	e.TaskGroupStatus("foo", "v1:1")
+	e.TaskGroupStatus("foo", "")
+	if eff := e.Effectiveness(); eff != 0.25 {
+		t.Fatalf("Effectiveness() returned %v; want 0.25", eff)
+	}
+
+	// All escaped
+	job := mock.Job()
+	job.Constraints = []*structs.Constraint{
+		&structs.Constraint{
+			LTarget: "${node.unique.id}",
+			RTarget: "foo",
+			Operand: "=",
+		},
+	}
+	job.TaskGroups[0].Constraints = job.Constraints
+	e = NewEvalEligibility()
+	e.SetJob(job)
+	e.SetJobEligibility(true, "v1:1")
+	e.SetTaskGroupEligibility(true, job.TaskGroups[0].Name, "v1:1")
+	e.JobStatus("v1:1")
+	e.TaskGroupStatus(job.TaskGroups[0].Name, "v1:1")
+	if eff := e.Effectiveness(); eff != 0 {
+		t.Fatalf("Effectiveness() returned %v; want 0", eff)
+	}
+}
+
+func TestEvalContext_PlacementCost(t *testing.T) {
+	state, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	for i, node := range nodes {
+		noErr(t, state.UpsertNode(uint64(1000+i), node))
+	}
+
+	// Partially use the first node
+	existing := mock.Alloc()
+	existing.NodeID = nodes[0].ID
+	noErr(t, state.UpsertJobSummary(1010, mock.JobSummary(existing.JobID)))
+	noErr(t, state.UpsertAllocs(1011, []*structs.Allocation{existing}))
+
+	alloc := &structs.Allocation{
+		ID: structs.GenerateUUID(),
+		Resources: &structs.Resources{
+			CPU:      390,
+			MemoryMB: 1984,
+		},
+	}
+
+	packed, err := ctx.PlacementCost(nodes[0].ID, alloc)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	opened, err := ctx.PlacementCost(nodes[1].ID, alloc)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if packed >= opened {
+		t.Fatalf("packing cost %v should be less than opening cost %v", packed, opened)
+	}
+
+	// Each node has 3900 CPU and 7936 MB available
+	if math.Abs(packed-0.175) > 1e-9 || math.Abs(opened-1.175) > 1e-9 {
+		t.Fatalf("bad costs: %v %v", packed, opened)
+	}
+
+	// Planned placements are considered
+	ctx.Plan().AppendAlloc(&structs.Allocation{
+		ID:        structs.GenerateUUID(),
+		NodeID:    nodes[1].ID,
+		Resources: alloc.Resources,
+	})
+	if cost, err := ctx.PlacementCost(nodes[1].ID, alloc); err != nil || math.Abs(cost-0.175) > 1e-9 {
+		t.Fatalf("bad cost %v: %v", cost, err)
+	}
+
+	// Allocations that don't fit have an infinite cost
+	alloc.Resources.CPU = 4000
+	if cost, err := ctx.PlacementCost(nodes[1].ID, alloc); err != nil || !math.IsInf(cost, 1) {
+		t.Fatalf("bad cost %v: %v", cost, err)
+	}
+
+	// Missing nodes are an error
+	if _, err := ctx.PlacementCost(structs.GenerateUUID(), alloc); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestEvalContext_ValidateJobConstraints(t *testing.T) {
+	_, ctx := testContext(t)
+	job := mock.Job()
+	job.Constraints = append(job.Constraints,
+		&structs.Constraint{
+			LTarget: "${attr.kernel.version}",
+			RTarget: ">= 3.0",
+			Operand: structs.ConstraintVersion,
+		},
+		&structs.Constraint{
+			LTarget: "${attr.kernel.name}",
+			RTarget: "^lin",
+			Operand: structs.ConstraintRegex,
+		},
+		&structs.Constraint{
+			LTarget: "${meta.cpu_speed}",
+			RTarget: ">= 2GHz",
+			Operand: structs.ConstraintUnits,
+		},
+		&structs.Constraint{
+			LTarget: "${attr.kernel.version}",
+			RTarget: "5.10",
+			Operand: structs.ConstraintPrefix,
+		},
+		&structs.Constraint{
+			LTarget: "${meta.interfaces}",
+			RTarget: ">= 2",
+			Operand: structs.ConstraintListLength,
+		})
+	if err := ctx.ValidateJobConstraints(job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The valid constraints are cached
+	if _, ok := ctx.ConstraintCache()[">= 3.0"]; !ok {
+		t.Fatalf("version constraint not cached")
+	}
+	if _, ok := ctx.RegexpCache()["^lin"]; !ok {
+		t.Fatalf("regexp not cached")
+	}
+}
+
+func TestEvalContext_ValidateJobConstraints_Invalid(t *testing.T) {
+	cases := []struct {
+		Constraint *structs.Constraint
+		Group      bool
+		Task       bool
+		Err        string
+	}{
+		{
+			Constraint: &structs.Constraint{
+				LTarget: "${attr.kernel.name}",
+				RTarget: "(foo",
+				Operand: structs.ConstraintRegex,
+			},
+			Err: `job "foo" constraint "${attr.kernel.name} regexp (foo": invalid regexp`,
+		},
+		{
+			Constraint: &structs.Constraint{
+				LTarget: "${attr.kernel.version}",
+				RTarget: "~> foo",
+				Operand: structs.ConstraintVersion,
+			},
+			Group: true,
+			Err:   `group "web" constraint "${attr.kernel.version} version ~> foo": invalid version constraint`,
+		},
+		{
+			Constraint: &structs.Constraint{
+				LTarget: "${attr.kernel.name}",
+				RTarget: "linux",
+				Operand: "like",
+			},
+			Task: true,
+			Err:  `task "web" in group "web" constraint "${attr.kernel.name} like linux": unknown operator "like"`,
+		},
+		{
+			Constraint: &structs.Constraint{
+				LTarget: "${meta.cpu_speed}",
+				RTarget: ">= 2XHz",
+				Operand: structs.ConstraintUnits,
+			},
+			Err: `invalid units value ">= 2XHz"`,
+		},
+		{
+			Constraint: &structs.Constraint{
+				LTarget: "${attr.unique.network.ip-address}",
+				RTarget: "10.0.1.0/33",
+				Operand: structs.ConstraintCIDR,
+			},
+			Err: `invalid CIDR block "10.0.1.0/33"`,
+		},
+		{
+			Constraint: &structs.Constraint{
+				RTarget: "linux/amd64/>= foo",
+				Operand: structs.ConstraintPlatform,
+			},
+			Err: `invalid version constraint ">= foo" in platform`,
+		},
+		{
+			Constraint: &structs.Constraint{
+				LTarget: "${meta.interfaces}",
+				RTarget: ">= two",
+				Operand: structs.ConstraintListLength,
+			},
+			Err: `invalid list length ">= two"`,
+		},
+	}
+
+	for i, c := range cases {
+		_, ctx := testContext(t)
+		job := mock.Job()
+		job.ID = "foo"
+		tg := job.TaskGroups[0]
+		switch {
+		case c.Task:
+			tg.Tasks[0].Constraints = append(tg.Tasks[0].Constraints, c.Constraint)
+		case c.Group:
+			tg.Constraints = append(tg.Constraints, c.Constraint)
+		default:
+			job.Constraints = append(job.Constraints, c.Constraint)
+		}
+
+		err := ctx.ValidateJobConstraints(job)
+		if err == nil || !strings.Contains(err.Error(), c.Err) {
+			t.Fatalf("case(%d) bad: %v", i, err)
+		}
+	}
+}
+
+func TestEvalContext_ValidateJobConstraints_Interpolated(t *testing.T) {
+	_, ctx := testContext(t)
+	job := mock.Job()
+	job.Constraints = append(job.Constraints, &structs.Constraint{
+		LTarget: "${attr.kernel.name}",
+		RTarget: "${meta.pattern}",
+		Operand: structs.ConstraintRegex,
+	})
+	if err := ctx.ValidateJobConstraints(job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestEvalContext_FailureSummary(t *testing.T) {
+	cases := []struct {
+		Metrics  *structs.AllocMetric
+		Expected string
+	}{
+		{
+			Metrics:  &structs.AllocMetric{},
+			Expected: "no nodes were evaluated",
+		},
+		{
+			Metrics: &structs.AllocMetric{
+				NodesEvaluated:     50,
+				NodesFiltered:      10,
+				ConstraintFiltered: map[string]int{"${attr.kernel.name} = linux": 10},
+				NodesExhausted:     40,
+				DimensionExhausted: map[string]int{"cpu exhausted": 15, "memory exhausted": 25},
+			},
+			Expected: "resources exhausted on 40 nodes (mostly memory exhausted), " +
+				"constraints filtered 10 nodes (mostly ${attr.kernel.name} = linux)",
+		},
+		{
+			Metrics: &structs.AllocMetric{
+				NodesEvaluated:     12,
+				NodesFiltered:      9,
+				ConstraintFiltered: map[string]int{"missing drivers": 6, "distinct_hosts": 3},
+				NodesExhausted:     1,
+				DimensionExhausted: map[string]int{"disk exhausted": 1},
+				NodesCordoned:      2,
+			},
+			Expected: "constraints filtered 9 nodes (mostly missing drivers), " +
+				"2 nodes cordoned, resources exhausted on 1 node (mostly disk exhausted)",
+		},
+		{
+			// Ties keep a fixed order and pick the first reason by name
+			Metrics: &structs.AllocMetric{
+				NodesEvaluated:     4,
+				NodesDenied:        2,
+				NodesExhausted:     2,
+				DimensionExhausted: map[string]int{"memory exhausted": 1, "cpu exhausted": 1},
+			},
+			Expected: "resources exhausted on 2 nodes (mostly cpu exhausted), " +
+				"2 nodes excluded by node lists",
+		},
+	}
+
+	for i, c := range cases {
+		_, ctx := testContext(t)
+		ctx.metrics = c.Metrics
+		if act := ctx.FailureSummary(); act != c.Expected {
+			t.Fatalf("case(%d) bad: got %q; want %q", i, act, c.Expected)
+		}
+	}
+}
+
+func TestEvalContext_FeasibilityWithExtraNodes(t *testing.T) {
+	state, ctx := testContext(t)
+	for i := 0; i < 3; i++ {
+		noErr(t, state.UpsertNode(uint64(1000+i), mock.Node()))
+	}
+
+	// The job only places on nodes in the new rack
+	job := mock.Job()
+	job.Constraints = append(job.Constraints, &structs.Constraint{
+		LTarget: "${meta.rack}",
+		RTarget: "r2",
+		Operand: "=",
+	})
+
+	counts, err := ctx.FeasibilityWithExtraNodes(job, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"web": 0}) {
+		t.Fatalf("bad: %#v", counts)
+	}
+
+	// Only the ready extra nodes in the job's datacenters are counted
+	extra := []*structs.Node{mock.Node(), mock.Node(), mock.Node(), mock.Node()}
+	for _, node := range extra {
+		node.Meta["rack"] = "r2"
+		node.ComputedClass = ""
+	}
+	extra[2].Datacenter = "dc2"
+	extra[3].Status = structs.NodeStatusDown
+
+	counts, err = ctx.FeasibilityWithExtraNodes(job, extra)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"web": 2}) {
+		t.Fatalf("bad: %#v", counts)
+	}
+
+	// The extra nodes are not added to the state
+	for _, node := range extra {
+		out, err := state.NodeByID(node.ID)
+		noErr(t, err)
+		if out != nil {
+			t.Fatalf("extra node added to state: %#v", out)
+		}
+	}
+
+	// The metrics of the context are untouched
+	if ctx.Metrics().NodesEvaluated != 0 {
+		t.Fatalf("bad: %#v", ctx.Metrics())
+	}
+}
+
+func TestEvalContext_FeasibilityBatch(t *testing.T) {
+	state, ctx := testContext(t)
+	nodes := []*structs.Node{mock.Node(), mock.Node(), mock.Node(), mock.Node()}
+	nodes[1].Meta["rack"] = "r2"
+	nodes[2].Datacenter = "dc2"
+	nodes[3].Status = structs.NodeStatusDown
+	for i, node := range nodes {
+		noErr(t, node.ComputeClass())
+		noErr(t, state.UpsertNode(uint64(1000+i), node))
+	}
+
+	// An unconstrained job, a job only placing in a rack, a job of two task
+	// groups in both datacenters and a job constraining on a regexp
+	plain := mock.Job()
+	rack := mock.Job()
+	rack.Constraints = append(rack.Constraints, &structs.Constraint{
+		LTarget: "${meta.rack}",
+		RTarget: "r2",
+		Operand: "=",
+	})
+	multi := mock.Job()
+	multi.Datacenters = []string{"dc1", "dc2"}
+	cache := multi.TaskGroups[0].Copy()
+	cache.Name = "cache"
+	cache.Constraints = append(cache.Constraints, &structs.Constraint{
+		LTarget: "${node.datacenter}",
+		RTarget: "dc2",
+		Operand: "=",
+	})
+	multi.TaskGroups = append(multi.TaskGroups, cache)
+	re := mock.Job()
+	re.Constraints = append(re.Constraints, &structs.Constraint{
+		LTarget: "${attr.kernel.name}",
+		RTarget: "^lin",
+		Operand: structs.ConstraintRegex,
+	})
+	jobs := []*structs.Job{plain, rack, multi, re}
+
+	out, err := ctx.FeasibilityBatch(jobs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != len(jobs) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The batch results match the per job results
+	for _, job := range jobs {
+		counts, err := ctx.FeasibilityWithExtraNodes(job, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(out[job.ID], counts) {
+			t.Fatalf("job %q bad: %#v; want %#v", job.ID, out[job.ID], counts)
+		}
+	}
+	expected := map[string]map[string]int{
+		plain.ID: {"web": 2},
+		rack.ID:  {"web": 1},
+		multi.ID: {"web": 3, "cache": 1},
+		re.ID:    {"web": 2},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The caches are shared with the context
+	if _, ok := ctx.RegexpCache()["^lin"]; !ok {
+		t.Fatalf("regexp not cached")
+	}
+
+	// The plan and metrics of the context are untouched
+	if !ctx.Plan().IsNoOp() {
+		t.Fatalf("bad: %#v", ctx.Plan())
+	}
+	if ctx.Metrics().NodesEvaluated != 0 {
+		t.Fatalf("bad: %#v", ctx.Metrics())
+	}
+}
+
+func TestEvalContext_ValidatePlan(t *testing.T) {
+	_, ctx := testContext(t)
+
+	// No validator never vetoes
+	if err := ctx.ValidatePlan(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var seen *structs.Plan
+	ctx.SetPlanValidator(func(plan *structs.Plan) error {
+		seen = plan
+		return fmt.Errorf("invariant violated")
+	})
+	if err := ctx.ValidatePlan(); err == nil || err.Error() != "invariant violated" {
+		t.Fatalf("bad: %v", err)
+	}
+	if seen != ctx.Plan() {
+		t.Fatalf("validator not passed the context plan: %#v", seen)
+	}
+
+	// Removing the validator clears the veto
+	ctx.SetPlanValidator(nil)
+	if err := ctx.ValidatePlan(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestEvalContext_PlacementCap(t *testing.T) {
+	_, ctx := testContext(t)
+
+	// Without a cap all placements are allowed
+	for i := 0; i < 10; i++ {
+		if !ctx.AllowPlacement("foo") {
+			t.Fatalf("placement %d not allowed", i)
+		}
+	}
+	if deferred := ctx.DeferredPlacements("foo"); deferred != 0 {
+		t.Fatalf("bad: %d", deferred)
+	}
+
+	_, ctx = testContext(t)
+	ctx.SetPlacementCap(3)
+
+	// Placements that aren't made don't count against the cap
+	for i := 0; i < 5; i++ {
+		if !ctx.AllowPlacement("foo") {
+			t.Fatalf("placement %d not allowed", i)
+		}
+	}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if ctx.AllowPlacement("foo") {
+			ctx.RecordPlacement("foo")
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("bad: %d", allowed)
+	}
+	if deferred := ctx.DeferredPlacements("foo"); deferred != 7 {
+		t.Fatalf("bad: %d", deferred)
+	}
+
+	// The cap is per job
+	if !ctx.AllowPlacement("bar") || ctx.DeferredPlacements("bar") != 0 {
+		t.Fatalf("other job should not be capped")
+	}
+}
+
+func TestEvalEligibility_MostPopulousClasses(t *testing.T) {
+	e := NewEvalEligibility()
+	if classes := e.MostPopulousClasses(); len(classes) != 0 {
+		t.Fatalf("bad: %#v", classes)
+	}
+
+	e.SetClassNodeCount("v1:1", 3)
+	e.SetClassNodeCount("v1:2", 40)
+	e.SetClassNodeCount("v1:4", 3)
+	e.SetClassNodeCount("v1:3", 12)
+
+	expected := []string{"v1:2", "v1:3", "v1:1", "v1:4"}
+	if classes := e.MostPopulousClasses(); !reflect.DeepEqual(classes, expected) {
+		t.Fatalf("bad: %#v", classes)
+	}
+
+	// Updating a count re-ranks the class
+	e.SetClassNodeCount("v1:4", 50)
+	expected = []string{"v1:4", "v1:2", "v1:3", "v1:1"}
+	if classes := e.MostPopulousClasses(); !reflect.DeepEqual(classes, expected) {
+		t.Fatalf("bad: %#v", classes)
+	}
+}
+
+func TestEvalEligibility_GroupAggregateEscapes(t *testing.T) {
+	e := NewEvalEligibility()
+	job := mock.Job()
+	job.Constraints = append(job.Constraints, &structs.Constraint{
+		Operand: ">=",
+		LTarget: "${attr.cpu.numcores}",
+		RTarget: "${group.tasks}",
+	})
+
+	// Job constraints referencing task group aggregates can't be cached
+	e.SetJob(job)
+	if !e.HasEscaped() {
+		t.Fatalf("job should have escaped")
+	}
+}
+
+func TestEvalEligibility_Dump(t *testing.T) {
+	e := NewEvalEligibility()
+	job := mock.Job()
+	cache := job.TaskGroups[0].Copy()
+	cache.Name = "cache"
+	cache.Constraints = append(cache.Constraints, &structs.Constraint{
+		LTarget: "${attr.unique.hostname}",
+		RTarget: "foo",
+		Operand: "=",
+	})
+	job.TaskGroups = append(job.TaskGroups, cache)
+	e.SetJob(job)
+
+	e.SetJobEligibility(true, "v1:1")
+	e.SetJobEligibility(false, "v1:2")
+	e.SetTaskGroupEligibility(true, "web", "v1:1")
+	e.SetTaskGroupEligibility(false, "web", "v1:3")
+
+	golden, err := ioutil.ReadFile("test-fixtures/eligibility_dump.golden")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := e.Dump(); out != string(golden) {
+		t.Fatalf("bad dump, got:\n%s\nwant:\n%s", out, golden)
+	}
+}
+
+func TestEvalContext_MetricsKeyLimit(t *testing.T) {
+	_, ctx := testContext(t)
+	ctx.SetMetricsKeyLimit(2)
+
+	// Filter nodes on more distinct constraints than the limit
+	node := mock.Node()
+	for i := 0; i < 3; i++ {
+		ctx.Metrics().FilterNode(node, "a")
+	}
+	ctx.Metrics().FilterNode(node, "b")
+	ctx.Metrics().FilterNode(node, "c")
+	ctx.Metrics().FilterNode(node, "d")
+	ctx.Metrics().FilterNode(node, "a")
+
+	// The dominant reasons are kept and the rest coalesced
+	expected := map[string]int{"a": 4, "b": 1, structs.AllocMetricOtherKey: 2}
+	if m := ctx.Metrics().ConstraintFiltered; !reflect.DeepEqual(m, expected) {
+		t.Fatalf("bad: %#v", m)
+	}
+	if ctx.Metrics().NodesFiltered != 7 {
+		t.Fatalf("bad: %#v", ctx.Metrics())
+	}
+
+	// The limit applies after a reset
+	ctx.Reset()
+	ctx.Metrics().ExhaustedNode(node, "cpu exhausted")
+	ctx.Metrics().ExhaustedNode(node, "memory exhausted")
+	ctx.Metrics().ExhaustedNode(node, "disk exhausted")
+	if m := ctx.Metrics().DimensionExhausted; len(m) != 3 || m[structs.AllocMetricOtherKey] != 1 {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	// Removing the limit tracks all keys
+	ctx.SetMetricsKeyLimit(0)
+	ctx.Reset()
+	for _, reason := range []string{"a", "b", "c", "d"} {
+		ctx.Metrics().FilterNode(node, reason)
+	}
+	if m := ctx.Metrics().ConstraintFiltered; len(m) != 4 {
+		t.Fatalf("bad: %#v", m)
+	}
+}
+
+// stateErrorState is a State failing to read the allocations of a node or of
+// a job.
+type stateErrorState struct {
+	State
+	nodeID string
+	jobID  string
+}
+
+func (s *stateErrorState) AllocsByNode(node string) ([]*structs.Allocation, error) {
+	if node == s.nodeID {
+		return nil, fmt.Errorf("transient error")
+	}
+	return s.State.AllocsByNode(node)
+}
+
+func (s *stateErrorState) AllocsByNodeTerminal(node string, terminal bool) ([]*structs.Allocation, error) {
+	if node == s.nodeID {
+		return nil, fmt.Errorf("transient error")
+	}
+	return s.State.AllocsByNodeTerminal(node, terminal)
+}
+
+func (s *stateErrorState) AllocsByJob(jobID string) ([]*structs.Allocation, error) {
+	if jobID == s.jobID {
+		return nil, fmt.Errorf("transient error")
+	}
+	return s.State.AllocsByJob(jobID)
+}
+
+func TestEvalContext_StateError(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		state, ctx := testContext(t)
+		nodes := []*structs.Node{mock.Node(), mock.Node()}
+		for i, node := range nodes {
+			noErr(t, state.UpsertNode(uint64(1000+i), node))
+		}
+		failing := nodes[0]
+		ctx.SetState(&stateErrorState{State: state, nodeID: failing.ID})
+		ctx.SetFailOnStateError(fail)
+
+		stack := NewGenericStack(false, ctx)
+		stack.SetNodes(nodes)
+		job := mock.Job()
+		stack.SetJob(job)
+
+		// The node with the state error is never selected
+		option, _ := stack.Select(job.TaskGroups[0])
+		if option == nil || option.Node == failing {
+			t.Fatalf("fail %v bad: %#v", fail, option)
+		}
+
+		// The node is skipped as infeasible
+		metrics := ctx.Metrics()
+		if metrics.NodesSkipped != 1 || metrics.NodesFiltered != 1 || metrics.ConstraintFiltered["state error"] != 1 {
+			t.Fatalf("bad: %#v", metrics)
+		}
+
+		// The error is only retained to fail the placement if enabled
+		err := ctx.StateErr()
+		if !fail {
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "transient error") {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"sort"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// PlanDelta is the net change the plan of an evaluation makes to the
+// allocations of a baseline state.
+type PlanDelta struct {
+	// Create is the allocations placed that don't replace an allocation
+	Create []*structs.Allocation
+
+	// Destroy is the allocations stopped without a replacement
+	Destroy []*structs.Allocation
+
+	// Move is the allocations replaced on a different node
+	Move []*AllocMove
+}
+
+// AllocMove describes an allocation moved between nodes.
+type AllocMove struct {
+	// Alloc is the allocation on the new node
+	Alloc *structs.Allocation
+
+	// From and To are the IDs of the previous and the new node
+	From string
+	To   string
+}
+
+// PlanDelta compares the allocations proposed by the plan against the running
+// allocations of the baseline on the nodes touched by the plan. An allocation
+// is identified by its job and name so that a replacement placed on another
+// node is classified as a move. Replacements and in-place updates on the same
+// node aren't changes.
+func (e *EvalContext) PlanDelta(baseline State) (*PlanDelta, error) {
+	nodes := make(map[string]struct{})
+	for nodeID := range e.plan.NodeUpdate {
+		nodes[nodeID] = struct{}{}
+	}
+	for nodeID := range e.plan.NodeAllocation {
+		nodes[nodeID] = struct{}{}
+	}
+
+	// Index the allocations before and after the plan by identity
+	before := make(map[string]*structs.Allocation)
+	after := make(map[string]*structs.Allocation)
+	for nodeID := range nodes {
+		existing, err := baseline.AllocsByNodeTerminal(nodeID, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, alloc := range existing {
+			before[allocIdentity(alloc)] = alloc
+		}
+
+		proposed, err := e.ProposedAllocs(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		for _, alloc := range proposed {
+			after[allocIdentity(alloc)] = alloc
+		}
+	}
+
+	delta := new(PlanDelta)
+	for id, alloc := range after {
+		prev, ok := before[id]
+		switch {
+		case !ok:
+			delta.Create = append(delta.Create, alloc)
+		case prev.NodeID != alloc.NodeID:
+			delta.Move = append(delta.Move, &AllocMove{
+				Alloc: alloc,
+				From:  prev.NodeID,
+				To:    alloc.NodeID,
+			})
+		}
+	}
+	for id, alloc := range before {
+		if _, ok := after[id]; !ok {
+			delta.Destroy = append(delta.Destroy, alloc)
+		}
+	}
+
+	// Sort the changes so the delta is deterministic
+	sort.Sort(allocsByIdentity(delta.Create))
+	sort.Sort(allocsByIdentity(delta.Destroy))
+	sort.Sort(movesByIdentity(delta.Move))
+	return delta, nil
+}
+
+// allocIdentity returns the identity of an allocation that is preserved when
+// it is replaced.
+func allocIdentity(alloc *structs.Allocation) string {
+	return alloc.JobID + "/" + alloc.Name
+}
+
+// allocsByIdentity sorts allocations by their identity.
+type allocsByIdentity []*structs.Allocation
+
+func (a allocsByIdentity) Len() int           { return len(a) }
+func (a allocsByIdentity) Less(i, j int) bool { return allocIdentity(a[i]) < allocIdentity(a[j]) }
+func (a allocsByIdentity) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// movesByIdentity sorts moves by the identity of the allocation.
+type movesByIdentity []*AllocMove
+
+func (m movesByIdentity) Len() int { return len(m) }
+func (m movesByIdentity) Less(i, j int) bool {
+	return allocIdentity(m[i].Alloc) < allocIdentity(m[j].Alloc)
+}
+func (m movesByIdentity) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
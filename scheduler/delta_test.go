@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestEvalContext_PlanDelta(t *testing.T) {
+	state, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	for i, node := range nodes {
+		noErr(t, state.UpsertNode(uint64(900+i), node))
+	}
+
+	// Run three allocations of the job on the first two nodes
+	job := mock.Job()
+	var running []*structs.Allocation
+	for i, name := range []string{"web[0]", "web[1]", "web[2]"} {
+		alloc := mock.Alloc()
+		alloc.JobID = job.ID
+		alloc.Name = name
+		alloc.NodeID = nodes[i%2].ID
+		running = append(running, alloc)
+	}
+	noErr(t, state.UpsertJobSummary(999, mock.JobSummary(job.ID)))
+	noErr(t, state.UpsertAllocs(1000, running))
+
+	// Stop web[0], move web[1] to the last node, update web[2] in place and
+	// create web[3].
+	plan := ctx.Plan()
+	plan.NodeUpdate[nodes[0].ID] = []*structs.Allocation{running[0], running[2]}
+	plan.NodeUpdate[nodes[1].ID] = []*structs.Allocation{running[1]}
+
+	moved := running[1].Copy()
+	moved.ID = structs.GenerateUUID()
+	moved.NodeID = nodes[2].ID
+	updated := running[2].Copy()
+	created := mock.Alloc()
+	created.JobID = job.ID
+	created.Name = "web[3]"
+	created.NodeID = nodes[1].ID
+	plan.NodeAllocation[nodes[0].ID] = []*structs.Allocation{updated}
+	plan.NodeAllocation[nodes[1].ID] = []*structs.Allocation{created}
+	plan.NodeAllocation[nodes[2].ID] = []*structs.Allocation{moved}
+
+	delta, err := ctx.PlanDelta(state)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(delta.Create) != 1 || delta.Create[0] != created {
+		t.Fatalf("bad create: %#v", delta.Create)
+	}
+	if len(delta.Destroy) != 1 || delta.Destroy[0].ID != running[0].ID {
+		t.Fatalf("bad destroy: %#v", delta.Destroy)
+	}
+	if len(delta.Move) != 1 {
+		t.Fatalf("bad move: %#v", delta.Move)
+	}
+	move := delta.Move[0]
+	if move.Alloc != moved || move.From != nodes[1].ID || move.To != nodes[2].ID {
+		t.Fatalf("bad move: %#v", move)
+	}
+}
+
+func TestEvalContext_PlanDelta_Empty(t *testing.T) {
+	state, ctx := testContext(t)
+	delta, err := ctx.PlanDelta(state)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(delta.Create) != 0 || len(delta.Destroy) != 0 || len(delta.Move) != 0 {
+		t.Fatalf("bad: %#v", delta)
+	}
+}
@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// FeasibilityExportVersion is the version of the exported feasibility
+	// format. It must be incremented on any incompatible change to the
+	// exported structs.
+	FeasibilityExportVersion = 1
+)
+
+// FeasibilityExport is a stable representation of the feasibility and
+// ranking results of a placement attempt. It is decoupled from the internal
+// scheduler structs so it can be consumed by external tools such as a
+// scheduler simulator.
+type FeasibilityExport struct {
+	// Version is the version of the export format
+	Version int `json:"version"`
+
+	// NodesEvaluated is the number of nodes that were evaluated
+	NodesEvaluated int `json:"nodes_evaluated"`
+
+	// NodesFiltered is the number of nodes filtered by a checker
+	NodesFiltered int `json:"nodes_filtered"`
+
+	// NodesExhausted is the number of nodes exhausted of a resource
+	NodesExhausted int `json:"nodes_exhausted"`
+
+	// Nodes is the per node result sorted by node ID
+	Nodes []*NodeFeasibilityExport `json:"nodes"`
+}
+
+// NodeFeasibilityExport is the exported result for a single node.
+type NodeFeasibilityExport struct {
+	// NodeID is the ID of the node
+	NodeID string `json:"node_id"`
+
+	// Feasible is whether the node was feasible and ranked
+	Feasible bool `json:"feasible"`
+
+	// Checker and Reason describe why the node was rejected if infeasible
+	Checker string `json:"checker,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+
+	// Score is the sum of the scores applied to a feasible node
+	Score float64 `json:"score"`
+
+	// Scores is the score applied to a feasible node by each ranker
+	Scores map[string]float64 `json:"scores,omitempty"`
+}
+
+// ExportFeasibility converts the results of the last placement attempt in the
+// context into a FeasibilityExport. Infeasible nodes are only included if
+// rejection details were enabled on the context.
+func ExportFeasibility(ctx *EvalContext) *FeasibilityExport {
+	metrics := ctx.Metrics()
+	out := &FeasibilityExport{
+		Version:        FeasibilityExportVersion,
+		NodesEvaluated: metrics.NodesEvaluated,
+		NodesFiltered:  metrics.NodesFiltered,
+		NodesExhausted: metrics.NodesExhausted,
+	}
+
+	nodes := make(map[string]*NodeFeasibilityExport)
+	for _, r := range ctx.InfeasibleNodes() {
+		nodes[r.NodeID] = &NodeFeasibilityExport{
+			NodeID:  r.NodeID,
+			Checker: r.Checker,
+			Reason:  r.Reason,
+		}
+	}
+
+	// Scores are keyed by the node ID and the ranker name separated by a dot.
+	for key, score := range metrics.Scores {
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		node, ok := nodes[parts[0]]
+		if !ok {
+			node = &NodeFeasibilityExport{NodeID: parts[0]}
+			nodes[parts[0]] = node
+		}
+		if node.Scores == nil {
+			node.Scores = make(map[string]float64)
+		}
+		node.Feasible = true
+		node.Scores[parts[1]] = score
+		node.Score += score
+	}
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		out.Nodes = append(out.Nodes, nodes[id])
+	}
+	return out
+}
+
+// DecodeFeasibilityExport decodes a JSON encoded FeasibilityExport, returning
+// an error if the version is not understood.
+func DecodeFeasibilityExport(buf []byte) (*FeasibilityExport, error) {
+	var out FeasibilityExport
+	if err := json.Unmarshal(buf, &out); err != nil {
+		return nil, err
+	}
+	if out.Version != FeasibilityExportVersion {
+		return nil, fmt.Errorf("unsupported feasibility export version %d", out.Version)
+	}
+	return &out, nil
+}
@@ -0,0 +1,117 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestExportFeasibility(t *testing.T) {
+	_, ctx := testContext(t)
+	ctx.SetRejectionDetail(true)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	delete(nodes[0].Attributes, "driver.exec")
+	nodes[0].ComputeClass()
+
+	stack := NewSystemStack(ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	stack.SetJob(job)
+	option, _ := stack.Select(job.TaskGroups[0])
+	if option == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+
+	out := ExportFeasibility(ctx)
+	if out.Version != FeasibilityExportVersion {
+		t.Fatalf("bad version: %d", out.Version)
+	}
+	if out.NodesEvaluated != 2 || out.NodesFiltered != 1 || out.NodesExhausted != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if len(out.Nodes) != 2 {
+		t.Fatalf("bad: %#v", out.Nodes)
+	}
+
+	exported := make(map[string]*NodeFeasibilityExport)
+	for _, n := range out.Nodes {
+		exported[n.NodeID] = n
+	}
+
+	rejected := exported[nodes[0].ID]
+	if rejected == nil || rejected.Feasible || rejected.Checker != "driver" || rejected.Reason != "missing drivers" {
+		t.Fatalf("bad: %#v", rejected)
+	}
+
+	feasible := exported[nodes[1].ID]
+	if feasible == nil || !feasible.Feasible || feasible.Score != option.Score {
+		t.Fatalf("bad: %#v", feasible)
+	}
+	if _, ok := feasible.Scores["binpack"]; !ok {
+		t.Fatalf("missing binpack score: %#v", feasible.Scores)
+	}
+}
+
+func TestExportFeasibility_RoundTrip(t *testing.T) {
+	in := &FeasibilityExport{
+		Version:        FeasibilityExportVersion,
+		NodesEvaluated: 2,
+		NodesFiltered:  1,
+		Nodes: []*NodeFeasibilityExport{
+			{
+				NodeID:  "a",
+				Checker: "constraint",
+				Reason:  "${attr.kernel.name} = linux",
+			},
+			{
+				NodeID:   "b",
+				Feasible: true,
+				Score:    12.5,
+				Scores:   map[string]float64{"binpack": 12.5},
+			},
+		},
+	}
+
+	buf, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := DecodeFeasibilityExport(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Check the wire field names are stable
+	var raw map[string]interface{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, field := range []string{"version", "nodes_evaluated", "nodes_filtered", "nodes_exhausted", "nodes"} {
+		if _, ok := raw[field]; !ok {
+			t.Fatalf("missing field %q: %s", field, buf)
+		}
+	}
+	node := raw["nodes"].([]interface{})[1].(map[string]interface{})
+	for _, field := range []string{"node_id", "feasible", "score", "scores"} {
+		if _, ok := node[field]; !ok {
+			t.Fatalf("missing node field %q: %s", field, buf)
+		}
+	}
+}
+
+func TestDecodeFeasibilityExport_Version(t *testing.T) {
+	if _, err := DecodeFeasibilityExport([]byte(`{"version": 99}`)); err == nil {
+		t.Fatalf("expected version error")
+	}
+}
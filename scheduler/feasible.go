@@ -1,11 +1,16 @@
 package scheduler
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"net"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-version"
 	"github.com/hashicorp/nomad/nomad/structs"
@@ -64,6 +69,7 @@ func (iter *StaticIterator) Next() *structs.Node {
 	iter.offset += 1
 	iter.seen += 1
 	iter.ctx.Metrics().EvaluateNode()
+	iter.ctx.ConsiderNode(iter.nodes[offset])
 	return iter.nodes[offset]
 }
 
@@ -79,15 +85,169 @@ func (iter *StaticIterator) SetNodes(nodes []*structs.Node) {
 
 // NewRandomIterator constructs a static iterator from a list of nodes
 // after applying the Fisher-Yates algorithm for a random shuffle. This
-// is applied in-place
+// is applied in-place and is deterministic if the context has a shuffle seed.
 func NewRandomIterator(ctx Context, nodes []*structs.Node) *StaticIterator {
 	// shuffle with the Fisher-Yates algorithm
-	shuffleNodes(nodes)
+	ctx.ShuffleNodes(nodes)
 
 	// Create a static iterator
 	return NewStaticIterator(ctx, nodes)
 }
 
+// NodeListIterator is a FeasibleIterator which filters out the nodes excluded
+// by the node allow and deny lists of the evaluation. It is applied before any
+// other feasibility checks.
+type NodeListIterator struct {
+	ctx    Context
+	source FeasibleIterator
+}
+
+// NewNodeListIterator creates a NodeListIterator from a source.
+func NewNodeListIterator(ctx Context, source FeasibleIterator) *NodeListIterator {
+	return &NodeListIterator{
+		ctx:    ctx,
+		source: source,
+	}
+}
+
+func (iter *NodeListIterator) Next() *structs.Node {
+	for {
+		option := iter.source.Next()
+		if option == nil {
+			return nil
+		}
+
+		denied, reason := iter.ctx.NodeDenied(option)
+		if !denied {
+			return option
+		}
+
+		iter.ctx.Metrics().DenyNode()
+		iter.ctx.RejectNode(option, "node-list", reason)
+	}
+}
+
+func (iter *NodeListIterator) Reset() {
+	iter.source.Reset()
+}
+
+// CordonIterator is a FeasibleIterator which filters out the nodes cordoned
+// for the evaluation. It is applied before any other feasibility checks.
+type CordonIterator struct {
+	ctx    Context
+	source FeasibleIterator
+}
+
+// NewCordonIterator creates a CordonIterator from a source.
+func NewCordonIterator(ctx Context, source FeasibleIterator) *CordonIterator {
+	return &CordonIterator{
+		ctx:    ctx,
+		source: source,
+	}
+}
+
+func (iter *CordonIterator) Next() *structs.Node {
+	for {
+		option := iter.source.Next()
+		if option == nil || !iter.ctx.Cordoned(option) {
+			return option
+		}
+
+		iter.ctx.Metrics().CordonNode()
+		iter.ctx.RejectNode(option, "cordon", "node cordoned")
+	}
+}
+
+func (iter *CordonIterator) Reset() {
+	iter.source.Reset()
+}
+
+// nodeFailureEvents are the task events that indicate a problem with the node
+// rather than the task.
+var nodeFailureEvents = map[string]struct{}{
+	structs.TaskDriverFailure:          struct{}{},
+	structs.TaskArtifactDownloadFailed: struct{}{},
+	structs.TaskDiskExceeded:           struct{}{},
+}
+
+// NodeHealthIterator is a FeasibleIterator which filters out nodes that have
+// recently flapped. Nodes don't record an event history so the history is
+// built from the task events of the allocations the node has run. A node is
+// filtered if more than the threshold of failure events occurred within the
+// window. Nodes without allocations have no history and are healthy.
+type NodeHealthIterator struct {
+	ctx       Context
+	source    FeasibleIterator
+	window    time.Duration
+	threshold int
+}
+
+// NewNodeHealthIterator creates a NodeHealthIterator from a source. A zero
+// threshold disables the iterator.
+func NewNodeHealthIterator(ctx Context, source FeasibleIterator, window time.Duration, threshold int) *NodeHealthIterator {
+	return &NodeHealthIterator{
+		ctx:       ctx,
+		source:    source,
+		window:    window,
+		threshold: threshold,
+	}
+}
+
+// SetHealth sets the window failures are counted over and the number of
+// failures a node may have within the window.
+func (iter *NodeHealthIterator) SetHealth(window time.Duration, threshold int) {
+	iter.window = window
+	iter.threshold = threshold
+}
+
+func (iter *NodeHealthIterator) Next() *structs.Node {
+	for {
+		option := iter.source.Next()
+		if option == nil || iter.threshold == 0 {
+			return option
+		}
+
+		failures, err := iter.failures(option)
+		if err != nil {
+			iter.ctx.StateError(option, "node-health", err)
+			continue
+		}
+		if failures <= iter.threshold {
+			return option
+		}
+
+		iter.ctx.Metrics().FilterNode(option, "node-health")
+		iter.ctx.RejectNode(option, "node-health",
+			fmt.Sprintf("%d failures in the last %v", failures, iter.window))
+	}
+}
+
+// failures returns the number of failure events on the node within the
+// window.
+func (iter *NodeHealthIterator) failures(node *structs.Node) (int, error) {
+	allocs, err := iter.ctx.State().AllocsByNode(node.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	since := iter.ctx.Now().Add(-iter.window).UnixNano()
+	failures := 0
+	for _, alloc := range allocs {
+		for _, state := range alloc.TaskStates {
+			for _, event := range state.Events {
+				if _, ok := nodeFailureEvents[event.Type]; ok && event.Time >= since {
+					failures++
+				}
+			}
+		}
+	}
+	return failures, nil
+}
+
+func (iter *NodeHealthIterator) Reset() {
+	iter.source.Reset()
+}
+
 // DriverChecker is a FeasibilityChecker which returns whether a node has the
 // drivers necessary to scheduler a task group.
 type DriverChecker struct {
@@ -107,12 +267,18 @@ func (c *DriverChecker) SetDrivers(d map[string]struct{}) {
 	c.drivers = d
 }
 
+func (c *DriverChecker) copyChecker() FeasibilityChecker {
+	copy := *c
+	return &copy
+}
+
 func (c *DriverChecker) Feasible(option *structs.Node) bool {
 	// Use this node if possible
 	if c.hasDrivers(option) {
 		return true
 	}
 	c.ctx.Metrics().FilterNode(option, "missing drivers")
+	c.ctx.RejectNode(option, "driver", "missing drivers")
 	return false
 }
 
@@ -157,6 +323,18 @@ type ProposedAllocConstraintIterator struct {
 	// they don't have to be calculated every time Next() is called.
 	tgDistinctHosts  bool
 	jobDistinctHosts bool
+
+	// Store the targets of the distinct_property constraints of the Job and
+	// TaskGroup.
+	tgDistinctProperties  []string
+	jobDistinctProperties []string
+
+	// usedProperties is the values of the distinct properties, keyed by
+	// target, used by the proposed allocations of the job and task group. It
+	// is computed on the first call to Next after a reset.
+	jobUsedProperties map[string]map[string]struct{}
+	tgUsedProperties  map[string]map[string]struct{}
+	usedComputed      bool
 }
 
 // NewProposedAllocConstraintIterator creates a ProposedAllocConstraintIterator
@@ -171,11 +349,27 @@ func NewProposedAllocConstraintIterator(ctx Context, source FeasibleIterator) *P
 func (iter *ProposedAllocConstraintIterator) SetTaskGroup(tg *structs.TaskGroup) {
 	iter.tg = tg
 	iter.tgDistinctHosts = iter.hasDistinctHostsConstraint(tg.Constraints)
+	iter.tgDistinctProperties = distinctPropertyTargets(tg.Constraints)
+	iter.usedComputed = false
 }
 
 func (iter *ProposedAllocConstraintIterator) SetJob(job *structs.Job) {
 	iter.job = job
 	iter.jobDistinctHosts = iter.hasDistinctHostsConstraint(job.Constraints)
+	iter.jobDistinctProperties = distinctPropertyTargets(job.Constraints)
+	iter.usedComputed = false
+}
+
+// distinctPropertyTargets returns the targets of the distinct_property
+// constraints.
+func distinctPropertyTargets(constraints []*structs.Constraint) []string {
+	var targets []string
+	for _, con := range constraints {
+		if con.Operand == structs.ConstraintDistinctProperty {
+			targets = append(targets, con.LTarget)
+		}
+	}
+	return targets
 }
 
 func (iter *ProposedAllocConstraintIterator) hasDistinctHostsConstraint(constraints []*structs.Constraint) bool {
@@ -192,13 +386,33 @@ func (iter *ProposedAllocConstraintIterator) Next() *structs.Node {
 		// Get the next option from the source
 		option := iter.source.Next()
 
-		// Hot-path if the option is nil or there are no distinct_hosts constraints.
-		if option == nil || !(iter.jobDistinctHosts || iter.tgDistinctHosts) {
+		// Hot-path if the option is nil or there are no distinct_hosts or
+		// distinct_property constraints.
+		if option == nil || !(iter.jobDistinctHosts || iter.tgDistinctHosts ||
+			len(iter.jobDistinctProperties) != 0 || len(iter.tgDistinctProperties) != 0) {
 			return option
 		}
 
-		if !iter.satisfiesDistinctHosts(option) {
+		ok, err := iter.satisfiesDistinctHosts(option)
+		if err != nil {
+			iter.ctx.StateError(option, "distinct-hosts", err)
+			continue
+		}
+		if !ok {
 			iter.ctx.Metrics().FilterNode(option, structs.ConstraintDistinctHosts)
+			iter.ctx.RejectNode(option, "distinct-hosts", structs.ConstraintDistinctHosts)
+			continue
+		}
+
+		target, ok, err := iter.satisfiesDistinctProperties(option)
+		if err != nil {
+			iter.ctx.StateError(option, "distinct-property", err)
+			continue
+		}
+		if !ok {
+			reason := fmt.Sprintf("%s %s", structs.ConstraintDistinctProperty, target)
+			iter.ctx.Metrics().FilterNode(option, reason)
+			iter.ctx.RejectNode(option, "distinct-property", reason)
 			continue
 		}
 
@@ -206,20 +420,137 @@ func (iter *ProposedAllocConstraintIterator) Next() *structs.Node {
 	}
 }
 
+// satisfiesDistinctProperties checks if the node satisfies the
+// distinct_property constraints specified at the job level or the TaskGroup
+// level. A property value may only be used by a single allocation of the job,
+// or of the TaskGroup for a TaskGroup constraint. If a constraint is not
+// satisfied, its target is returned. An error is returned if the used values
+// can't be read from the state.
+func (iter *ProposedAllocConstraintIterator) satisfiesDistinctProperties(option *structs.Node) (string, bool, error) {
+	if len(iter.jobDistinctProperties) == 0 && len(iter.tgDistinctProperties) == 0 {
+		return "", true, nil
+	}
+	if !iter.usedComputed {
+		if err := iter.computeUsedProperties(); err != nil {
+			return "", false, err
+		}
+	}
+
+	for _, target := range iter.jobDistinctProperties {
+		if !iter.propertyUnused(iter.jobUsedProperties, target, option) {
+			return target, false, nil
+		}
+	}
+	for _, target := range iter.tgDistinctProperties {
+		if !iter.propertyUnused(iter.tgUsedProperties, target, option) {
+			return target, false, nil
+		}
+	}
+	return "", true, nil
+}
+
+// propertyUnused returns whether the value of the property of the node is not
+// used. Nodes without the property never satisfy the constraint.
+func (iter *ProposedAllocConstraintIterator) propertyUnused(used map[string]map[string]struct{},
+	target string, option *structs.Node) bool {
+	val, ok := resolveNodeTarget(iter.ctx, target, option)
+	if !ok {
+		return false
+	}
+	_, inUse := used[target][fmt.Sprintf("%v", val)]
+	return !inUse
+}
+
+// computeUsedProperties computes the values of the distinct properties used
+// by the proposed allocations of the job, which are its existing allocations,
+// removing evictions, and adding any planned placements. If the state can't
+// be read, an error is returned and the values are computed again for the
+// next node.
+func (iter *ProposedAllocConstraintIterator) computeUsedProperties() error {
+	existing, err := iter.ctx.State().AllocsByJob(iter.job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get job allocations: %v", err)
+	}
+
+	// Index the proposed allocations so that in-place updates override the
+	// existing allocation
+	plan := iter.ctx.Plan()
+	proposed := make(map[string]*structs.Allocation, len(existing))
+	for _, alloc := range existing {
+		if !alloc.TerminalStatus() {
+			proposed[alloc.ID] = alloc
+		}
+	}
+	for _, updates := range plan.NodeUpdate {
+		for _, alloc := range updates {
+			delete(proposed, alloc.ID)
+		}
+	}
+	for _, placements := range plan.NodeAllocation {
+		for _, alloc := range placements {
+			if alloc.JobID == iter.job.ID {
+				proposed[alloc.ID] = alloc
+			}
+		}
+	}
+
+	jobUsed := make(map[string]map[string]struct{})
+	tgUsed := make(map[string]map[string]struct{})
+	nodes := make(map[string]*structs.Node)
+	for _, alloc := range proposed {
+		node, ok := nodes[alloc.NodeID]
+		if !ok {
+			node, err = iter.ctx.State().NodeByID(alloc.NodeID)
+			if err != nil {
+				return fmt.Errorf("failed to get node %q: %v", alloc.NodeID, err)
+			}
+			nodes[alloc.NodeID] = node
+		}
+		if node == nil {
+			continue
+		}
+
+		addUsedProperties(iter.ctx, jobUsed, iter.jobDistinctProperties, node)
+		if alloc.TaskGroup == iter.tg.Name {
+			addUsedProperties(iter.ctx, tgUsed, iter.tgDistinctProperties, node)
+		}
+	}
+
+	iter.jobUsedProperties = jobUsed
+	iter.tgUsedProperties = tgUsed
+	iter.usedComputed = true
+	return nil
+}
+
+// addUsedProperties marks the values of the properties of the node as used.
+func addUsedProperties(ctx Context, used map[string]map[string]struct{}, targets []string, node *structs.Node) {
+	for _, target := range targets {
+		val, ok := resolveNodeTarget(ctx, target, node)
+		if !ok {
+			continue
+		}
+		values, ok := used[target]
+		if !ok {
+			values = make(map[string]struct{})
+			used[target] = values
+		}
+		values[fmt.Sprintf("%v", val)] = struct{}{}
+	}
+}
+
 // satisfiesDistinctHosts checks if the node satisfies a distinct_hosts
-// constraint either specified at the job level or the TaskGroup level.
-func (iter *ProposedAllocConstraintIterator) satisfiesDistinctHosts(option *structs.Node) bool {
+// constraint either specified at the job level or the TaskGroup level. An
+// error is returned if the proposed allocations of the node can't be read.
+func (iter *ProposedAllocConstraintIterator) satisfiesDistinctHosts(option *structs.Node) (bool, error) {
 	// Check if there is no constraint set.
 	if !(iter.jobDistinctHosts || iter.tgDistinctHosts) {
-		return true
+		return true, nil
 	}
 
 	// Get the proposed allocations
 	proposed, err := iter.ctx.ProposedAllocs(option.ID)
 	if err != nil {
-		iter.ctx.Logger().Printf(
-			"[ERR] scheduler.dynamic-constraint: failed to get proposed allocations: %v", err)
-		return false
+		return false, err
 	}
 
 	// Skip the node if the task group has already been allocated on it.
@@ -230,15 +561,16 @@ func (iter *ProposedAllocConstraintIterator) satisfiesDistinctHosts(option *stru
 		jobCollision := alloc.JobID == iter.job.ID
 		taskCollision := alloc.TaskGroup == iter.tg.Name
 		if iter.jobDistinctHosts && jobCollision || jobCollision && taskCollision {
-			return false
+			return false, nil
 		}
 	}
 
-	return true
+	return true, nil
 }
 
 func (iter *ProposedAllocConstraintIterator) Reset() {
 	iter.source.Reset()
+	iter.usedComputed = false
 }
 
 // ConstraintChecker is a FeasibilityChecker which returns nodes that match a
@@ -247,6 +579,10 @@ func (iter *ProposedAllocConstraintIterator) Reset() {
 type ConstraintChecker struct {
 	ctx         Context
 	constraints []*structs.Constraint
+
+	// tg is the task group being placed which task group aggregates are
+	// resolved against.
+	tg *structs.TaskGroup
 }
 
 // NewConstraintChecker creates a ConstraintChecker for a set of constraints
@@ -261,30 +597,154 @@ func (c *ConstraintChecker) SetConstraints(constraints []*structs.Constraint) {
 	c.constraints = constraints
 }
 
+// SetTaskGroup sets the task group being placed which targets referencing
+// task group aggregates are resolved against.
+func (c *ConstraintChecker) SetTaskGroup(tg *structs.TaskGroup) {
+	c.tg = tg
+}
+
+func (c *ConstraintChecker) copyChecker() FeasibilityChecker {
+	copy := *c
+	return &copy
+}
+
 func (c *ConstraintChecker) Feasible(option *structs.Node) bool {
 	// Use this node if possible
 	for _, constraint := range c.constraints {
-		if !c.meetsConstraint(constraint, option) {
-			c.ctx.Metrics().FilterNode(option, constraint.String())
+		if ok, detail := c.meetsConstraint(constraint, option); !ok {
+			// Include the detail of why the constraint couldn't be evaluated
+			reason := constraint.String()
+			if detail != "" {
+				reason = fmt.Sprintf("%s (%s)", reason, detail)
+			}
+			c.ctx.Metrics().FilterNode(option, reason)
+			c.ctx.RejectNode(option, "constraint", reason)
 			return false
 		}
 	}
 	return true
 }
 
-func (c *ConstraintChecker) meetsConstraint(constraint *structs.Constraint, option *structs.Node) bool {
+// meetsConstraint returns whether the node meets the constraint. If it does
+// not, an optional detail describing the failure is returned.
+//
+// A negated constraint is met when the operand is not satisfied. Only a
+// definitive result is inverted: if a target can't be resolved, such as an
+// absent attribute, or the operand returns a detail because a value couldn't
+// be evaluated, the constraint is not met regardless of negation. This is
+// consistent with the "!=" operator which is not met by an absent attribute.
+func (c *ConstraintChecker) meetsConstraint(constraint *structs.Constraint, option *structs.Node) (bool, string) {
+	// Platform constraints resolve each field of the tuple from the node
+	if constraint.Operand == structs.ConstraintPlatform {
+		return checkPlatformConstraint(c.ctx, option, constraint.RTarget)
+	}
+
 	// Resolve the targets
-	lVal, ok := resolveConstraintTarget(constraint.LTarget, option)
+	lVal, ok, detail := c.resolveTarget(constraint.LTarget, option)
 	if !ok {
-		return false
+		// An absent list attribute is an empty list
+		if constraint.Operand != structs.ConstraintListLength || detail != "" {
+			return false, detail
+		}
+		lVal = ""
 	}
-	rVal, ok := resolveConstraintTarget(constraint.RTarget, option)
+	rVal, ok, detail := c.resolveTarget(constraint.RTarget, option)
 	if !ok {
-		return false
+		return false, detail
 	}
 
 	// Check if satisfied
-	return checkConstraint(c.ctx, constraint.Operand, lVal, rVal)
+	met, detail := checkConstraintDetail(c.ctx, constraint.Operand, lVal, rVal)
+	if !constraint.Negate || detail != "" || constraint.Operand == structs.ConstraintDistinctHosts ||
+		constraint.Operand == structs.ConstraintDistinctProperty {
+		return met, detail
+	}
+	return !met, ""
+}
+
+// resolveTarget resolves a target against the node or, for a task group
+// aggregate, against the task group being placed. If an aggregate can't be
+// resolved, a detail is returned.
+func (c *ConstraintChecker) resolveTarget(target string, option *structs.Node) (interface{}, bool, string) {
+	if !strings.HasPrefix(target, groupAggregatePrefix) {
+		val, ok := resolveNodeTarget(c.ctx, target, option)
+		return val, ok, ""
+	}
+
+	val, err := resolveGroupAggregate(target, c.tg)
+	if err != nil {
+		return nil, false, err.Error()
+	}
+	return val, true, ""
+}
+
+// groupAggregatePrefix is the prefix of targets referencing an aggregate of
+// the resources requested by the task group being placed.
+const groupAggregatePrefix = "${group."
+
+// hasGroupAggregate returns whether any of the constraints reference a task
+// group aggregate.
+func hasGroupAggregate(constraints []*structs.Constraint) bool {
+	for _, c := range constraints {
+		if strings.HasPrefix(c.LTarget, groupAggregatePrefix) ||
+			strings.HasPrefix(c.RTarget, groupAggregatePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveGroupAggregate resolves a target referencing an aggregate of the
+// resources requested by the tasks of the task group, such as "${group.cpu}".
+// The aggregate may be scaled by a multiplier, such as "${group.cpu} * 2".
+func resolveGroupAggregate(target string, tg *structs.TaskGroup) (float64, error) {
+	end := strings.Index(target, "}")
+	if end < 0 {
+		return 0, fmt.Errorf("unresolvable aggregate %q", target)
+	}
+	name := target[len(groupAggregatePrefix):end]
+
+	multiplier := 1.0
+	if rest := strings.TrimSpace(target[end+1:]); rest != "" {
+		if !strings.HasPrefix(rest, "*") {
+			return 0, fmt.Errorf("unresolvable aggregate %q", target)
+		}
+		m, err := strconv.ParseFloat(strings.TrimSpace(rest[1:]), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid multiplier in aggregate %q", target)
+		}
+		multiplier = m
+	}
+
+	if tg == nil {
+		return 0, fmt.Errorf("unresolvable aggregate %q: no task group", target)
+	}
+
+	total := 0
+	switch name {
+	case "tasks":
+		total = len(tg.Tasks)
+	case "cpu", "memory", "disk", "iops":
+		for _, task := range tg.Tasks {
+			r := task.Resources
+			if r == nil {
+				continue
+			}
+			switch name {
+			case "cpu":
+				total += r.CPU
+			case "memory":
+				total += r.MemoryMB
+			case "disk":
+				total += r.DiskMB
+			case "iops":
+				total += r.IOPS
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unresolvable aggregate %q", target)
+	}
+	return float64(total) * multiplier, nil
 }
 
 // resolveConstraintTarget is used to resolve the LTarget and RTarget of a Constraint
@@ -325,27 +785,214 @@ func resolveConstraintTarget(target string, node *structs.Node) (interface{}, bo
 
 // checkConstraint checks if a constraint is satisfied
 func checkConstraint(ctx Context, operand string, lVal, rVal interface{}) bool {
+	ok, _ := checkConstraintDetail(ctx, operand, lVal, rVal)
+	return ok
+}
+
+// checkConstraintDetail checks if a constraint is satisfied. If it is not, an
+// optional detail describing why it could not be evaluated is returned.
+func checkConstraintDetail(ctx Context, operand string, lVal, rVal interface{}) (bool, string) {
 	// Check for constraints not handled by this checker.
 	switch operand {
-	case structs.ConstraintDistinctHosts:
-		return true
+	case structs.ConstraintDistinctHosts, structs.ConstraintDistinctProperty:
+		return true, ""
 	default:
 		break
 	}
 
+	// Task group aggregates are numbers and are compared numerically
+	_, lNum := lVal.(float64)
+	_, rNum := rVal.(float64)
+	if lNum || rNum {
+		return checkNumericOrder(operand, lVal, rVal)
+	}
+
 	switch operand {
 	case "=", "==", "is":
-		return reflect.DeepEqual(lVal, rVal)
+		return reflect.DeepEqual(lVal, rVal), ""
 	case "!=", "not":
-		return !reflect.DeepEqual(lVal, rVal)
+		return !reflect.DeepEqual(lVal, rVal), ""
 	case "<", "<=", ">", ">=":
-		return checkLexicalOrder(operand, lVal, rVal)
+		return checkLexicalOrder(operand, lVal, rVal), ""
 	case structs.ConstraintVersion:
-		return checkVersionConstraint(ctx, lVal, rVal)
+		return checkVersionConstraintDetail(ctx, lVal, rVal)
 	case structs.ConstraintRegex:
-		return checkRegexpConstraint(ctx, lVal, rVal)
+		return checkRegexpConstraintDetail(ctx, lVal, rVal)
+	case structs.ConstraintGlob:
+		return checkGlobConstraintDetail(ctx, lVal, rVal)
+	case structs.ConstraintUnits:
+		return checkUnitsConstraint(lVal, rVal)
+	case structs.ConstraintRegexExtract:
+		return checkRegexpExtractConstraint(ctx, lVal, rVal)
+	case structs.ConstraintBool:
+		return checkBoolConstraint(lVal, rVal)
+	case structs.ConstraintTimeWindow:
+		return checkTimeWindowConstraint(ctx, lVal, rVal)
+	case structs.ConstraintCIDR:
+		return checkCIDRConstraint(ctx, lVal, rVal)
+	case structs.ConstraintPrefix:
+		return checkPrefixConstraint(lVal, rVal)
+	case structs.ConstraintListLength:
+		return checkListLengthConstraint(lVal, rVal)
 	default:
-		return false
+		return false, fmt.Sprintf("unknown operator %q", operand)
+	}
+}
+
+// validateConstraint returns an error if the operand of the constraint is
+// unknown or its literal right hand side can't be evaluated. Regexp, glob and
+// version constraints are compiled into the caches of the context.
+func validateConstraint(ctx Context, constraint *structs.Constraint) error {
+	switch constraint.Operand {
+	case "=", "==", "is", "!=", "not", "<", "<=", ">", ">=",
+		structs.ConstraintDistinctHosts, structs.ConstraintDistinctProperty:
+		return nil
+	case structs.ConstraintVersion, structs.ConstraintRegex,
+		structs.ConstraintGlob, structs.ConstraintUnits,
+		structs.ConstraintRegexExtract, structs.ConstraintBool,
+		structs.ConstraintTimeWindow, structs.ConstraintCIDR,
+		structs.ConstraintPlatform, structs.ConstraintPrefix,
+		structs.ConstraintListLength:
+	default:
+		return fmt.Errorf("unknown operator %q", constraint.Operand)
+	}
+
+	// Interpolated values can only be checked against a node
+	rVal := constraint.RTarget
+	if strings.HasPrefix(rVal, "${") {
+		return nil
+	}
+
+	switch constraint.Operand {
+	case structs.ConstraintVersion:
+		cache := ctx.ConstraintCache()
+		if cache[rVal] == nil {
+			constraints, err := version.NewConstraint(rVal)
+			if err != nil {
+				return fmt.Errorf("invalid version constraint %q: %v", rVal, err)
+			}
+			cache[rVal] = constraints
+			versionCacheStats.store()
+		}
+	case structs.ConstraintRegex:
+		cache := ctx.RegexpCache()
+		if cache[rVal] == nil {
+			re, err := regexp.Compile(rVal)
+			if err != nil {
+				return fmt.Errorf("invalid regexp %q: %v", rVal, err)
+			}
+			cache[rVal] = re
+			regexpCacheStats.store()
+		}
+	case structs.ConstraintGlob:
+		cache := ctx.RegexpCache()
+		key := "glob:" + rVal
+		if cache[key] == nil {
+			re, err := regexp.Compile(globToRegexp(rVal))
+			if err != nil {
+				return fmt.Errorf("invalid glob %q: %v", rVal, err)
+			}
+			cache[key] = re
+			regexpCacheStats.store()
+		}
+	case structs.ConstraintUnits:
+		_, value := parseUnitsOperand(rVal)
+		if _, _, err := parseUnitValue(value); err != nil {
+			return fmt.Errorf("invalid units value %q: %v", rVal, err)
+		}
+	case structs.ConstraintBool:
+		if _, err := parseBool(rVal); err != nil {
+			return err
+		}
+	case structs.ConstraintTimeWindow:
+		if _, _, err := parseTimeWindow(rVal); err != nil {
+			return err
+		}
+	case structs.ConstraintPlatform:
+		fields, err := parsePlatform(rVal)
+		if err != nil {
+			return err
+		}
+		cache := ctx.ConstraintCache()
+		for _, field := range fields {
+			if !isPlatformVersionField(field) || cache[field] != nil {
+				continue
+			}
+			constraints, err := version.NewConstraint(field)
+			if err != nil {
+				return fmt.Errorf("invalid version constraint %q in platform %q: %v", field, rVal, err)
+			}
+			cache[field] = constraints
+			versionCacheStats.store()
+		}
+	case structs.ConstraintCIDR:
+		cache := ctx.CIDRCache()
+		if cache[rVal] == nil {
+			_, block, err := net.ParseCIDR(strings.TrimSpace(rVal))
+			if err != nil {
+				return fmt.Errorf("invalid CIDR block %q: %v", rVal, err)
+			}
+			cache[rVal] = block
+			cidrCacheStats.store()
+		}
+	case structs.ConstraintListLength:
+		if _, _, err := parseListLength(rVal); err != nil {
+			return err
+		}
+	case structs.ConstraintRegexExtract:
+		pattern, _, _, err := parseRegexpExtract(rVal)
+		if err != nil {
+			return err
+		}
+		cache := ctx.RegexpCache()
+		if cache[pattern] == nil {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid regexp %q: %v", pattern, err)
+			}
+			cache[pattern] = re
+			regexpCacheStats.store()
+		}
+	}
+	return nil
+}
+
+// checkNumericOrder is used to compare the values numerically. Strings are
+// parsed as numbers. If a value isn't a number or the operand doesn't compare
+// numbers, a detail is returned.
+func checkNumericOrder(op string, lVal, rVal interface{}) (bool, string) {
+	var vals [2]float64
+	for i, val := range []interface{}{lVal, rVal} {
+		switch v := val.(type) {
+		case float64:
+			vals[i] = v
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return false, fmt.Sprintf("%q is not a number", v)
+			}
+			vals[i] = f
+		default:
+			return false, fmt.Sprintf("%v is not a number", v)
+		}
+	}
+
+	l, r := vals[0], vals[1]
+	switch op {
+	case "=", "==", "is":
+		return l == r, ""
+	case "!=", "not":
+		return l != r, ""
+	case "<":
+		return l < r, ""
+	case "<=":
+		return l <= r, ""
+	case ">":
+		return l > r, ""
+	case ">=":
+		return l >= r, ""
+	default:
+		return false, fmt.Sprintf("operator %q can't compare numbers", op)
 	}
 }
 
@@ -378,6 +1025,14 @@ func checkLexicalOrder(op string, lVal, rVal interface{}) bool {
 // checkVersionConstraint is used to compare a version on the
 // left hand side with a set of constraints on the right hand side
 func checkVersionConstraint(ctx Context, lVal, rVal interface{}) bool {
+	ok, _ := checkVersionConstraintDetail(ctx, lVal, rVal)
+	return ok
+}
+
+// checkVersionConstraintDetail checks a version constraint like
+// checkVersionConstraint. If the version or the constraint can't be parsed, a
+// detail is returned.
+func checkVersionConstraintDetail(ctx Context, lVal, rVal interface{}) (bool, string) {
 	// Parse the version
 	var versionStr string
 	switch v := lVal.(type) {
@@ -386,69 +1041,1059 @@ func checkVersionConstraint(ctx Context, lVal, rVal interface{}) bool {
 	case int:
 		versionStr = fmt.Sprintf("%d", v)
 	default:
-		return false
+		return false, "attribute is not a string"
 	}
 
 	// Parse the version
 	vers, err := version.NewVersion(versionStr)
 	if err != nil {
-		return false
+		return false, fmt.Sprintf("attribute unparseable: %v", err)
 	}
 
 	// Constraint must be a string
 	constraintStr, ok := rVal.(string)
 	if !ok {
-		return false
+		return false, "value is not a string"
 	}
 
 	// Check the cache for a match
 	cache := ctx.ConstraintCache()
 	constraints := cache[constraintStr]
+	versionCacheStats.lookup(constraints != nil)
 
 	// Parse the constraints
 	if constraints == nil {
 		constraints, err = version.NewConstraint(constraintStr)
 		if err != nil {
-			return false
+			return false, fmt.Sprintf("invalid version constraint %q: %v", constraintStr, err)
 		}
 		cache[constraintStr] = constraints
+		versionCacheStats.store()
 	}
 
 	// Check the constraints against the version
-	return constraints.Check(vers)
+	return constraints.Check(vers), ""
 }
 
 // checkRegexpConstraint is used to compare a value on the
 // left hand side with a regexp on the right hand side
 func checkRegexpConstraint(ctx Context, lVal, rVal interface{}) bool {
+	ok, _ := checkRegexpConstraintDetail(ctx, lVal, rVal)
+	return ok
+}
+
+// checkRegexpConstraintDetail checks a regexp constraint like
+// checkRegexpConstraint. If the regexp can't be compiled, a detail is
+// returned.
+func checkRegexpConstraintDetail(ctx Context, lVal, rVal interface{}) (bool, string) {
 	// Ensure left-hand is string
 	lStr, ok := lVal.(string)
 	if !ok {
-		return false
+		return false, "attribute is not a string"
 	}
 
 	// Regexp must be a string
 	regexpStr, ok := rVal.(string)
 	if !ok {
-		return false
+		return false, "value is not a string"
 	}
 
 	// Check the cache
 	cache := ctx.RegexpCache()
 	re := cache[regexpStr]
+	regexpCacheStats.lookup(re != nil)
 
 	// Parse the regexp
 	if re == nil {
 		var err error
 		re, err = regexp.Compile(regexpStr)
 		if err != nil {
-			return false
+			return false, fmt.Sprintf("invalid regexp %q: %v", regexpStr, err)
 		}
 		cache[regexpStr] = re
+		regexpCacheStats.store()
 	}
 
 	// Look for a match
-	return re.MatchString(lStr)
+	return re.MatchString(lStr), ""
+}
+
+// checkGlobConstraint is used to compare a value on the left hand side with a
+// glob pattern on the right hand side. The pattern supports "*" to match any
+// sequence of characters and "?" to match a single character. Either may be
+// escaped with a backslash to be matched literally.
+func checkGlobConstraint(ctx Context, lVal, rVal interface{}) bool {
+	ok, _ := checkGlobConstraintDetail(ctx, lVal, rVal)
+	return ok
+}
+
+// checkGlobConstraintDetail checks a glob constraint like
+// checkGlobConstraint. If the glob can't be translated, a detail is returned.
+func checkGlobConstraintDetail(ctx Context, lVal, rVal interface{}) (bool, string) {
+	// Ensure left-hand is string
+	lStr, ok := lVal.(string)
+	if !ok {
+		return false, "attribute is not a string"
+	}
+
+	// Glob must be a string
+	globStr, ok := rVal.(string)
+	if !ok {
+		return false, "value is not a string"
+	}
+
+	// Check the cache. Globs are keyed distinctly so they do not collide with
+	// a regexp of the same text.
+	cache := ctx.RegexpCache()
+	key := "glob:" + globStr
+	re := cache[key]
+	regexpCacheStats.lookup(re != nil)
+
+	// Translate and parse the glob
+	if re == nil {
+		var err error
+		re, err = regexp.Compile(globToRegexp(globStr))
+		if err != nil {
+			return false, fmt.Sprintf("invalid glob %q: %v", globStr, err)
+		}
+		cache[key] = re
+		regexpCacheStats.store()
+	}
+
+	// Look for a match
+	return re.MatchString(lStr), ""
+}
+
+// globToRegexp translates a glob pattern to an anchored regular expression,
+// escaping any regular expression metacharacters in the literal portions.
+func globToRegexp(glob string) string {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	escaped := false
+	for _, r := range glob {
+		switch {
+		case escaped:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			buf.WriteString(".*")
+		case r == '?':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	// A trailing backslash matches itself
+	if escaped {
+		buf.WriteString(regexp.QuoteMeta("\\"))
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// unit is a unit of measurement that values may be expressed in.
+type unit struct {
+	// dimension is what the unit measures. Only values of the same
+	// dimension may be compared.
+	dimension string
+
+	// factor converts a value in the unit to the base unit of the dimension.
+	factor float64
+}
+
+// units are the units understood by the units constraint. A value without a
+// unit is dimensionless.
+var units = map[string]unit{
+	"": {"", 1},
+
+	// Frequency
+	"Hz":  {"frequency", 1},
+	"kHz": {"frequency", 1e3},
+	"KHz": {"frequency", 1e3},
+	"MHz": {"frequency", 1e6},
+	"GHz": {"frequency", 1e9},
+	"THz": {"frequency", 1e12},
+
+	// Memory
+	"B":   {"memory", 1},
+	"KB":  {"memory", 1e3},
+	"kB":  {"memory", 1e3},
+	"MB":  {"memory", 1e6},
+	"GB":  {"memory", 1e9},
+	"TB":  {"memory", 1e12},
+	"KiB": {"memory", 1 << 10},
+	"MiB": {"memory", 1 << 20},
+	"GiB": {"memory", 1 << 30},
+	"TiB": {"memory", 1 << 40},
+
+	// Bandwidth
+	"bps":  {"bandwidth", 1},
+	"Kbps": {"bandwidth", 1e3},
+	"kbps": {"bandwidth", 1e3},
+	"Mbps": {"bandwidth", 1e6},
+	"Gbps": {"bandwidth", 1e9},
+	"Tbps": {"bandwidth", 1e12},
+}
+
+// unitValueRe matches a number followed by an optional unit.
+var unitValueRe = regexp.MustCompile(`^\s*([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)\s*([A-Za-z]*)\s*$`)
+
+// parseUnitValue parses a value such as "2GHz" or "512 MiB", returning its
+// magnitude in the base unit and its dimension.
+func parseUnitValue(s string) (float64, string, error) {
+	matches := unitValueRe.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, "", fmt.Errorf("invalid value %q", s)
+	}
+
+	u, ok := units[matches[2]]
+	if !ok {
+		return 0, "", fmt.Errorf("unknown unit %q", matches[2])
+	}
+
+	f, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid value %q: %v", s, err)
+	}
+	return f * u.factor, u.dimension, nil
+}
+
+// parseUnitsOperand splits the right hand side of a units constraint, such as
+// ">= 2GHz", into the comparison operator and the value. If no operator is
+// given, equality is used.
+func parseUnitsOperand(operand string) (string, string) {
+	operand = strings.TrimSpace(operand)
+	for _, op := range []string{">=", "<=", "==", "!=", ">", "<", "="} {
+		if strings.HasPrefix(operand, op) {
+			return op, strings.TrimSpace(strings.TrimPrefix(operand, op))
+		}
+	}
+	return "=", operand
+}
+
+// checkUnitsConstraint is used to compare a value with a unit on the left
+// hand side against an operator and value on the right hand side, such as
+// ">= 2GHz". Values are normalized to the base unit of their dimension before
+// their magnitudes are compared. If either value can't be parsed or the
+// dimensions differ, a detail is returned.
+func checkUnitsConstraint(lVal, rVal interface{}) (bool, string) {
+	// Ensure the values are strings
+	lStr, ok := lVal.(string)
+	if !ok {
+		return false, "attribute is not a string"
+	}
+	rStr, ok := rVal.(string)
+	if !ok {
+		return false, "value is not a string"
+	}
+
+	op, value := parseUnitsOperand(rStr)
+	l, lDim, err := parseUnitValue(lStr)
+	if err != nil {
+		return false, fmt.Sprintf("attribute unparseable: %v", err)
+	}
+	r, rDim, err := parseUnitValue(value)
+	if err != nil {
+		return false, fmt.Sprintf("value unparseable: %v", err)
+	}
+	if lDim != rDim {
+		return false, fmt.Sprintf("attribute %q and value %q have different dimensions", lStr, value)
+	}
+
+	// Allow for rounding when converting between units
+	equal := math.Abs(l-r) <= 1e-9*math.Max(math.Abs(l), math.Abs(r))
+	switch op {
+	case "=", "==":
+		return equal, ""
+	case "!=":
+		return !equal, ""
+	case "<":
+		return l < r && !equal, ""
+	case "<=":
+		return l < r || equal, ""
+	case ">":
+		return l > r && !equal, ""
+	case ">=":
+		return l > r || equal, ""
+	default:
+		return false, fmt.Sprintf("unknown operator %q", op)
+	}
+}
+
+// regexpExtractGroup is the name of the capture group whose value is compared
+// by a regexp_extract constraint. If the regexp has no group of this name the
+// first group is used.
+const regexpExtractGroup = "value"
+
+// parseRegexpExtract splits the right hand side of a regexp_extract
+// constraint, such as "^(\d+)\. >= 4", into the regexp, the comparison
+// operator and the value. The operator and value are the last two whitespace
+// separated fields so the regexp may contain spaces.
+func parseRegexpExtract(rStr string) (string, string, string, error) {
+	fields := strings.Fields(rStr)
+	if len(fields) < 3 {
+		return "", "", "", fmt.Errorf("regexp_extract value %q must be of the form \"<regexp> <operator> <value>\"", rStr)
+	}
+
+	op, value := fields[len(fields)-2], fields[len(fields)-1]
+	switch op {
+	case "=", "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return "", "", "", fmt.Errorf("unknown regexp_extract operator %q", op)
+	}
+
+	pattern := strings.TrimSuffix(strings.TrimSpace(rStr), value)
+	pattern = strings.TrimSuffix(strings.TrimSpace(pattern), op)
+	return strings.TrimSpace(pattern), op, value, nil
+}
+
+// checkRegexpExtractConstraint is used to extract a capture group of a regexp
+// from the left hand side and compare it against the value on the right hand
+// side, such as "^(\d+)\. >= 4". The captured value is compared numerically
+// if both it and the value are numbers and lexically otherwise. If the regexp
+// doesn't match or has no group to extract, a detail is returned.
+func checkRegexpExtractConstraint(ctx Context, lVal, rVal interface{}) (bool, string) {
+	// Ensure the values are strings
+	lStr, ok := lVal.(string)
+	if !ok {
+		return false, "attribute is not a string"
+	}
+	rStr, ok := rVal.(string)
+	if !ok {
+		return false, "value is not a string"
+	}
+
+	pattern, op, value, err := parseRegexpExtract(rStr)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	// Check the cache
+	cache := ctx.RegexpCache()
+	re := cache[pattern]
+	regexpCacheStats.lookup(re != nil)
+
+	// Parse the regexp
+	if re == nil {
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return false, fmt.Sprintf("invalid regexp %q", pattern)
+		}
+		cache[pattern] = re
+		regexpCacheStats.store()
+	}
+
+	// Find the group to extract
+	group := 1
+	for idx, name := range re.SubexpNames() {
+		if name == regexpExtractGroup {
+			group = idx
+			break
+		}
+	}
+	if re.NumSubexp() < group {
+		return false, fmt.Sprintf("regexp %q has no capture group", pattern)
+	}
+
+	matches := re.FindStringSubmatch(lStr)
+	if matches == nil {
+		return false, fmt.Sprintf("extraction failed: %q does not match", lStr)
+	}
+	captured := matches[group]
+
+	// Compare numerically if possible
+	l, lErr := strconv.ParseFloat(captured, 64)
+	r, rErr := strconv.ParseFloat(value, 64)
+	if lErr != nil || rErr != nil {
+		switch op {
+		case "=", "==":
+			return captured == value, ""
+		case "!=":
+			return captured != value, ""
+		default:
+			return checkLexicalOrder(op, captured, value), ""
+		}
+	}
+
+	switch op {
+	case "=", "==":
+		return l == r, ""
+	case "!=":
+		return l != r, ""
+	case "<":
+		return l < r, ""
+	case "<=":
+		return l <= r, ""
+	case ">":
+		return l > r, ""
+	default:
+		return l >= r, ""
+	}
+}
+
+// parseBool parses the common representations of a boolean, ignoring case.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "true", "t", "1", "yes", "y", "on":
+		return true, nil
+	case "false", "f", "0", "no", "n", "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean %q", s)
+	}
+}
+
+// checkBoolConstraint is used to compare boolean values such as "yes" and
+// "true". If either value can't be parsed as a boolean, a detail is returned.
+func checkBoolConstraint(lVal, rVal interface{}) (bool, string) {
+	// Ensure the values are strings
+	lStr, ok := lVal.(string)
+	if !ok {
+		return false, "attribute is not a string"
+	}
+	rStr, ok := rVal.(string)
+	if !ok {
+		return false, "value is not a string"
+	}
+
+	l, err := parseBool(lStr)
+	if err != nil {
+		return false, fmt.Sprintf("attribute unparseable: %v", err)
+	}
+	r, err := parseBool(rStr)
+	if err != nil {
+		return false, fmt.Sprintf("value unparseable: %v", err)
+	}
+	return l == r, ""
+}
+
+// parseTimeWindow parses a daily time window such as "22:00-06:00" into the
+// minutes after midnight the window starts and ends at. A window ending before
+// it starts crosses midnight.
+func parseTimeWindow(window string) (int, int, error) {
+	parts := strings.Split(strings.TrimSpace(window), "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("time window %q must be of the form \"HH:MM-HH:MM\"", window)
+	}
+
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time %q in time window %q", part, window)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return 0, 0, fmt.Errorf("time window %q is empty", window)
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// checkTimeWindowConstraint is used to check whether the current time of the
+// context is within the daily time window on the right hand side, such as
+// "22:00-06:00". The start of the window is inclusive and the end exclusive.
+// The left hand side is the time zone the window is in, such as
+// "America/New_York", and defaults to UTC if empty. If the window or time zone
+// can't be parsed, a detail is returned.
+func checkTimeWindowConstraint(ctx Context, lVal, rVal interface{}) (bool, string) {
+	// Ensure the values are strings
+	zone, ok := lVal.(string)
+	if !ok {
+		return false, "time zone is not a string"
+	}
+	window, ok := rVal.(string)
+	if !ok {
+		return false, "value is not a string"
+	}
+
+	start, end, err := parseTimeWindow(window)
+	if err != nil {
+		return false, err.Error()
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return false, fmt.Sprintf("invalid time zone %q", zone)
+	}
+
+	now := ctx.Now().In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return minute >= start && minute < end, ""
+	}
+
+	// The window crosses midnight
+	return minute >= start || minute < end, ""
+}
+
+// checkCIDRConstraint is used to check whether the IP address on the left hand
+// side is within the CIDR block on the right hand side, such as "10.0.1.0/24".
+// Both IPv4 and IPv6 are supported. If either value can't be parsed, a detail
+// is returned.
+func checkCIDRConstraint(ctx Context, lVal, rVal interface{}) (bool, string) {
+	// Ensure the values are strings
+	lStr, ok := lVal.(string)
+	if !ok {
+		return false, "attribute is not a string"
+	}
+	cidrStr, ok := rVal.(string)
+	if !ok {
+		return false, "value is not a string"
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(lStr))
+	if ip == nil {
+		return false, fmt.Sprintf("invalid IP address %q", lStr)
+	}
+
+	// Check the cache
+	cache := ctx.CIDRCache()
+	block := cache[cidrStr]
+	cidrCacheStats.lookup(block != nil)
+
+	// Parse the CIDR block
+	if block == nil {
+		var err error
+		_, block, err = net.ParseCIDR(strings.TrimSpace(cidrStr))
+		if err != nil {
+			return false, fmt.Sprintf("invalid CIDR block %q", cidrStr)
+		}
+		cache[cidrStr] = block
+		cidrCacheStats.store()
+	}
+	return block.Contains(ip), ""
+}
+
+// checkPrefixConstraint is used to check whether the attribute on the left
+// hand side starts with the value on the right hand side, such as "5.10" for a
+// kernel version of "5.10.0-8-amd64". An empty value matches any attribute.
+func checkPrefixConstraint(lVal, rVal interface{}) (bool, string) {
+	// Ensure the values are strings
+	lStr, ok := lVal.(string)
+	if !ok {
+		return false, "attribute is not a string"
+	}
+	rStr, ok := rVal.(string)
+	if !ok {
+		return false, "value is not a string"
+	}
+	return strings.HasPrefix(lStr, rStr), ""
+}
+
+// splitList splits a comma separated list attribute, such as "eth0, eth1",
+// into its items. Whitespace around the items is trimmed and empty items are
+// dropped so an empty attribute is an empty list.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseListLength splits the right hand side of a list_length constraint,
+// such as ">= 2", into the comparison operator and the length. A missing
+// operator compares for equality.
+func parseListLength(rStr string) (string, int, error) {
+	op, value := parseUnitsOperand(rStr)
+	length, err := strconv.Atoi(value)
+	if err != nil || length < 0 {
+		return "", 0, fmt.Errorf("invalid list length %q", rStr)
+	}
+	return op, length, nil
+}
+
+// checkListLengthConstraint is used to compare the number of items of the
+// comma separated list on the left hand side against an operator and length
+// on the right hand side, such as ">= 2". If the length can't be parsed, a
+// detail is returned.
+func checkListLengthConstraint(lVal, rVal interface{}) (bool, string) {
+	// Ensure the values are strings
+	lStr, ok := lVal.(string)
+	if !ok {
+		return false, "attribute is not a string"
+	}
+	rStr, ok := rVal.(string)
+	if !ok {
+		return false, "value is not a string"
+	}
+
+	op, r, err := parseListLength(rStr)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	l := len(splitList(lStr))
+	switch op {
+	case "=", "==":
+		return l == r, ""
+	case "!=":
+		return l != r, ""
+	case "<":
+		return l < r, ""
+	case "<=":
+		return l <= r, ""
+	case ">":
+		return l > r, ""
+	case ">=":
+		return l >= r, ""
+	default:
+		return false, fmt.Sprintf("unknown operator %q", op)
+	}
+}
+
+// platformAttributes are the node attributes the fields of a platform tuple
+// are resolved from, in order.
+var platformAttributes = []string{"kernel.name", "arch", "kernel.version"}
+
+// parsePlatform splits a platform tuple such as "linux/amd64/>= 4.4" into its
+// fields. Trailing fields may be omitted and match any value.
+func parsePlatform(platform string) ([]string, error) {
+	fields := strings.Split(platform, "/")
+	if len(fields) > len(platformAttributes) {
+		return nil, fmt.Errorf("platform %q must be of the form \"os/arch/kernel.version\"", platform)
+	}
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+	}
+	return fields, nil
+}
+
+// isPlatformVersionField returns whether a field of a platform tuple is a
+// version constraint rather than a literal value.
+func isPlatformVersionField(field string) bool {
+	return field != "" && strings.ContainsAny(field[:1], "=!<>~")
+}
+
+// checkPlatformConstraint is used to check the node's (os, arch,
+// kernel.version) tuple against the platform on the right hand side, such as
+// "linux/amd64/>= 4.4". Each field is either a literal matched exactly, a
+// version constraint if it starts with an operator, or empty or "*" to match
+// any value. Only the core of a version, such as "4.4.0" of
+// "4.4.0-21-generic", is compared. If a field doesn't match, a detail naming
+// the field is returned.
+func checkPlatformConstraint(ctx Context, option *structs.Node, platform string) (bool, string) {
+	fields, err := parsePlatform(platform)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	for i, field := range fields {
+		if field == "" || field == "*" {
+			continue
+		}
+
+		attr := platformAttributes[i]
+		val, ok := option.Attributes[attr]
+		if !ok {
+			return false, fmt.Sprintf("missing %s", attr)
+		}
+
+		if !isPlatformVersionField(field) {
+			if val != field {
+				return false, fmt.Sprintf("%s %q is not %q", attr, val, field)
+			}
+			continue
+		}
+
+		// Distribution suffixes such as "-21-generic" aren't prereleases, so
+		// only the version core is compared
+		core := val
+		if i := strings.IndexAny(core, "-+"); i >= 0 {
+			core = core[:i]
+		}
+		vers, err := version.NewVersion(core)
+		if err != nil {
+			return false, fmt.Sprintf("%s %q is not a version", attr, val)
+		}
+
+		// Check the cache
+		cache := ctx.ConstraintCache()
+		constraints := cache[field]
+		versionCacheStats.lookup(constraints != nil)
+
+		// Parse the constraints
+		if constraints == nil {
+			constraints, err = version.NewConstraint(field)
+			if err != nil {
+				return false, fmt.Sprintf("invalid version constraint %q", field)
+			}
+			cache[field] = constraints
+			versionCacheStats.store()
+		}
+		if !constraints.Check(vers) {
+			return false, fmt.Sprintf("%s %q does not satisfy %q", attr, val, field)
+		}
+	}
+	return true, ""
+}
+
+// FallbackConstraintIterator is a FeasibleIterator which filters nodes by
+// ordered tiers of constraints. The nodes meeting every constraint of the
+// first tier are used if there are any, otherwise the nodes meeting the second
+// tier and so on. If no node meets any tier, every node is filtered by the last
+// tier. The tier used is recorded in the metrics.
+//
+// Choosing a tier requires checking every node of the source, so the source is
+// consumed on the first call to Next.
+type FallbackConstraintIterator struct {
+	ctx     Context
+	source  FeasibleIterator
+	tiers   [][]*structs.Constraint
+	checker *ConstraintChecker
+
+	nodes    []*structs.Node
+	offset   int
+	selected bool
+}
+
+// NewFallbackConstraintIterator is used to create a FallbackConstraintIterator
+// for the tiers of constraints. Without tiers no nodes are filtered.
+func NewFallbackConstraintIterator(ctx Context, source FeasibleIterator, tiers [][]*structs.Constraint) *FallbackConstraintIterator {
+	iter := &FallbackConstraintIterator{
+		ctx:     ctx,
+		source:  source,
+		tiers:   tiers,
+		checker: NewConstraintChecker(ctx, nil),
+	}
+	return iter
+}
+
+func (iter *FallbackConstraintIterator) SetTiers(tiers [][]*structs.Constraint) {
+	iter.tiers = tiers
+}
+
+// SetTaskGroup sets the task group being placed which targets referencing
+// task group aggregates are resolved against.
+func (iter *FallbackConstraintIterator) SetTaskGroup(tg *structs.TaskGroup) {
+	iter.checker.SetTaskGroup(tg)
+}
+
+func (iter *FallbackConstraintIterator) Next() *structs.Node {
+	if len(iter.tiers) == 0 {
+		return iter.source.Next()
+	}
+	if !iter.selected {
+		iter.selectTier()
+	}
+	if iter.offset >= len(iter.nodes) {
+		return nil
+	}
+	option := iter.nodes[iter.offset]
+	iter.offset++
+	return option
+}
+
+// selectTier consumes the source and retains the nodes meeting the first tier
+// met by any node.
+func (iter *FallbackConstraintIterator) selectTier() {
+	iter.selected = true
+
+	var nodes []*structs.Node
+	for {
+		option := iter.source.Next()
+		if option == nil {
+			break
+		}
+		nodes = append(nodes, option)
+	}
+
+	// Find the first tier met by a node, defaulting to the last tier so the
+	// nodes are filtered with its reasons if none is met
+	tier := len(iter.tiers) - 1
+	met := false
+	for i, constraints := range iter.tiers {
+		if iter.anyMeets(nodes, constraints) {
+			tier, met = i, true
+			break
+		}
+	}
+	if met {
+		iter.ctx.Metrics().FallbackTier = tier + 1
+	}
+
+	// Filter the nodes by the tier, recording the failures
+	iter.checker.SetConstraints(iter.tiers[tier])
+	for _, option := range nodes {
+		if iter.checker.Feasible(option) {
+			iter.nodes = append(iter.nodes, option)
+		}
+	}
+}
+
+// anyMeets returns whether any of the nodes meets all the constraints.
+func (iter *FallbackConstraintIterator) anyMeets(nodes []*structs.Node, constraints []*structs.Constraint) bool {
+OUTER:
+	for _, option := range nodes {
+		for _, constraint := range constraints {
+			if ok, _ := iter.checker.meetsConstraint(constraint, option); !ok {
+				continue OUTER
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (iter *FallbackConstraintIterator) Reset() {
+	iter.source.Reset()
+	iter.nodes = nil
+	iter.offset = 0
+	iter.selected = false
+}
+
+// TimeoutChecker is a FeasibilityChecker which bounds the time a wrapped
+// checker may spend on a single node. If the wrapped checker exceeds the
+// timeout, the node is treated as infeasible with a "checker timeout" reason
+// and the timeout is recorded in the metrics.
+//
+// With a timeout the wrapped checker runs on its own goroutine so a checker
+// that stalls doesn't stall the evaluation. A running checker can't be
+// interrupted, so a timed out check is left to finish in the background and
+// its result is discarded. Until it finishes the wrapped checker isn't run
+// again and every node is rejected as timed out, so a stalled checker costs
+// the evaluation at most one timeout. A wrapped checker using the context must
+// be constructed with the context of a newCheckerContext passed to the
+// TimeoutChecker so a timed out check never writes to the evaluation.
+type TimeoutChecker struct {
+	ctx      Context
+	checkCtx *checkerContext
+	name     string
+	checker  FeasibilityChecker
+	timeout  time.Duration
+	timedOut bool
+
+	// pending receives the result of a timed out check once the wrapped
+	// checker returns.
+	pending chan bool
+}
+
+// NewTimeoutChecker is used to create a TimeoutChecker wrapping the named
+// checker. A zero timeout disables the timeout.
+func NewTimeoutChecker(ctx Context, name string, checker FeasibilityChecker, timeout time.Duration) *TimeoutChecker {
+	c := &TimeoutChecker{
+		ctx:     ctx,
+		name:    name,
+		checker: checker,
+		timeout: timeout,
+	}
+	if checkCtx, ok := ctx.(*checkerContext); ok {
+		c.ctx = checkCtx.Context
+		c.checkCtx = checkCtx
+	}
+	return c
+}
+
+func (c *TimeoutChecker) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+func (c *TimeoutChecker) Feasible(option *structs.Node) bool {
+	c.timedOut = false
+
+	// Don't run the wrapped checker while a timed out check is running. Once
+	// the timeout is disabled the check is waited for instead.
+	if c.pending != nil {
+		if c.timeout <= 0 {
+			<-c.pending
+		} else {
+			select {
+			case <-c.pending:
+			default:
+				c.reject(option)
+				return false
+			}
+		}
+		c.pending = nil
+		c.checkCtx.attach(nil)
+	}
+
+	if c.timeout <= 0 {
+		return c.checker.Feasible(option)
+	}
+
+	// The check runs on a copy of the checker so the checker can be
+	// reconfigured while a timed out check is running.
+	checker := c.checker
+	if copyable, ok := checker.(copyableChecker); ok {
+		checker = copyable.copyChecker()
+	}
+
+	c.checkCtx.detach()
+	result := make(chan bool, 1)
+	go func() {
+		result <- checker.Feasible(option)
+	}()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case feasible := <-result:
+		c.checkCtx.attach(option)
+		return feasible
+	case <-timer.C:
+		c.checkCtx.abandon()
+		c.pending = result
+		c.reject(option)
+		return false
+	}
+}
+
+// reject rejects the node as timed out.
+func (c *TimeoutChecker) reject(option *structs.Node) {
+	c.timedOut = true
+	c.ctx.Metrics().CheckerTimeout(c.name)
+	c.ctx.Metrics().FilterNode(option, "checker timeout")
+	c.ctx.RejectNode(option, c.name, "checker timeout")
+}
+
+// copyableChecker is a FeasibilityChecker that can be copied so the copy
+// can run while the checker is reconfigured.
+type copyableChecker interface {
+	copyChecker() FeasibilityChecker
+}
+
+// checkerContext is the Context of the checkers wrapped by a TimeoutChecker.
+// While a check runs on its own goroutine the context is detached from the
+// evaluation: the node filtering and rejections of the check are recorded by
+// the context and its caches are its own. Once the check returns in time they
+// are applied to the evaluation, and if it times out they are discarded. The
+// remaining state of the evaluation is only read while the evaluation waits
+// for the check. Otherwise the context is the context of the evaluation.
+type checkerContext struct {
+	Context
+
+	// l serializes the reads of the evaluation by a detached check with the
+	// check being abandoned.
+	l         sync.Mutex
+	detached  bool
+	abandoned bool
+
+	cache      EvalCache
+	metrics    *structs.AllocMetric
+	rejections []NodeRejection
+}
+
+// newCheckerContext returns a context for checkers wrapped by a
+// TimeoutChecker.
+func newCheckerContext(ctx Context) *checkerContext {
+	return &checkerContext{Context: ctx}
+}
+
+// detach detaches the context for a check run on its own goroutine.
+func (c *checkerContext) detach() {
+	if c == nil {
+		return
+	}
+	c.detached = true
+	c.abandoned = false
+	c.metrics = new(structs.AllocMetric)
+	c.rejections = nil
+}
+
+// abandon discards the check running on its own goroutine. Once it returns
+// the check no longer reads the evaluation.
+func (c *checkerContext) abandon() {
+	if c == nil {
+		return
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.abandoned = true
+}
+
+// attach reattaches the context once the check returned, applying the
+// filtering and rejections of the check of the node unless it was abandoned.
+func (c *checkerContext) attach(option *structs.Node) {
+	if c == nil {
+		return
+	}
+	if !c.abandoned {
+		// Node filtering is the only metric recorded by checkers
+		metrics := c.Context.Metrics()
+		unreasoned := c.metrics.NodesFiltered
+		for reason, count := range c.metrics.ConstraintFiltered {
+			unreasoned -= count
+			for i := 0; i < count; i++ {
+				metrics.FilterNode(option, reason)
+			}
+		}
+		for i := 0; i < unreasoned; i++ {
+			metrics.FilterNode(option, "")
+		}
+		for _, r := range c.rejections {
+			c.Context.RejectNode(option, r.Checker, r.Reason)
+		}
+	}
+	c.detached = false
+	c.abandoned = false
+	c.metrics = nil
+	c.rejections = nil
+}
+
+func (c *checkerContext) Metrics() *structs.AllocMetric {
+	if c.detached {
+		return c.metrics
+	}
+	return c.Context.Metrics()
+}
+
+func (c *checkerContext) RejectNode(node *structs.Node, checker, reason string) {
+	if !c.detached {
+		c.Context.RejectNode(node, checker, reason)
+		return
+	}
+	c.rejections = append(c.rejections, NodeRejection{
+		NodeID:  node.ID,
+		Checker: checker,
+		Reason:  reason,
+	})
+}
+
+func (c *checkerContext) RegexpCache() map[string]*regexp.Regexp {
+	if c.detached {
+		return c.cache.RegexpCache()
+	}
+	return c.Context.RegexpCache()
+}
+
+func (c *checkerContext) ConstraintCache() map[string]version.Constraints {
+	if c.detached {
+		return c.cache.ConstraintCache()
+	}
+	return c.Context.ConstraintCache()
+}
+
+func (c *checkerContext) CIDRCache() map[string]*net.IPNet {
+	if c.detached {
+		return c.cache.CIDRCache()
+	}
+	return c.Context.CIDRCache()
+}
+
+func (c *checkerContext) TopologyLabel(node *structs.Node, label string) (string, bool) {
+	if !c.detached {
+		return c.Context.TopologyLabel(node, label)
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.abandoned {
+		return "", false
+	}
+	return c.Context.TopologyLabel(node, label)
+}
+
+// checkTimedOut returns whether the last check of the checker exceeded its
+// timeout. Timeouts depend on the node rather than its computed class, so the
+// result of such a check must not be cached for the class.
+func checkTimedOut(check FeasibilityChecker) bool {
+	t, ok := check.(*TimeoutChecker)
+	return ok && t.timedOut
 }
 
 // FeasibilityWrapper is a FeasibleIterator which wraps both job and task group
@@ -502,6 +2147,7 @@ OUTER:
 		case EvalComputedClassIneligible:
 			// Fast path the ineligible case
 			metrics.FilterNode(option, "computed class ineligible")
+			w.ctx.RejectNode(option, "computed-class", "computed class ineligible")
 			continue
 		case EvalComputedClassEscaped:
 			jobEscaped = true
@@ -515,7 +2161,7 @@ OUTER:
 			if !feasible {
 				// If the job hasn't escaped, set it to be ineligible since it
 				// failed a job check.
-				if !jobEscaped {
+				if !jobEscaped && !checkTimedOut(check) {
 					evalElig.SetJobEligibility(false, option.ComputedClass)
 				}
 				continue OUTER
@@ -534,6 +2180,7 @@ OUTER:
 		case EvalComputedClassIneligible:
 			// Fast path the ineligible case
 			metrics.FilterNode(option, "computed class ineligible")
+			w.ctx.RejectNode(option, "computed-class", "computed class ineligible")
 			continue
 		case EvalComputedClassEligible:
 			// Fast path the eligible case
@@ -550,7 +2197,7 @@ OUTER:
 			if !feasible {
 				// If the task group hasn't escaped, set it to be ineligible
 				// since it failed a check.
-				if !tgEscaped {
+				if !tgEscaped && !checkTimedOut(check) {
 					evalElig.SetTaskGroupEligibility(false, w.tg, option.ComputedClass)
 				}
 				continue OUTER
@@ -2,7 +2,10 @@ package scheduler
 
 import (
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/nomad/nomad/mock"
 	"github.com/hashicorp/nomad/nomad/structs"
@@ -76,6 +79,218 @@ func TestRandomIterator(t *testing.T) {
 	}
 }
 
+func TestCordonIterator(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Meta["maintenance"] = "true"
+	nodes[2].Meta["maintenance"] = "true"
+	static := NewStaticIterator(ctx, nodes)
+
+	// Nothing is cordoned without a predicate
+	iter := NewCordonIterator(ctx, static)
+	if out := collectFeasible(iter); len(out) != 3 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	ctx.Reset()
+	ctx.SetCordon(func(n *structs.Node) bool {
+		return n.Meta["maintenance"] == "true"
+	})
+	iter.Reset()
+	out := collectFeasible(iter)
+	if len(out) != 1 || out[0] != nodes[1] {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	met := ctx.Metrics()
+	if met.NodesCordoned != 2 || met.NodesFiltered != 0 {
+		t.Fatalf("bad: %#v", met)
+	}
+}
+
+func TestNodeListIterator(t *testing.T) {
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+
+	cases := []struct {
+		Name     string
+		Allow    []string
+		Deny     []string
+		Expected []*structs.Node
+	}{
+		{
+			Name:     "none",
+			Expected: nodes,
+		},
+		{
+			Name:     "allow only",
+			Allow:    []string{nodes[0].ID, nodes[2].ID},
+			Expected: []*structs.Node{nodes[0], nodes[2]},
+		},
+		{
+			Name:     "deny only",
+			Deny:     []string{nodes[1].ID},
+			Expected: []*structs.Node{nodes[0], nodes[2]},
+		},
+		{
+			Name:     "combined",
+			Allow:    []string{nodes[0].ID, nodes[1].ID},
+			Deny:     []string{nodes[1].ID},
+			Expected: []*structs.Node{nodes[0]},
+		},
+	}
+
+	for _, c := range cases {
+		_, ctx := testContext(t)
+		ctx.SetNodeAllowList(c.Allow)
+		ctx.SetNodeDenyList(c.Deny)
+
+		static := NewStaticIterator(ctx, nodes)
+		list := NewNodeListIterator(ctx, static)
+		out := collectFeasible(list)
+		if !reflect.DeepEqual(out, c.Expected) {
+			t.Fatalf("%s: bad: %#v", c.Name, out)
+		}
+
+		denied := len(nodes) - len(c.Expected)
+		if ctx.Metrics().NodesDenied != denied || ctx.Metrics().NodesFiltered != 0 {
+			t.Fatalf("%s: bad: %#v", c.Name, ctx.Metrics())
+		}
+	}
+}
+
+func TestNodeListIterator_Reason(t *testing.T) {
+	_, ctx := testContext(t)
+	ctx.SetRejectionDetail(true)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	ctx.SetNodeAllowList([]string{nodes[0].ID, nodes[1].ID})
+	ctx.SetNodeDenyList([]string{nodes[1].ID})
+
+	static := NewStaticIterator(ctx, nodes)
+	collectFeasible(NewNodeListIterator(ctx, static))
+
+	expected := []NodeRejection{
+		{NodeID: nodes[1].ID, Checker: "node-list", Reason: "node deny-listed"},
+		{NodeID: nodes[2].ID, Checker: "node-list", Reason: "node not allow-listed"},
+	}
+	if act := ctx.InfeasibleNodes(); !reflect.DeepEqual(act, expected) {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+func TestNodeHealthIterator(t *testing.T) {
+	state, ctx := testContext(t)
+	ctx.SetRejectionDetail(true)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	now := time.Now()
+
+	// The first node has a single recent failure and older ones
+	healthy := mock.Alloc()
+	healthy.NodeID = nodes[0].ID
+	healthy.TaskStates = map[string]*structs.TaskState{
+		"web": &structs.TaskState{
+			Events: []*structs.TaskEvent{
+				&structs.TaskEvent{Type: structs.TaskDriverFailure, Time: now.Add(-time.Minute).UnixNano()},
+				&structs.TaskEvent{Type: structs.TaskDriverFailure, Time: now.Add(-2 * time.Hour).UnixNano()},
+				&structs.TaskEvent{Type: structs.TaskDriverFailure, Time: now.Add(-3 * time.Hour).UnixNano()},
+				&structs.TaskEvent{Type: structs.TaskStarted, Time: now.UnixNano()},
+			},
+		},
+	}
+
+	// The second node is flapping
+	flapping := mock.Alloc()
+	flapping.NodeID = nodes[1].ID
+	flapping.TaskStates = map[string]*structs.TaskState{
+		"web": &structs.TaskState{
+			Events: []*structs.TaskEvent{
+				&structs.TaskEvent{Type: structs.TaskDriverFailure, Time: now.Add(-time.Minute).UnixNano()},
+				&structs.TaskEvent{Type: structs.TaskDiskExceeded, Time: now.Add(-2 * time.Minute).UnixNano()},
+			},
+		},
+	}
+
+	// The third node has no history
+	noErr(t, state.UpsertJobSummary(999, mock.JobSummary(healthy.JobID)))
+	noErr(t, state.UpsertJobSummary(1000, mock.JobSummary(flapping.JobID)))
+	noErr(t, state.UpsertAllocs(1001, []*structs.Allocation{healthy, flapping}))
+
+	static := NewStaticIterator(ctx, nodes)
+	health := NewNodeHealthIterator(ctx, static, time.Hour, 1)
+	ctx.SetClock(func() time.Time { return now })
+
+	out := collectFeasible(health)
+	if len(out) != 2 || out[0] != nodes[0] || out[1] != nodes[2] {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if ctx.Metrics().NodesFiltered != 1 {
+		t.Fatalf("bad: %#v", ctx.Metrics())
+	}
+	rejected := ctx.InfeasibleNodes()
+	if len(rejected) != 1 || rejected[0].NodeID != nodes[1].ID ||
+		rejected[0].Checker != "node-health" || rejected[0].Reason != "2 failures in the last 1h0m0s" {
+		t.Fatalf("bad: %#v", rejected)
+	}
+
+	// The window follows the clock of the evaluation
+	ctx.SetClock(func() time.Time { return now.Add(time.Hour) })
+	static.Reset()
+	out = collectFeasible(health)
+	if len(out) != 3 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestNodeHealthIterator_StateError(t *testing.T) {
+	state, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	ctx.SetState(&stateErrorState{State: state, nodeID: nodes[0].ID})
+
+	// A node whose history can't be read is skipped rather than healthy
+	static := NewStaticIterator(ctx, nodes)
+	health := NewNodeHealthIterator(ctx, static, time.Hour, 1)
+	out := collectFeasible(health)
+	if len(out) != 1 || out[0] != nodes[1] {
+		t.Fatalf("bad: %#v", out)
+	}
+	if ctx.Metrics().NodesSkipped != 1 {
+		t.Fatalf("bad: %#v", ctx.Metrics())
+	}
+}
+
+func TestNodeHealthIterator_Disabled(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+	}
+	static := NewStaticIterator(ctx, nodes)
+	health := NewNodeHealthIterator(ctx, static, time.Hour, 0)
+
+	out := collectFeasible(health)
+	if len(out) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
 func TestDriverChecker(t *testing.T) {
 	_, ctx := testContext(t)
 	nodes := []*structs.Node{
@@ -179,6 +394,34 @@ func TestConstraintChecker(t *testing.T) {
 	}
 }
 
+func TestConstraintChecker_Glob(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Name = "web-01"
+	nodes[1].Name = "api-01"
+
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintGlob,
+		LTarget: "${node.unique.name}",
+		RTarget: "web-*",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	if !checker.Feasible(nodes[0]) {
+		t.Fatalf("node should match glob")
+	}
+	if checker.Feasible(nodes[1]) {
+		t.Fatalf("node should not match glob")
+	}
+
+	met := ctx.Metrics()
+	if met.NodesFiltered != 1 || met.ConstraintFiltered[constraint.String()] != 1 {
+		t.Fatalf("bad: %#v", met)
+	}
+}
+
 func TestResolveConstraintTarget(t *testing.T) {
 	type tcase struct {
 		target string
@@ -304,122 +547,1113 @@ func TestCheckConstraint(t *testing.T) {
 			lVal: "foo", rVal: "bar",
 			result: false,
 		},
+		{
+			op:   structs.ConstraintGlob,
+			lVal: "foobarbaz", rVal: "foo*",
+			result: true,
+		},
+	}
+
+	for _, tc := range cases {
+		_, ctx := testContext(t)
+		if res := checkConstraint(ctx, tc.op, tc.lVal, tc.rVal); res != tc.result {
+			t.Fatalf("TC: %#v, Result: %v", tc, res)
+		}
+	}
+}
+
+func TestCheckLexicalOrder(t *testing.T) {
+	type tcase struct {
+		op         string
+		lVal, rVal interface{}
+		result     bool
+	}
+	cases := []tcase{
+		{
+			op:   "<",
+			lVal: "bar", rVal: "foo",
+			result: true,
+		},
+		{
+			op:   "<=",
+			lVal: "foo", rVal: "foo",
+			result: true,
+		},
+		{
+			op:   ">",
+			lVal: "bar", rVal: "foo",
+			result: false,
+		},
+		{
+			op:   ">=",
+			lVal: "bar", rVal: "bar",
+			result: true,
+		},
+		{
+			op:   ">",
+			lVal: 1, rVal: "foo",
+			result: false,
+		},
+	}
+	for _, tc := range cases {
+		if res := checkLexicalOrder(tc.op, tc.lVal, tc.rVal); res != tc.result {
+			t.Fatalf("TC: %#v, Result: %v", tc, res)
+		}
+	}
+}
+
+func TestCheckVersionConstraint(t *testing.T) {
+	type tcase struct {
+		lVal, rVal interface{}
+		result     bool
+	}
+	cases := []tcase{
+		{
+			lVal: "1.2.3", rVal: "~> 1.0",
+			result: true,
+		},
+		{
+			lVal: "1.2.3", rVal: ">= 1.0, < 1.4",
+			result: true,
+		},
+		{
+			lVal: "2.0.1", rVal: "~> 1.0",
+			result: false,
+		},
+		{
+			lVal: "1.4", rVal: ">= 1.0, < 1.4",
+			result: false,
+		},
+		{
+			lVal: 1, rVal: "~> 1.0",
+			result: true,
+		},
+	}
+	for _, tc := range cases {
+		_, ctx := testContext(t)
+		if res := checkVersionConstraint(ctx, tc.lVal, tc.rVal); res != tc.result {
+			t.Fatalf("TC: %#v, Result: %v", tc, res)
+		}
+	}
+}
+
+func TestCheckRegexpConstraint(t *testing.T) {
+	type tcase struct {
+		lVal, rVal interface{}
+		result     bool
+	}
+	cases := []tcase{
+		{
+			lVal: "foobar", rVal: "bar",
+			result: true,
+		},
+		{
+			lVal: "foobar", rVal: "^foo",
+			result: true,
+		},
+		{
+			lVal: "foobar", rVal: "^bar",
+			result: false,
+		},
+		{
+			lVal: "zipzap", rVal: "foo",
+			result: false,
+		},
+		{
+			lVal: 1, rVal: "foo",
+			result: false,
+		},
+	}
+	for _, tc := range cases {
+		_, ctx := testContext(t)
+		if res := checkRegexpConstraint(ctx, tc.lVal, tc.rVal); res != tc.result {
+			t.Fatalf("TC: %#v, Result: %v", tc, res)
+		}
+	}
+}
+
+func TestCheckGlobConstraint(t *testing.T) {
+	type tcase struct {
+		lVal, rVal interface{}
+		result     bool
+	}
+	cases := []tcase{
+		{
+			lVal: "web-01", rVal: "web-*",
+			result: true,
+		},
+		{
+			lVal: "web-", rVal: "web-*",
+			result: true,
+		},
+		{
+			lVal: "api-01", rVal: "web-*",
+			result: false,
+		},
+		{
+			lVal: "my-web-01", rVal: "web-*",
+			result: false,
+		},
+		{
+			lVal: "web-1", rVal: "web-?",
+			result: true,
+		},
+		{
+			lVal: "web-10", rVal: "web-?",
+			result: false,
+		},
+		{
+			lVal: "web.01", rVal: "web.*",
+			result: true,
+		},
+		{
+			lVal: "webx01", rVal: "web.*",
+			result: false,
+		},
+		{
+			lVal: "a+b(1)", rVal: "a+b(?)",
+			result: true,
+		},
+		{
+			lVal: "web-*", rVal: "web-\\*",
+			result: true,
+		},
+		{
+			lVal: "web-01", rVal: "web-\\*",
+			result: false,
+		},
+		{
+			lVal: 1, rVal: "*",
+			result: false,
+		},
+	}
+	for _, tc := range cases {
+		_, ctx := testContext(t)
+		if res := checkGlobConstraint(ctx, tc.lVal, tc.rVal); res != tc.result {
+			t.Fatalf("TC: %#v, Result: %v", tc, res)
+		}
+	}
+}
+
+func TestCheckGlobConstraint_Cache(t *testing.T) {
+	_, ctx := testContext(t)
+	if !checkRegexpConstraint(ctx, "my-web-01", "web-*") {
+		t.Fatalf("regexp should match")
+	}
+	if checkGlobConstraint(ctx, "my-web-01", "web-*") {
+		t.Fatalf("glob should not match")
+	}
+
+	cache := ctx.RegexpCache()
+	if _, ok := cache["web-*"]; !ok {
+		t.Fatalf("missing regexp in cache: %#v", cache)
+	}
+	if _, ok := cache["glob:web-*"]; !ok {
+		t.Fatalf("missing glob in cache: %#v", cache)
+	}
+}
+
+func TestCheckUnitsConstraint(t *testing.T) {
+	type tcase struct {
+		lVal, rVal interface{}
+		result     bool
+	}
+	cases := []tcase{
+		{
+			lVal: "1GHz", rVal: "1000MHz",
+			result: true,
+		},
+		{
+			lVal: "1GHz", rVal: "= 1000 MHz",
+			result: true,
+		},
+		{
+			lVal: "2.4GHz", rVal: ">= 2400MHz",
+			result: true,
+		},
+		{
+			lVal: "2.4GHz", rVal: "> 2400MHz",
+			result: false,
+		},
+		{
+			lVal: "1.8GHz", rVal: ">= 2GHz",
+			result: false,
+		},
+		{
+			lVal: "512MiB", rVal: "< 1GiB",
+			result: true,
+		},
+		{
+			lVal: "1GiB", rVal: "1024MiB",
+			result: true,
+		},
+		{
+			lVal: "1GB", rVal: "1000MB",
+			result: true,
+		},
+		{
+			lVal: "1GB", rVal: "!= 1GiB",
+			result: true,
+		},
+		{
+			lVal: "1Gbps", rVal: "<= 1000Mbps",
+			result: true,
+		},
+		{
+			lVal: "10", rVal: "> 9.5",
+			result: true,
+		},
+		{
+			lVal: "1GHz", rVal: "1GB",
+			result: false,
+		},
+		{
+			lVal: "fast", rVal: "1GHz",
+			result: false,
+		},
+		{
+			lVal: "1GHz", rVal: "> 1 parsecs",
+			result: false,
+		},
+		{
+			lVal: 1, rVal: "1GHz",
+			result: false,
+		},
+	}
+	for _, tc := range cases {
+		if res, _ := checkUnitsConstraint(tc.lVal, tc.rVal); res != tc.result {
+			t.Fatalf("TC: %#v, Result: %v", tc, res)
+		}
+	}
+}
+
+func TestConstraintChecker_Units(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Meta["cpu_speed"] = "2400MHz"
+	nodes[1].Meta["cpu_speed"] = "1.8GHz"
+	nodes[2].Meta["cpu_speed"] = "fast"
+
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintUnits,
+		LTarget: "${meta.cpu_speed}",
+		RTarget: ">= 2GHz",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// The unparseable node is filtered with the detail
+	met := ctx.Metrics()
+	if met.ConstraintFiltered[constraint.String()] != 1 {
+		t.Fatalf("bad: %#v", met)
+	}
+	unparseable := `${meta.cpu_speed} units >= 2GHz (attribute unparseable: invalid value "fast")`
+	if met.ConstraintFiltered[unparseable] != 1 {
+		t.Fatalf("bad: %#v", met)
+	}
+}
+
+func TestCheckRegexpExtractConstraint(t *testing.T) {
+	cases := []struct {
+		lVal, rVal string
+		result     bool
+		detail     bool
+	}{
+		{
+			lVal:   "4.4.0-31-generic",
+			rVal:   `^(\d+)\. >= 4`,
+			result: true,
+		},
+		{
+			lVal:   "3.19.0",
+			rVal:   `^(\d+)\. >= 4`,
+			result: false,
+		},
+		{
+			// Compared numerically rather than lexically
+			lVal:   "10.2",
+			rVal:   `^(\d+)\. > 9`,
+			result: true,
+		},
+		{
+			// The named group is extracted rather than the first
+			lVal:   "4.10.2",
+			rVal:   `^(\d+)\.(?P<value>\d+) >= 9`,
+			result: true,
+		},
+		{
+			// Non-numeric values are compared lexically
+			lVal:   "ubuntu-xenial",
+			rVal:   `^ubuntu-(\w+)$ = xenial`,
+			result: true,
+		},
+		{
+			lVal:   "ubuntu-xenial",
+			rVal:   `^debian-(\w+)$ = jessie`,
+			detail: true,
+		},
+		{
+			lVal:   "4.4.0",
+			rVal:   `^\d+ >= 4`,
+			detail: true,
+		},
+		{
+			lVal:   "4.4.0",
+			rVal:   `>= 4`,
+			detail: true,
+		},
+	}
+
+	for _, tc := range cases {
+		_, ctx := testContext(t)
+		result, detail := checkRegexpExtractConstraint(ctx, tc.lVal, tc.rVal)
+		if result != tc.result || (detail != "") != tc.detail {
+			t.Fatalf("case %q %q: got %v %q", tc.lVal, tc.rVal, result, detail)
+		}
+	}
+}
+
+func TestConstraintChecker_RegexpExtract(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Attributes["kernel.version"] = "4.4.0-31-generic"
+	nodes[1].Attributes["kernel.version"] = "3.19.0"
+	nodes[2].Attributes["kernel.version"] = "unknown"
+
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintRegexExtract,
+		LTarget: "${attr.kernel.version}",
+		RTarget: `^(?P<value>\d+)\. >= 4`,
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// The regexp is compiled once
+	if _, ok := ctx.RegexpCache()[`^(?P<value>\d+)\.`]; !ok {
+		t.Fatalf("regexp not cached: %#v", ctx.RegexpCache())
+	}
+}
+
+func TestCheckBoolConstraint(t *testing.T) {
+	cases := []struct {
+		lVal, rVal string
+		result     bool
+		detail     bool
+	}{
+		{lVal: "true", rVal: "true", result: true},
+		{lVal: "1", rVal: "true", result: true},
+		{lVal: "yes", rVal: "true", result: true},
+		{lVal: "Yes", rVal: "1", result: true},
+		{lVal: "false", rVal: "true", result: false},
+		{lVal: "false", rVal: "false", result: true},
+		{lVal: "0", rVal: "false", result: true},
+		{lVal: "no", rVal: "true", result: false},
+		{lVal: "garbage", rVal: "true", detail: true},
+		{lVal: "true", rVal: "garbage", detail: true},
+	}
+
+	for _, tc := range cases {
+		result, detail := checkBoolConstraint(tc.lVal, tc.rVal)
+		if result != tc.result || (detail != "") != tc.detail {
+			t.Fatalf("case %q %q: got %v %q", tc.lVal, tc.rVal, result, detail)
+		}
+	}
+}
+
+func TestConstraintChecker_Bool(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Meta["ssd"] = "yes"
+	nodes[1].Meta["ssd"] = "0"
+	nodes[2].Meta["ssd"] = "maybe"
+
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintBool,
+		LTarget: "${meta.ssd}",
+		RTarget: "true",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// The unparseable node is filtered with the reason
+	unparseable := `${meta.ssd} bool true (attribute unparseable: invalid boolean "maybe")`
+	if ctx.Metrics().ConstraintFiltered[unparseable] != 1 {
+		t.Fatalf("bad: %#v", ctx.Metrics().ConstraintFiltered)
+	}
+}
+
+func TestCheckTimeWindowConstraint(t *testing.T) {
+	at := func(hour, minute int) func() time.Time {
+		return func() time.Time {
+			return time.Date(2016, 10, 14, hour, minute, 0, 0, time.UTC)
+		}
+	}
+
+	cases := []struct {
+		clock  func() time.Time
+		zone   string
+		window string
+		result bool
+		detail bool
+	}{
+		{clock: at(12, 0), window: "09:00-17:00", result: true},
+		{clock: at(9, 0), window: "09:00-17:00", result: true},
+		{clock: at(17, 0), window: "09:00-17:00", result: false},
+		{clock: at(8, 59), window: "09:00-17:00", result: false},
+
+		// Windows crossing midnight
+		{clock: at(23, 30), window: "22:00-06:00", result: true},
+		{clock: at(2, 0), window: "22:00-06:00", result: true},
+		{clock: at(12, 0), window: "22:00-06:00", result: false},
+
+		// The window is in the time zone
+		{clock: at(14, 0), zone: "America/New_York", window: "09:00-12:00", result: true},
+		{clock: at(14, 0), zone: "UTC", window: "09:00-12:00", result: false},
+
+		{clock: at(12, 0), window: "09:00", detail: true},
+		{clock: at(12, 0), window: "09:00-25:00", detail: true},
+		{clock: at(12, 0), window: "09:00-09:00", detail: true},
+		{clock: at(12, 0), zone: "Mars/Olympus", window: "09:00-17:00", detail: true},
+	}
+
+	for i, c := range cases {
+		_, ctx := testContext(t)
+		ctx.SetClock(c.clock)
+		result, detail := checkTimeWindowConstraint(ctx, c.zone, c.window)
+		if result != c.result || (detail != "") != c.detail {
+			t.Fatalf("case(%d) bad: got %v %q", i, result, detail)
+		}
+	}
+}
+
+func TestConstraintChecker_TimeWindow(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Meta["tz"] = "UTC"
+	nodes[1].Meta["tz"] = "Asia/Tokyo"
+
+	// The maintenance window of each node is in its own time zone
+	ctx.SetClock(func() time.Time {
+		return time.Date(2016, 10, 14, 1, 0, 0, 0, time.UTC)
+	})
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintTimeWindow,
+		LTarget: "${meta.tz}",
+		RTarget: "22:00-06:00",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+}
+
+func TestCheckCIDRConstraint(t *testing.T) {
+	cases := []struct {
+		lVal, rVal string
+		result     bool
+		detail     bool
+	}{
+		{lVal: "10.0.1.5", rVal: "10.0.1.0/24", result: true},
+		{lVal: "10.0.1.255", rVal: "10.0.1.0/24", result: true},
+		{lVal: "10.0.2.5", rVal: "10.0.1.0/24", result: false},
+		{lVal: "10.0.2.5", rVal: "10.0.0.0/8", result: true},
+		{lVal: " 10.0.1.5 ", rVal: "10.0.1.0/24", result: true},
+
+		// IPv6
+		{lVal: "2001:db8::1", rVal: "2001:db8::/32", result: true},
+		{lVal: "2001:db9::1", rVal: "2001:db8::/32", result: false},
+		{lVal: "10.0.1.5", rVal: "2001:db8::/32", result: false},
+		{lVal: "::ffff:10.0.1.5", rVal: "10.0.1.0/24", result: true},
+
+		// Malformed
+		{lVal: "10.0.1", rVal: "10.0.1.0/24", detail: true},
+		{lVal: "10.0.1.256", rVal: "10.0.1.0/24", detail: true},
+		{lVal: "", rVal: "10.0.1.0/24", detail: true},
+		{lVal: "10.0.1.5", rVal: "10.0.1.0", detail: true},
+		{lVal: "10.0.1.5", rVal: "10.0.1.0/33", detail: true},
+	}
+
+	for _, tc := range cases {
+		_, ctx := testContext(t)
+		result, detail := checkCIDRConstraint(ctx, tc.lVal, tc.rVal)
+		if result != tc.result || (detail != "") != tc.detail {
+			t.Fatalf("case %q %q: got %v %q", tc.lVal, tc.rVal, result, detail)
+		}
+	}
+}
+
+func TestConstraintChecker_CIDR(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Attributes["unique.network.ip-address"] = "10.0.1.12"
+	nodes[1].Attributes["unique.network.ip-address"] = "10.0.2.12"
+	nodes[2].Attributes["unique.network.ip-address"] = "bogus"
+
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintCIDR,
+		LTarget: "${attr.unique.network.ip-address}",
+		RTarget: "10.0.1.0/24",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// Non-members and malformed addresses are filtered with a reason
+	filtered := ctx.Metrics().ConstraintFiltered
+	if filtered["${attr.unique.network.ip-address} cidr 10.0.1.0/24"] != 1 {
+		t.Fatalf("bad: %#v", filtered)
+	}
+	if filtered[`${attr.unique.network.ip-address} cidr 10.0.1.0/24 (invalid IP address "bogus")`] != 1 {
+		t.Fatalf("bad: %#v", filtered)
+	}
+
+	// The parsed block is cached for the eval
+	if _, ok := ctx.CIDRCache()["10.0.1.0/24"]; !ok {
+		t.Fatalf("CIDR block not cached")
+	}
+}
+
+func TestCheckPrefixConstraint(t *testing.T) {
+	cases := []struct {
+		lVal, rVal interface{}
+		result     bool
+		detail     bool
+	}{
+		{lVal: "5.10.0-8-amd64", rVal: "5.10", result: true},
+		{lVal: "5.10", rVal: "5.10", result: true},
+		{lVal: "5.1.0", rVal: "5.10", result: false},
+		{lVal: "4.19.0", rVal: "5.10", result: false},
+
+		// An empty value matches any attribute
+		{lVal: "5.10.0", rVal: "", result: true},
+		{lVal: "", rVal: "", result: true},
+
+		// Non string values
+		{lVal: 5.1, rVal: "5.1", detail: true},
+		{lVal: "5.1", rVal: 5.1, detail: true},
+	}
+
+	for _, tc := range cases {
+		result, detail := checkPrefixConstraint(tc.lVal, tc.rVal)
+		if result != tc.result || (detail != "") != tc.detail {
+			t.Fatalf("case %v %v: got %v %q", tc.lVal, tc.rVal, result, detail)
+		}
+	}
+}
+
+func TestConstraintChecker_Prefix(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Attributes["kernel.version"] = "5.10.0-8-amd64"
+	nodes[1].Attributes["kernel.version"] = "4.19.0-16-amd64"
+	delete(nodes[2].Attributes, "kernel.version")
+
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintPrefix,
+		LTarget: "${attr.kernel.version}",
+		RTarget: "5.10",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// Non-matching and absent attributes are filtered with a reason
+	filtered := ctx.Metrics().ConstraintFiltered
+	if filtered["${attr.kernel.version} prefix 5.10"] != 2 {
+		t.Fatalf("bad: %#v", filtered)
+	}
+
+	// An empty value matches all nodes with the attribute
+	constraint.RTarget = ""
+	for i, exp := range []bool{true, true, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+}
+
+func TestCheckListLengthConstraint(t *testing.T) {
+	cases := []struct {
+		lVal, rVal interface{}
+		result     bool
+		detail     bool
+	}{
+		{lVal: "eth0,eth1", rVal: ">= 2", result: true},
+		{lVal: "eth0, eth1, eth2", rVal: ">2", result: true},
+		{lVal: "eth0", rVal: ">= 2", result: false},
+		{lVal: "eth0", rVal: "1", result: true},
+		{lVal: "eth0,eth1", rVal: "== 1", result: false},
+		{lVal: "eth0,eth1", rVal: "!= 1", result: true},
+		{lVal: "eth0,eth1", rVal: "< 3", result: true},
+		{lVal: "eth0,eth1,eth2", rVal: "<= 2", result: false},
+
+		// Empty items are dropped and an empty attribute is an empty list
+		{lVal: "eth0,,eth1,", rVal: "2", result: true},
+		{lVal: "", rVal: "0", result: true},
+		{lVal: " , ", rVal: "< 1", result: true},
+		{lVal: "", rVal: ">= 1", result: false},
+
+		// Invalid lengths and non string values
+		{lVal: "eth0", rVal: ">= two", detail: true},
+		{lVal: "eth0", rVal: ">= -1", detail: true},
+		{lVal: 2.0, rVal: "2", detail: true},
+		{lVal: "eth0", rVal: 1.0, detail: true},
+	}
+
+	for _, tc := range cases {
+		result, detail := checkListLengthConstraint(tc.lVal, tc.rVal)
+		if result != tc.result || (detail != "") != tc.detail {
+			t.Fatalf("case %v %v: got %v %q", tc.lVal, tc.rVal, result, detail)
+		}
+	}
+}
+
+func TestConstraintChecker_ListLength(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Meta["interfaces"] = "eth0,eth1,eth2"
+	nodes[1].Meta["interfaces"] = "eth0"
+	nodes[2].Meta["interfaces"] = ""
+	delete(nodes[3].Meta, "interfaces")
+
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintListLength,
+		LTarget: "${meta.interfaces}",
+		RTarget: ">= 2",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// Empty and absent attributes are both empty lists
+	constraint = &structs.Constraint{
+		Operand: structs.ConstraintListLength,
+		LTarget: "${meta.interfaces}",
+		RTarget: "0",
+	}
+	checker.SetConstraints([]*structs.Constraint{constraint})
+	for i, exp := range []bool{false, false, true, true} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// Negation applies to absent attributes
+	constraint = &structs.Constraint{
+		Operand: structs.ConstraintListLength,
+		LTarget: "${meta.interfaces}",
+		RTarget: "0",
+		Negate:  true,
+	}
+	checker.SetConstraints([]*structs.Constraint{constraint})
+	for i, exp := range []bool{true, true, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+}
+
+func TestCheckPlatformConstraint(t *testing.T) {
+	node := mock.Node()
+	node.Attributes["arch"] = "amd64"
+	node.Attributes["kernel.version"] = "4.4.0-21-generic"
+
+	cases := []struct {
+		platform string
+		result   bool
+		detail   string
+	}{
+		{platform: "linux/amd64/>= 4.4", result: true},
+		{platform: "linux/amd64/>= 4.0, < 5.0", result: true},
+		{platform: "linux/amd64/= 4.4.0", result: true},
+		{platform: "linux/amd64/4.4.0-21-generic", result: true},
+		{platform: "linux/amd64", result: true},
+		{platform: "linux", result: true},
+		{platform: "*/amd64/~> 4.4", result: true},
+		{platform: "//>= 4.4", result: true},
+
+		// Per field mismatches
+		{platform: "darwin/amd64/>= 4.4", detail: `kernel.name "linux" is not "darwin"`},
+		{platform: "linux/arm64/>= 4.4", detail: `arch "amd64" is not "arm64"`},
+		{platform: "linux/amd64/4.4.0", detail: `kernel.version "4.4.0-21-generic" is not "4.4.0"`},
+		{platform: "linux/amd64/>= 4.9", detail: `kernel.version "4.4.0-21-generic" does not satisfy ">= 4.9"`},
+		{platform: "linux/amd64/>= 4.4/extra", detail: `must be of the form`},
+	}
+
+	for _, c := range cases {
+		_, ctx := testContext(t)
+		result, detail := checkPlatformConstraint(ctx, node, c.platform)
+		if result != c.result || !strings.Contains(detail, c.detail) || (detail == "") != (c.detail == "") {
+			t.Fatalf("case %q: got %v %q", c.platform, result, detail)
+		}
+	}
+
+	// Missing attributes are reported
+	delete(node.Attributes, "kernel.version")
+	_, ctx := testContext(t)
+	if result, detail := checkPlatformConstraint(ctx, node, "linux/amd64/>= 4.4"); result || detail != "missing kernel.version" {
+		t.Fatalf("got %v %q", result, detail)
+	}
+}
+
+func TestConstraintChecker_Platform(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Attributes["arch"] = "amd64"
+	nodes[0].Attributes["kernel.version"] = "4.8.0"
+	nodes[1].Attributes["arch"] = "arm64"
+	nodes[1].Attributes["kernel.version"] = "4.8.0"
+	nodes[2].Attributes["arch"] = "amd64"
+	nodes[2].Attributes["kernel.version"] = "3.10.0"
+
+	constraint := &structs.Constraint{
+		Operand: structs.ConstraintPlatform,
+		RTarget: "linux/amd64/>= 4.4",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// The mismatching field is part of the reason
+	filtered := ctx.Metrics().ConstraintFiltered
+	if filtered[` platform linux/amd64/>= 4.4 (arch "arm64" is not "amd64")`] != 1 {
+		t.Fatalf("bad: %#v", filtered)
+	}
+	if filtered[` platform linux/amd64/>= 4.4 (kernel.version "3.10.0" does not satisfy ">= 4.4")`] != 1 {
+		t.Fatalf("bad: %#v", filtered)
 	}
+}
 
-	for _, tc := range cases {
-		_, ctx := testContext(t)
-		if res := checkConstraint(ctx, tc.op, tc.lVal, tc.rVal); res != tc.result {
-			t.Fatalf("TC: %#v, Result: %v", tc, res)
+func TestResolveGroupAggregate(t *testing.T) {
+	tg := mock.Job().TaskGroups[0]
+	tg.Tasks = append(tg.Tasks, tg.Tasks[0].Copy())
+	tg.Tasks[0].Resources.CPU = 500
+	tg.Tasks[1].Resources.CPU = 1500
+
+	cases := []struct {
+		target string
+		result float64
+		err    bool
+	}{
+		{target: "${group.cpu}", result: 2000},
+		{target: "${group.cpu} * 2", result: 4000},
+		{target: "${group.memory}", result: 512},
+		{target: "${group.tasks}", result: 2},
+		{target: "${group.gpus}", err: true},
+		{target: "${group.cpu} + 2", err: true},
+		{target: "${group.cpu} * two", err: true},
+	}
+
+	for _, c := range cases {
+		result, err := resolveGroupAggregate(c.target, tg)
+		if (err != nil) != c.err || result != c.result {
+			t.Fatalf("case %q: got %v %v", c.target, result, err)
 		}
 	}
+
+	if _, err := resolveGroupAggregate("${group.cpu}", nil); err == nil {
+		t.Fatalf("expected error without a task group")
+	}
 }
 
-func TestCheckLexicalOrder(t *testing.T) {
-	type tcase struct {
-		op         string
-		lVal, rVal interface{}
-		result     bool
+func TestConstraintChecker_GroupAggregate(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
 	}
-	cases := []tcase{
-		{
-			op:   "<",
-			lVal: "bar", rVal: "foo",
-			result: true,
-		},
-		{
-			op:   "<=",
-			lVal: "foo", rVal: "foo",
-			result: true,
-		},
+	nodes[0].Attributes["cpu.numcores"] = "8"
+	nodes[1].Attributes["cpu.numcores"] = "2"
+
+	// Require a core per 125 MHz requested
+	tg := mock.Job().TaskGroups[0]
+	tg.Tasks[0].Resources.CPU = 1000
+	constraint := &structs.Constraint{
+		Operand: ">=",
+		LTarget: "${attr.cpu.numcores}",
+		RTarget: "${group.cpu} * 0.008",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	checker.SetTaskGroup(tg)
+	for i, exp := range []bool{true, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+
+	// Unresolvable aggregates are filtered with the reason
+	constraint = &structs.Constraint{
+		Operand: ">=",
+		LTarget: "${attr.cpu.numcores}",
+		RTarget: "${group.gpus}",
+	}
+	checker.SetConstraints([]*structs.Constraint{constraint})
+	if checker.Feasible(nodes[0]) {
+		t.Fatalf("unresolvable aggregate should not be feasible")
+	}
+	reason := `${attr.cpu.numcores} >= ${group.gpus} (unresolvable aggregate "${group.gpus}")`
+	if ctx.Metrics().ConstraintFiltered[reason] != 1 {
+		t.Fatalf("bad: %#v", ctx.Metrics().ConstraintFiltered)
+	}
+}
+
+func TestConstraintChecker_Negate(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Attributes["kernel.version"] = "4.4.0"
+	nodes[1].Attributes["kernel.version"] = "3.19.0"
+	delete(nodes[2].Attributes, "kernel.version")
+
+	cases := []struct {
+		Constraint *structs.Constraint
+		Result     []bool
+	}{
 		{
-			op:   ">",
-			lVal: "bar", rVal: "foo",
-			result: false,
+			Constraint: &structs.Constraint{
+				Operand: "=",
+				LTarget: "${attr.kernel.version}",
+				RTarget: "4.4.0",
+				Negate:  true,
+			},
+			Result: []bool{false, true, false},
 		},
 		{
-			op:   ">=",
-			lVal: "bar", rVal: "bar",
-			result: true,
+			Constraint: &structs.Constraint{
+				Operand: structs.ConstraintRegex,
+				LTarget: "${attr.kernel.version}",
+				RTarget: "^3\\.",
+				Negate:  true,
+			},
+			Result: []bool{true, false, false},
 		},
 		{
-			op:   ">",
-			lVal: 1, rVal: "foo",
-			result: false,
+			Constraint: &structs.Constraint{
+				Operand: structs.ConstraintVersion,
+				LTarget: "${attr.kernel.version}",
+				RTarget: ">= 4.0",
+				Negate:  true,
+			},
+			Result: []bool{false, true, false},
 		},
 	}
-	for _, tc := range cases {
-		if res := checkLexicalOrder(tc.op, tc.lVal, tc.rVal); res != tc.result {
-			t.Fatalf("TC: %#v, Result: %v", tc, res)
+
+	for i, c := range cases {
+		checker := NewConstraintChecker(ctx, []*structs.Constraint{c.Constraint})
+		for j, exp := range c.Result {
+			if act := checker.Feasible(nodes[j]); act != exp {
+				t.Fatalf("case(%d) node(%d) failed: got %v; want %v", i, j, act, exp)
+			}
 		}
 	}
-}
 
-func TestCheckVersionConstraint(t *testing.T) {
-	type tcase struct {
-		lVal, rVal interface{}
-		result     bool
+	// The filter reason notes the negation
+	met := ctx.Metrics()
+	if met.ConstraintFiltered["!(${attr.kernel.version} = 4.4.0)"] != 2 {
+		t.Fatalf("bad: %#v", met.ConstraintFiltered)
 	}
-	cases := []tcase{
+}
+
+func TestConstraintChecker_NegateUnparseable(t *testing.T) {
+	_, ctx := testContext(t)
+	node := mock.Node()
+	node.Meta["cpu_speed"] = "fast"
+
+	node.Meta["version"] = "not-a-version"
+	node.Meta["release"] = "1.2.3"
+
+	// An operand that can't evaluate the attribute is not inverted
+	cases := []*structs.Constraint{
 		{
-			lVal: "1.2.3", rVal: "~> 1.0",
-			result: true,
+			Operand: structs.ConstraintUnits,
+			LTarget: "${meta.cpu_speed}",
+			RTarget: ">= 2GHz",
+			Negate:  true,
 		},
 		{
-			lVal: "1.2.3", rVal: ">= 1.0, < 1.4",
-			result: true,
+			Operand: structs.ConstraintVersion,
+			LTarget: "${meta.version}",
+			RTarget: ">= 1.0",
+			Negate:  true,
 		},
 		{
-			lVal: "2.0.1", rVal: "~> 1.0",
-			result: false,
+			Operand: structs.ConstraintVersion,
+			LTarget: "${meta.release}",
+			RTarget: "~> foo",
+			Negate:  true,
 		},
 		{
-			lVal: "1.4", rVal: ">= 1.0, < 1.4",
-			result: false,
+			Operand: structs.ConstraintRegex,
+			LTarget: "${attr.kernel.name}",
+			RTarget: "(foo",
+			Negate:  true,
 		},
 		{
-			lVal: 1, rVal: "~> 1.0",
-			result: true,
+			Operand: "~=",
+			LTarget: "${attr.kernel.name}",
+			RTarget: "linux",
+			Negate:  true,
 		},
 	}
-	for _, tc := range cases {
-		_, ctx := testContext(t)
-		if res := checkVersionConstraint(ctx, tc.lVal, tc.rVal); res != tc.result {
-			t.Fatalf("TC: %#v, Result: %v", tc, res)
+	for i, constraint := range cases {
+		checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+		if checker.Feasible(node) {
+			t.Fatalf("case(%d) unevaluable constraint should not be feasible", i)
 		}
 	}
+
+	// The unknown operator is the reason the node is filtered
+	reason := `!(${attr.kernel.name} ~= linux) (unknown operator "~=")`
+	if ctx.Metrics().ConstraintFiltered[reason] != 1 {
+		t.Fatalf("bad: %#v", ctx.Metrics().ConstraintFiltered)
+	}
 }
 
-func TestCheckRegexpConstraint(t *testing.T) {
-	type tcase struct {
-		lVal, rVal interface{}
-		result     bool
+func TestFallbackConstraintIterator(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
 	}
-	cases := []tcase{
-		{
-			lVal: "foobar", rVal: "bar",
-			result: true,
+	nodes[0].NodeClass = "large"
+	nodes[1].NodeClass = "small"
+
+	large := []*structs.Constraint{
+		&structs.Constraint{
+			Operand: "=",
+			LTarget: "${node.class}",
+			RTarget: "large",
+		},
+	}
+	small := []*structs.Constraint{
+		&structs.Constraint{
+			Operand: "=",
+			LTarget: "${node.class}",
+			RTarget: "small",
 		},
+	}
+	gpu := []*structs.Constraint{
+		&structs.Constraint{
+			Operand: "=",
+			LTarget: "${node.class}",
+			RTarget: "gpu",
+		},
+	}
+
+	cases := []struct {
+		Tiers    [][]*structs.Constraint
+		Expected []*structs.Node
+		Tier     int
+	}{
+		// No tiers filters nothing
 		{
-			lVal: "foobar", rVal: "^foo",
-			result: true,
+			Tiers:    nil,
+			Expected: nodes,
+			Tier:     0,
 		},
+		// The first tier is met
 		{
-			lVal: "foobar", rVal: "^bar",
-			result: false,
+			Tiers:    [][]*structs.Constraint{large, small},
+			Expected: []*structs.Node{nodes[0]},
+			Tier:     1,
 		},
+		// Fallback to the second tier
 		{
-			lVal: "zipzap", rVal: "foo",
-			result: false,
+			Tiers:    [][]*structs.Constraint{gpu, small},
+			Expected: []*structs.Node{nodes[1]},
+			Tier:     2,
 		},
+		// Neither tier is met
 		{
-			lVal: 1, rVal: "foo",
-			result: false,
+			Tiers:    [][]*structs.Constraint{gpu, gpu},
+			Expected: nil,
+			Tier:     0,
 		},
 	}
-	for _, tc := range cases {
-		_, ctx := testContext(t)
-		if res := checkRegexpConstraint(ctx, tc.lVal, tc.rVal); res != tc.result {
-			t.Fatalf("TC: %#v, Result: %v", tc, res)
+
+	for i, c := range cases {
+		ctx.Reset()
+		static := NewStaticIterator(ctx, nodes)
+		iter := NewFallbackConstraintIterator(ctx, static, c.Tiers)
+
+		out := collectFeasible(iter)
+		if !reflect.DeepEqual(out, c.Expected) {
+			t.Fatalf("case(%d) bad: %#v", i, out)
+		}
+		metrics := ctx.Metrics()
+		if metrics.FallbackTier != c.Tier {
+			t.Fatalf("case(%d) bad tier: %d", i, metrics.FallbackTier)
+		}
+		if filtered := len(nodes) - len(c.Expected); metrics.NodesFiltered != filtered {
+			t.Fatalf("case(%d) bad filtered: %#v", i, metrics)
+		}
+
+		// The tier is selected again after a reset
+		iter.Reset()
+		if out := collectFeasible(iter); !reflect.DeepEqual(out, c.Expected) {
+			t.Fatalf("case(%d) bad after reset: %#v", i, out)
 		}
 	}
 }
@@ -638,6 +1872,102 @@ func (c *mockFeasibilityChecker) Feasible(*structs.Node) bool {
 // calls returns how many times the checker was called.
 func (c *mockFeasibilityChecker) calls() int { return c.i }
 
+func TestProposedAllocConstraint_DistinctProperty(t *testing.T) {
+	state, ctx := testContext(t)
+
+	// Create two racks of two nodes
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	for i, node := range nodes {
+		node.Name = []string{"r1-a", "r1-b", "r2-a", "r2-b"}[i]
+		noErr(t, state.UpsertNode(uint64(100+i), node))
+	}
+	noErr(t, ctx.SetTopologyRules([]*TopologyRule{
+		{
+			Label:  "rack",
+			Target: "${node.unique.name}",
+			Regexp: `^(r\d+)-`,
+		},
+	}))
+	static := NewStaticIterator(ctx, nodes)
+
+	job := mock.Job()
+	job.Constraints = append(job.Constraints, &structs.Constraint{
+		Operand: structs.ConstraintDistinctProperty,
+		LTarget: "${topology.rack}",
+	})
+	tg := job.TaskGroups[0]
+
+	// An alloc of the job runs in the first rack
+	alloc := mock.Alloc()
+	alloc.NodeID = nodes[0].ID
+	alloc.JobID = job.ID
+	noErr(t, state.UpsertJobSummary(998, mock.JobSummary(job.ID)))
+	noErr(t, state.UpsertAllocs(999, []*structs.Allocation{alloc}))
+
+	proposed := NewProposedAllocConstraintIterator(ctx, static)
+	proposed.SetJob(job)
+	proposed.SetTaskGroup(tg)
+
+	out := collectFeasible(proposed)
+	if len(out) != 2 || out[0] != nodes[2] || out[1] != nodes[3] {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if ctx.Metrics().ConstraintFiltered["distinct_property ${topology.rack}"] != 2 {
+		t.Fatalf("Bad: %#v", ctx.Metrics())
+	}
+
+	// Planning a placement in the second rack leaves no rack
+	planned := mock.Alloc()
+	planned.NodeID = nodes[3].ID
+	planned.JobID = job.ID
+	ctx.Plan().NodeAllocation[nodes[3].ID] = []*structs.Allocation{planned}
+
+	proposed.Reset()
+	if out := collectFeasible(proposed); len(out) != 0 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	// Evicting the existing alloc frees the first rack
+	ctx.Plan().NodeUpdate[nodes[0].ID] = []*structs.Allocation{alloc}
+	proposed.Reset()
+	out = collectFeasible(proposed)
+	if len(out) != 2 || out[0] != nodes[0] || out[1] != nodes[1] {
+		t.Fatalf("Bad: %#v", out)
+	}
+}
+
+func TestProposedAllocConstraint_DistinctProperty_StateError(t *testing.T) {
+	state, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	job := mock.Job()
+	job.Constraints = append(job.Constraints, &structs.Constraint{
+		Operand: structs.ConstraintDistinctProperty,
+		LTarget: "${node.unique.name}",
+	})
+	ctx.SetState(&stateErrorState{State: state, jobID: job.ID})
+
+	static := NewStaticIterator(ctx, nodes)
+	proposed := NewProposedAllocConstraintIterator(ctx, static)
+	proposed.SetJob(job)
+	proposed.SetTaskGroup(job.TaskGroups[0])
+
+	// Without the used values no node can be checked
+	if out := collectFeasible(proposed); len(out) != 0 {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if ctx.Metrics().NodesSkipped != 2 {
+		t.Fatalf("Bad: %#v", ctx.Metrics())
+	}
+}
+
 func TestFeasibilityWrapper_JobIneligible(t *testing.T) {
 	_, ctx := testContext(t)
 	nodes := []*structs.Node{mock.Node()}
@@ -751,3 +2081,184 @@ func TestFeasibilityWrapper_JobEligible_TgEscaped(t *testing.T) {
 		t.Fatalf("bad: %v %v", e, ok)
 	}
 }
+
+// blockingFeasibilityChecker is a FeasibilityChecker that accepts every node,
+// blocking on the nodes marked blocked until released. If it has a context
+// the blocked nodes are rejected once released instead.
+type blockingFeasibilityChecker struct {
+	ctx     Context
+	blocked map[string]bool
+	release chan struct{}
+	called  int32
+}
+
+func newBlockingFeasibilityChecker(blocked ...*structs.Node) *blockingFeasibilityChecker {
+	c := &blockingFeasibilityChecker{
+		blocked: make(map[string]bool),
+		release: make(chan struct{}),
+	}
+	for _, node := range blocked {
+		c.blocked[node.ID] = true
+	}
+	return c
+}
+
+func (c *blockingFeasibilityChecker) Feasible(option *structs.Node) bool {
+	atomic.AddInt32(&c.called, 1)
+	if !c.blocked[option.ID] {
+		return true
+	}
+	<-c.release
+	if c.ctx == nil {
+		return true
+	}
+	c.ctx.RegexpCache()["blocked"] = nil
+	c.ctx.Metrics().FilterNode(option, "blocked")
+	c.ctx.RejectNode(option, "blocking", "blocked")
+	return false
+}
+
+func (c *blockingFeasibilityChecker) calls() int {
+	return int(atomic.LoadInt32(&c.called))
+}
+
+func TestTimeoutChecker(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	blocking := newBlockingFeasibilityChecker(nodes[0])
+
+	// Without a timeout the other node is feasible
+	checker := NewTimeoutChecker(ctx, "blocking", blocking, 0)
+	if !checker.Feasible(nodes[1]) {
+		t.Fatalf("should be feasible")
+	}
+
+	// With a timeout the blocked node is rejected without waiting for the
+	// checker
+	ctx.SetRejectionDetail(true)
+	checker.SetTimeout(5 * time.Millisecond)
+	start := time.Now()
+	if checker.Feasible(nodes[0]) {
+		t.Fatalf("blocked node should be infeasible")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("checker not bounded: %v", elapsed)
+	}
+
+	// While the checker is stalled it isn't run again
+	if checker.Feasible(nodes[1]) || blocking.calls() != 2 {
+		t.Fatalf("stalled checker was run again: %d calls", blocking.calls())
+	}
+
+	metrics := ctx.Metrics()
+	if metrics.CheckerTimeouts["blocking"] != 2 {
+		t.Fatalf("bad: %#v", metrics.CheckerTimeouts)
+	}
+	if metrics.NodesFiltered != 2 || metrics.ConstraintFiltered["checker timeout"] != 2 {
+		t.Fatalf("bad: %#v", metrics)
+	}
+	rejected := ctx.InfeasibleNodes()
+	if len(rejected) != 2 || rejected[0].NodeID != nodes[0].ID || rejected[0].Checker != "blocking" || rejected[0].Reason != "checker timeout" {
+		t.Fatalf("bad: %#v", rejected)
+	}
+
+	// Once the stalled check returns the checker is used again
+	close(blocking.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for !checker.Feasible(nodes[1]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("checker not resumed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if blocking.calls() != 3 {
+		t.Fatalf("bad: %d calls", blocking.calls())
+	}
+}
+
+func TestTimeoutChecker_CheckerContext(t *testing.T) {
+	_, ctx := testContext(t)
+	ctx.SetRejectionDetail(true)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+
+	// The filtering and rejections of a check returning in time are applied
+	// to the evaluation
+	checkCtx := newCheckerContext(ctx)
+	constraint := NewConstraintChecker(checkCtx, []*structs.Constraint{
+		{
+			Operand: "regexp",
+			LTarget: "${attr.kernel.name}",
+			RTarget: "^windows$",
+		},
+	})
+	checker := NewTimeoutChecker(checkCtx, "constraint", constraint, 5*time.Second)
+	if checker.Feasible(nodes[0]) {
+		t.Fatalf("should be infeasible")
+	}
+	metrics := ctx.Metrics()
+	if metrics.NodesFiltered != 1 || metrics.ConstraintFiltered["${attr.kernel.name} regexp ^windows$"] != 1 {
+		t.Fatalf("bad: %#v", metrics)
+	}
+	if rejected := ctx.InfeasibleNodes(); len(rejected) != 1 || rejected[0].NodeID != nodes[0].ID || rejected[0].Checker != "constraint" {
+		t.Fatalf("bad: %#v", rejected)
+	}
+	if len(ctx.RegexpCache()) != 0 {
+		t.Fatalf("checker wrote the cache of the evaluation")
+	}
+
+	// A timed out check that returns later is discarded
+	checkCtx = newCheckerContext(ctx)
+	blocking := newBlockingFeasibilityChecker(nodes[1])
+	blocking.ctx = checkCtx
+	checker = NewTimeoutChecker(checkCtx, "blocking", blocking, 5*time.Millisecond)
+	if checker.Feasible(nodes[1]) {
+		t.Fatalf("blocked node should be infeasible")
+	}
+	close(blocking.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for !checker.Feasible(nodes[0]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("checker not resumed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if metrics.ConstraintFiltered["blocked"] != 0 || len(ctx.RegexpCache()) != 0 {
+		t.Fatalf("timed out check written to the evaluation: %#v", metrics)
+	}
+	for _, r := range ctx.InfeasibleNodes() {
+		if r.Reason == "blocked" {
+			t.Fatalf("timed out check written to the evaluation: %#v", r)
+		}
+	}
+}
+
+func TestFeasibilityWrapper_TimeoutNotCached(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	static := NewStaticIterator(ctx, nodes)
+	blocking := newBlockingFeasibilityChecker(nodes[0])
+	defer close(blocking.release)
+	checker := NewTimeoutChecker(ctx, "blocking", blocking, 5*time.Millisecond)
+	wrapper := NewFeasibilityWrapper(ctx, static, nil, []FeasibilityChecker{checker})
+	wrapper.SetTaskGroup("foo")
+
+	// The timed out nodes are filtered but their computed class isn't
+	// marked ineligible
+	out := collectFeasible(wrapper)
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+	cc := nodes[0].ComputedClass
+	if status := ctx.Eligibility().TaskGroupStatus("foo", cc); status != EvalComputedClassUnknown {
+		t.Fatalf("bad: %v", status)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -32,6 +33,10 @@ const (
 	// allocInPlace is the status used when speculating on an in-place update
 	allocInPlace = "alloc updating in-place"
 
+	// allocPreempted is the status used when an allocation is evicted to
+	// reclaim its resources for a higher priority job
+	allocPreempted = "alloc is preempted by a higher priority job"
+
 	// blockedEvalMaxPlanDesc is the description used for blocked evals that are
 	// a result of hitting the max number of plan attempts
 	blockedEvalMaxPlanDesc = "created due to placement conflicts"
@@ -51,6 +56,17 @@ func (s *SetStatusError) Error() string {
 	return s.Err.Error()
 }
 
+// invalidJobError is returned when the job can not be scheduled as specified,
+// such as when one of its constraints is malformed. Retrying the evaluation
+// can't make progress so it is failed without blocking.
+type invalidJobError struct {
+	Err error
+}
+
+func (i *invalidJobError) Error() string {
+	return fmt.Sprintf("invalid job: %v", i.Err)
+}
+
 // GenericScheduler is used for 'service' and 'batch' type jobs. This scheduler is
 // designed for long-lived services, and as such spends more time attemping
 // to make a high quality placement. This is the primary scheduler for
@@ -75,6 +91,93 @@ type GenericScheduler struct {
 	blocked        *structs.Evaluation
 	failedTGAllocs map[string]*structs.AllocMetric
 	queuedAllocs   map[string]int
+
+	// preempted are the allocations of other jobs evicted by the plan,
+	// indexed by ID
+	preempted map[string]*structs.Allocation
+
+	planValidator  func(*structs.Plan) error
+	placementCap   int
+	topologyRules  []*TopologyRule
+	attributeCache *AttributeCache
+	placementCache *PlacementCache
+
+	rankingMode          RankingMode
+	stickyVolumeBonus    float64
+	stickyVolumeRequired bool
+	failOnStateError     bool
+	reclaim              bool
+}
+
+// SetPlanValidator sets a callback used to veto the proposed plan before it is
+// submitted. See EvalContext.SetPlanValidator.
+func (s *GenericScheduler) SetPlanValidator(validator func(*structs.Plan) error) {
+	s.planValidator = validator
+}
+
+// SetFailOnStateError sets whether an error reading the state of a node fails
+// the evaluation rather than only skipping the node. See
+// EvalContext.SetFailOnStateError.
+func (s *GenericScheduler) SetFailOnStateError(fail bool) {
+	s.failOnStateError = fail
+}
+
+// SetStickyVolumeRequired sets whether replacements of allocations with sticky
+// volumes, such as a sticky ephemeral disk, must be placed on the node holding
+// their data. Otherwise the node is
+// only preferred. If the node no longer exists the data is lost and the
+// replacement may be placed on any node.
+func (s *GenericScheduler) SetStickyVolumeRequired(required bool) {
+	s.stickyVolumeRequired = required
+}
+
+// SetStickyVolumeBonus sets the ranking bonus applied to the node holding the
+// sticky volume, such as a sticky ephemeral disk, of an allocation being
+// replaced. With a bonus the node is ranked against the other nodes rather
+// than always being preferred when it fits. A zero bonus disables it.
+func (s *GenericScheduler) SetStickyVolumeBonus(bonus float64) {
+	s.stickyVolumeBonus = bonus
+}
+
+// SetTopologyRules sets the rules deriving the topology labels of nodes. See
+// EvalContext.SetTopologyRules.
+func (s *GenericScheduler) SetTopologyRules(rules []*TopologyRule) {
+	s.topologyRules = rules
+}
+
+// SetAttributeCache sets the cache the topology labels of nodes are derived
+// through, shared between evaluations. The cached labels of a node removed
+// from the cluster are dropped by evaluations triggered by its removal. See
+// EvalContext.SetAttributeCache.
+func (s *GenericScheduler) SetAttributeCache(cache *AttributeCache) {
+	s.attributeCache = cache
+}
+
+// SetPlacementCache sets the cache placement results are reused from. See
+// EvalContext.SetPlacementCache.
+func (s *GenericScheduler) SetPlacementCache(cache *PlacementCache) {
+	s.placementCache = cache
+}
+
+// SetPlacementCap limits the number of allocations of the job placed per
+// evaluation. See EvalContext.SetPlacementCap.
+func (s *GenericScheduler) SetPlacementCap(cap int) {
+	s.placementCap = cap
+}
+
+// SetReclaim sets whether allocations of lower priority jobs are preempted
+// when a task group doesn't fit otherwise. The fewest allocations needed for
+// the placement are evicted from the node it is placed on, and an evaluation
+// is created for each job whose allocations were evicted so they are
+// rescheduled.
+func (s *GenericScheduler) SetReclaim(reclaim bool) {
+	s.reclaim = reclaim
+}
+
+// SetRankingMode sets how feasible nodes are ranked when placing the
+// allocations of the job. See GenericStack.SetRankingMode.
+func (s *GenericScheduler) SetRankingMode(mode RankingMode) {
+	s.rankingMode = mode
 }
 
 // NewServiceScheduler is a factory function to instantiate a new service scheduler
@@ -123,6 +226,11 @@ func (s *GenericScheduler) Process(eval *structs.Evaluation) error {
 		limit = maxBatchScheduleAttempts
 	}
 	if err := retryMax(limit, s.process, progress); err != nil {
+		if _, ok := err.(*invalidJobError); ok {
+			return setStatus(s.logger, s.planner, s.eval, s.nextEval, s.blocked,
+				s.failedTGAllocs, structs.EvalStatusFailed, err.Error(),
+				s.queuedAllocs)
+		}
 		if statusErr, ok := err.(*SetStatusError); ok {
 			// Scheduling was tried but made no forward progress so create a
 			// blocked eval to retry once resources become available.
@@ -155,6 +263,47 @@ func (s *GenericScheduler) Process(eval *structs.Evaluation) error {
 		s.failedTGAllocs, structs.EvalStatusComplete, "", s.queuedAllocs)
 }
 
+// createPreemptionEvals creates an evaluation for each job with allocations
+// preempted by the committed plan so the evicted allocations are rescheduled,
+// the way allocations evicted by a node drain are.
+func (s *GenericScheduler) createPreemptionEvals(result *structs.PlanResult) error {
+	if len(s.preempted) == 0 || result == nil {
+		return nil
+	}
+
+	jobIDs := make(map[string]struct{})
+	for _, updates := range result.NodeUpdate {
+		for _, update := range updates {
+			alloc, ok := s.preempted[update.ID]
+			if !ok {
+				continue
+			}
+
+			// Deduplicate on JobID
+			if _, ok := jobIDs[alloc.JobID]; ok {
+				continue
+			}
+			jobIDs[alloc.JobID] = struct{}{}
+
+			eval := &structs.Evaluation{
+				ID:           structs.GenerateUUID(),
+				Priority:     alloc.Job.Priority,
+				Type:         alloc.Job.Type,
+				TriggeredBy:  structs.EvalTriggerNodeUpdate,
+				JobID:        alloc.JobID,
+				NodeID:       alloc.NodeID,
+				Status:       structs.EvalStatusPending,
+				PreviousEval: s.eval.ID,
+			}
+			if err := s.planner.CreateEval(eval); err != nil {
+				return err
+			}
+			s.logger.Printf("[DEBUG] sched: %#v: allocs of job %q preempted, eval '%s' created", s.eval, alloc.JobID, eval.ID)
+		}
+	}
+	return nil
+}
+
 // createBlockedEval creates a blocked eval and submits it to the planner. If
 // failure is set to true, the eval's trigger reason reflects that.
 func (s *GenericScheduler) createBlockedEval(planFailure bool) error {
@@ -199,14 +348,51 @@ func (s *GenericScheduler) process() (bool, error) {
 
 	// Reset the failed allocations
 	s.failedTGAllocs = nil
+	s.preempted = nil
 
 	// Create an evaluation context
 	s.ctx = NewEvalContext(s.state, s.plan, s.logger)
+	s.ctx.SetPlanValidator(s.planValidator)
+	s.ctx.SetPlacementCap(s.placementCap)
+	s.ctx.SetFailOnStateError(s.failOnStateError)
+	s.ctx.SetPlacementCache(s.placementCache)
+	if err := s.ctx.SetTopologyRules(s.topologyRules); err != nil {
+		return false, err
+	}
+	s.ctx.SetAttributeCache(s.attributeCache)
+
+	// Drop the cached attributes of the node that triggered the evaluation if
+	// it was removed
+	if s.attributeCache != nil && s.eval.NodeID != "" {
+		node, err := s.state.NodeByID(s.eval.NodeID)
+		if err != nil {
+			return false, err
+		}
+		if node == nil {
+			s.attributeCache.Invalidate(s.eval.NodeID)
+		}
+	}
+
+	// Shuffle the nodes reproducibly for the evaluation so placements spread
+	// across nodes while a given evaluation always visits them in the same
+	// order.
+	s.ctx.SetShuffleSeed(evalShuffleSeed(s.eval.ID))
 
 	// Construct the placement stack
 	s.stack = NewGenericStack(s.batch, s.ctx)
+	s.stack.SetRankingMode(s.rankingMode)
+	s.stack.SetStickyVolumeBonus(s.stickyVolumeBonus)
+	s.stack.SetStickyVolumeRequired(s.stickyVolumeRequired)
+	s.stack.SetReclaim(s.reclaim)
 	if s.job != nil {
 		s.stack.SetJob(s.job)
+
+		// Fail the evaluation of a job with malformed constraints rather
+		// than filtering every node
+		if err := s.ctx.ValidateJobConstraints(s.job); err != nil {
+			s.logger.Printf("[DEBUG] sched: %#v: %v", s.eval, err)
+			return false, &invalidJobError{Err: err}
+		}
 	}
 
 	// Compute the target job allocations
@@ -215,6 +401,15 @@ func (s *GenericScheduler) process() (bool, error) {
 		return false, err
 	}
 
+	// Give the plan validator a chance to veto a plan that will be submitted
+	// before any evaluation is created for it
+	if !s.plan.IsNoOp() || s.eval.AnnotatePlan {
+		if err := s.ctx.ValidatePlan(); err != nil {
+			s.logger.Printf("[DEBUG] sched: %#v: plan vetoed: %v", s.eval, err)
+			return false, fmt.Errorf("plan vetoed: %v", err)
+		}
+	}
+
 	// If there are failed allocations, we need to create a blocked evaluation
 	// to place the failed allocations when resources become available. If the
 	// current evaluation is already a blocked eval, we reuse it.
@@ -226,14 +421,9 @@ func (s *GenericScheduler) process() (bool, error) {
 		s.logger.Printf("[DEBUG] sched: %#v: failed to place all allocations, blocked eval '%s' created", s.eval, s.blocked.ID)
 	}
 
-	// If the plan is a no-op, we can bail. If AnnotatePlan is set submit the plan
-	// anyways to get the annotations.
-	if s.plan.IsNoOp() && !s.eval.AnnotatePlan {
-		return true, nil
-	}
-
 	// If the limit of placements was reached we need to create an evaluation
-	// to pickup from here after the stagger period.
+	// to pickup from here after the stagger period. This is done even if the
+	// plan is a no-op so placements deferred by the placement cap are made.
 	if s.limitReached && s.nextEval == nil {
 		s.nextEval = s.eval.NextRollingEval(s.job.Update.Stagger)
 		if err := s.planner.CreateEval(s.nextEval); err != nil {
@@ -243,6 +433,12 @@ func (s *GenericScheduler) process() (bool, error) {
 		s.logger.Printf("[DEBUG] sched: %#v: rolling update limit reached, next eval '%s' created", s.eval, s.nextEval.ID)
 	}
 
+	// If the plan is a no-op, we can bail. If AnnotatePlan is set submit the plan
+	// anyways to get the annotations.
+	if s.plan.IsNoOp() && !s.eval.AnnotatePlan {
+		return true, nil
+	}
+
 	// Submit the plan and store the results.
 	result, newState, err := s.planner.SubmitPlan(s.plan)
 	s.planResult = result
@@ -254,6 +450,12 @@ func (s *GenericScheduler) process() (bool, error) {
 	// number of allocations successfully placed
 	adjustQueuedAllocations(s.logger, result, s.queuedAllocs)
 
+	// Reschedule the allocations the plan preempted
+	if err := s.createPreemptionEvals(result); err != nil {
+		s.logger.Printf("[ERR] sched: %#v failed to make evals for preempted allocs: %v", s.eval, err)
+		return false, err
+	}
+
 	// If we got a state refresh, try again since we have stale data
 	if newState != nil {
 		s.logger.Printf("[DEBUG] sched: %#v: refresh forced", s.eval)
@@ -399,7 +601,13 @@ func (s *GenericScheduler) computeJobAllocs() error {
 		limit = s.job.Update.MaxParallel
 	}
 
+	// Don't evict more allocations than can be replaced by the eval
+	if cap := s.ctx.PlacementCap(); cap > 0 && cap < limit {
+		limit = cap
+	}
+
 	// Treat migrations as an eviction and a new placement.
+	newPlacements := len(diff.place)
 	s.limitReached = evictAndPlace(s.ctx, diff, diff.migrate, allocMigrating, &limit)
 
 	// Treat non in-place updates as an eviction and new placement.
@@ -409,6 +617,14 @@ func (s *GenericScheduler) computeJobAllocs() error {
 	// status lost and a new placement should be made
 	s.limitReached = s.limitReached || markLostAndPlace(s.ctx, diff, diff.lost, allocLost, &limit)
 
+	// Replace the evicted allocations ahead of the new placements so the
+	// placement cap never defers the replacement of a stopped allocation.
+	if s.ctx.PlacementCap() > 0 && newPlacements > 0 {
+		place := make([]allocTuple, 0, len(diff.place))
+		place = append(place, diff.place[newPlacements:]...)
+		diff.place = append(place, diff.place[:newPlacements]...)
+	}
+
 	// Nothing remaining to do if placement is not required
 	if len(diff.place) == 0 {
 		if s.job != nil {
@@ -436,9 +652,30 @@ func (s *GenericScheduler) computePlacements(place []allocTuple) error {
 		return err
 	}
 
+	// Reuse the prior placements if neither the job nor the state changed
+	var key uint64
+	cache := s.ctx.PlacementCache()
+	if cache != nil {
+		var cacheable bool
+		key, cacheable, err = placementCacheKey(s.state, s.job, place, nodes)
+		if err != nil {
+			return err
+		}
+		if !cacheable {
+			cache = nil
+		} else if result, ok := cache.lookup(s.job.ID, key); ok {
+			s.logger.Printf("[DEBUG] sched: %#v: reusing cached placements", s.eval)
+			s.applyCachedPlacements(result)
+			return nil
+		}
+	}
+
 	// Update the set of placement ndoes
 	s.stack.SetNodes(nodes)
 
+	var placed []*structs.Allocation
+	preempted := false
+
 	for _, missing := range place {
 		// Check if this task group has already failed
 		if metric, ok := s.failedTGAllocs[missing.TaskGroup.Name]; ok {
@@ -446,19 +683,47 @@ func (s *GenericScheduler) computePlacements(place []allocTuple) error {
 			continue
 		}
 
+		// Defer the placement to a follow-up eval if the job has reached
+		// its placement cap
+		if !s.ctx.AllowPlacement(s.job.ID) {
+			s.limitReached = true
+			continue
+		}
+
 		// Find the preferred node
 		preferredNode, err := s.findPreferredNode(&missing)
 		if err != nil {
 			return err
 		}
 
-		// Attempt to match the task group
+		// Prefer the datacenter the allocation was previously placed in
+		previousDC, err := s.findPreviousDatacenter(&missing)
+		if err != nil {
+			return err
+		}
+		s.stack.SetPreferredDatacenter(previousDC)
+
+		// Prefer, or require, the node holding the sticky data of the
+		// allocation being replaced
+		stickyNode, err := s.findStickyNode(&missing)
+		if err != nil {
+			return err
+		}
+		s.stack.SetStickyVolume(stickyNode)
+
+		// Attempt to match the task group. With a sticky volume bonus the
+		// preferred node is ranked with the other nodes so the bonus decides.
 		var option *RankedNode
-		if preferredNode != nil {
+		if preferredNode != nil && s.stickyVolumeBonus != 0 {
+			option, _ = s.stack.SelectRankingNodes(missing.TaskGroup, []*structs.Node{preferredNode})
+		} else if preferredNode != nil {
 			option, _ = s.stack.SelectPreferringNodes(missing.TaskGroup, []*structs.Node{preferredNode})
 		} else {
 			option, _ = s.stack.Select(missing.TaskGroup)
 		}
+		if err := s.ctx.StateErr(); err != nil {
+			return err
+		}
 
 		// Store the available nodes by datacenter
 		s.ctx.Metrics().NodesAvailable = byDC
@@ -490,6 +755,18 @@ func (s *GenericScheduler) computePlacements(place []allocTuple) error {
 			}
 
 			s.plan.AppendAlloc(alloc)
+			s.ctx.RecordPlacement(s.job.ID)
+			placed = append(placed, alloc)
+
+			// Evict the allocations preempted for the placement
+			for _, reclaim := range option.Reclaim {
+				s.plan.AppendUpdate(reclaim, structs.AllocDesiredStatusEvict, allocPreempted, "")
+				if s.preempted == nil {
+					s.preempted = make(map[string]*structs.Allocation)
+				}
+				s.preempted[reclaim.ID] = reclaim
+				preempted = true
+			}
 		} else {
 			// Lazy initialize the failed map
 			if s.failedTGAllocs == nil {
@@ -500,9 +777,51 @@ func (s *GenericScheduler) computePlacements(place []allocTuple) error {
 		}
 	}
 
+	if deferred := s.ctx.DeferredPlacements(s.job.ID); deferred > 0 {
+		metrics.IncrCounter([]string{"nomad", "scheduler", "placements_deferred"}, float32(deferred))
+		s.logger.Printf("[DEBUG] sched: %#v: placement cap reached, %d placements deferred", s.eval, deferred)
+	}
+
+	// Placements preempting allocations aren't cached as the evictions would
+	// not be reused
+	if cache != nil && !preempted {
+		result := &placementResult{
+			key:          key,
+			limitReached: s.limitReached,
+		}
+		for _, alloc := range placed {
+			result.allocs = append(result.allocs, alloc.Copy())
+		}
+		for tg, metric := range s.failedTGAllocs {
+			if result.failed == nil {
+				result.failed = make(map[string]*structs.AllocMetric)
+			}
+			result.failed[tg] = metric.Copy()
+		}
+		cache.store(s.job.ID, result)
+	}
+
 	return nil
 }
 
+// applyCachedPlacements adds the cached placements to the plan. The
+// allocations are copied with new IDs for the current evaluation.
+func (s *GenericScheduler) applyCachedPlacements(result *placementResult) {
+	for _, cached := range result.allocs {
+		alloc := cached.Copy()
+		alloc.ID = structs.GenerateUUID()
+		alloc.EvalID = s.eval.ID
+		s.plan.AppendAlloc(alloc)
+	}
+	for tg, metric := range result.failed {
+		if s.failedTGAllocs == nil {
+			s.failedTGAllocs = make(map[string]*structs.AllocMetric)
+		}
+		s.failedTGAllocs[tg] = metric.Copy()
+	}
+	s.limitReached = s.limitReached || result.limitReached
+}
+
 // findPreferredNode finds the preferred node for an allocation
 func (s *GenericScheduler) findPreferredNode(allocTuple *allocTuple) (node *structs.Node, err error) {
 	if allocTuple.Alloc != nil {
@@ -514,10 +833,39 @@ func (s *GenericScheduler) findPreferredNode(allocTuple *allocTuple) (node *stru
 		if taskGroup.EphemeralDisk.Sticky == true {
 			var preferredNode *structs.Node
 			preferredNode, err = s.state.NodeByID(allocTuple.Alloc.NodeID)
-			if preferredNode.Ready() {
+			if preferredNode != nil && preferredNode.Ready() {
 				node = preferredNode
 			}
 		}
 	}
 	return
 }
+
+// findStickyNode returns the node holding the sticky data of the allocation
+// being replaced, or nil if the task group isn't sticky or the node no longer
+// exists.
+func (s *GenericScheduler) findStickyNode(allocTuple *allocTuple) (*structs.Node, error) {
+	if allocTuple.Alloc == nil {
+		return nil, nil
+	}
+	taskGroup := allocTuple.Alloc.Job.LookupTaskGroup(allocTuple.Alloc.TaskGroup)
+	if taskGroup == nil || !taskGroup.EphemeralDisk.Sticky {
+		return nil, nil
+	}
+	return s.state.NodeByID(allocTuple.Alloc.NodeID)
+}
+
+// findPreviousDatacenter returns the datacenter of the node the allocation
+// being replaced was placed on. An empty string is returned if there is no
+// previous allocation or its node no longer exists.
+func (s *GenericScheduler) findPreviousDatacenter(allocTuple *allocTuple) (string, error) {
+	if allocTuple.Alloc == nil {
+		return "", nil
+	}
+
+	node, err := s.state.NodeByID(allocTuple.Alloc.NodeID)
+	if err != nil || node == nil {
+		return "", err
+	}
+	return node.Datacenter, nil
+}
@@ -2,8 +2,10 @@ package scheduler
 
 import (
 	"fmt"
+	"log"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -2350,3 +2352,1114 @@ func TestServiceSched_NodeDrain_Sticky(t *testing.T) {
 
 	h.AssertEvalStatus(t, structs.EvalStatusComplete)
 }
+
+func TestServiceSched_JobRegister_ShuffleSeed(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job
+	job := mock.Job()
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Process the evaluation
+	err := h.Process(NewServiceScheduler, eval)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure the placements record the seed derived from the eval
+	if len(h.Plans) != 1 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	seed := evalShuffleSeed(eval.ID)
+	for _, allocList := range h.Plans[0].NodeAllocation {
+		for _, alloc := range allocList {
+			if alloc.Metrics.ShuffleSeed != seed {
+				t.Fatalf("bad: %#v", alloc.Metrics)
+			}
+		}
+	}
+}
+
+func TestServiceSched_JobRegister_DistinctTopology(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create two racks of two nodes named after their rack
+	rackOf := make(map[string]string)
+	for _, name := range []string{"r1-a", "r1-b", "r2-a", "r2-b"} {
+		node := mock.Node()
+		node.Name = name
+		rackOf[node.ID] = name[:2]
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job placing at most one alloc per rack
+	job := mock.Job()
+	job.TaskGroups[0].Count = 3
+	job.TaskGroups[0].Constraints = append(job.TaskGroups[0].Constraints,
+		&structs.Constraint{
+			Operand: structs.ConstraintDistinctProperty,
+			LTarget: "${topology.rack}",
+		})
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Derive the rack from the node name
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetTopologyRules([]*TopologyRule{
+			{
+				Label:  "rack",
+				Target: "${node.unique.name}",
+				Regexp: `^(r\d+)-`,
+			},
+		})
+		return s
+	}
+
+	// Process the evaluation
+	err := h.Process(factory, eval)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure a single plan
+	if len(h.Plans) != 1 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	plan := h.Plans[0]
+
+	// Ensure one alloc was placed in each rack
+	racks := make(map[string]int)
+	for nodeID, allocList := range plan.NodeAllocation {
+		racks[rackOf[nodeID]] += len(allocList)
+	}
+	if len(racks) != 2 || racks["r1"] != 1 || racks["r2"] != 1 {
+		t.Fatalf("bad: %#v", racks)
+	}
+
+	// Ensure the third alloc failed on the distinct property
+	metrics, ok := h.Evals[0].FailedTGAllocs[job.TaskGroups[0].Name]
+	if !ok {
+		t.Fatalf("bad: %#v", h.Evals[0].FailedTGAllocs)
+	}
+	if metrics.ConstraintFiltered["distinct_property ${topology.rack}"] != 4 {
+		t.Fatalf("bad: %#v", metrics)
+	}
+
+	h.AssertEvalStatus(t, structs.EvalStatusComplete)
+}
+
+func TestServiceSched_JobRegister_StateError(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		h := NewHarness(t)
+
+		// Create two nodes, failing to read the allocations of one. Every
+		// placement scans both nodes.
+		var failing string
+		for i := 0; i < 2; i++ {
+			node := mock.Node()
+			failing = node.ID
+			noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+		}
+
+		// Create a job
+		job := mock.Job()
+		job.TaskGroups[0].Count = 2
+		noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+		// Create a mock evaluation to register the job
+		eval := &structs.Evaluation{
+			ID:          structs.GenerateUUID(),
+			Priority:    job.Priority,
+			TriggeredBy: structs.EvalTriggerJobRegister,
+			JobID:       job.ID,
+		}
+
+		factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+			state = &stateErrorState{State: state, nodeID: failing}
+			s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+			s.SetFailOnStateError(fail)
+			return s
+		}
+
+		// Failing on state errors fails the evaluation
+		err := h.Process(factory, eval)
+		if fail {
+			if err == nil || !strings.Contains(err.Error(), "transient error") {
+				t.Fatalf("bad: %v", err)
+			}
+			if len(h.Plans) != 0 {
+				t.Fatalf("bad: %#v", h.Plans)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Ensure the allocs were placed on the other node
+		if len(h.Plans) != 1 {
+			t.Fatalf("bad: %#v", h.Plans)
+		}
+		var planned []*structs.Allocation
+		for nodeID, allocList := range h.Plans[0].NodeAllocation {
+			if nodeID == failing {
+				t.Fatalf("placed on failing node: %#v", allocList)
+			}
+			planned = append(planned, allocList...)
+		}
+		if len(planned) != 2 {
+			t.Fatalf("bad: %#v", h.Plans[0])
+		}
+		for _, alloc := range planned {
+			if alloc.Metrics.NodesSkipped != 1 {
+				t.Fatalf("bad: %#v", alloc.Metrics)
+			}
+		}
+
+		h.AssertEvalStatus(t, structs.EvalStatusComplete)
+	}
+}
+
+func TestServiceSched_JobRegister_Reclaim(t *testing.T) {
+	for _, reclaim := range []bool{false, true} {
+		h := NewHarness(t)
+
+		// Create a node full with a low priority alloc
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+
+		low := mock.Alloc()
+		low.NodeID = node.ID
+		low.Job.Priority = 10
+		low.Resources.CPU = 3900
+		low.TaskResources["web"].CPU = 3900
+		noErr(t, h.State.UpsertJobSummary(h.NextIndex(), mock.JobSummary(low.JobID)))
+		noErr(t, h.State.UpsertAllocs(h.NextIndex(), []*structs.Allocation{low}))
+
+		// Create a higher priority job
+		job := mock.Job()
+		job.TaskGroups[0].Count = 1
+		noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+		factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+			s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+			s.SetReclaim(reclaim)
+			return s
+		}
+
+		// Create a mock evaluation to register the job
+		eval := &structs.Evaluation{
+			ID:          structs.GenerateUUID(),
+			Priority:    job.Priority,
+			TriggeredBy: structs.EvalTriggerJobRegister,
+			JobID:       job.ID,
+		}
+		if err := h.Process(factory, eval); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Without reclaiming nothing is placed
+		if !reclaim {
+			if len(h.Plans) != 0 {
+				t.Fatalf("bad: %#v", h.Plans)
+			}
+			continue
+		}
+		if len(h.Plans) != 1 {
+			t.Fatalf("bad: %#v", h.Plans)
+		}
+		plan := h.Plans[0]
+
+		// Ensure the low priority alloc is evicted for the placement
+		if len(plan.NodeAllocation[node.ID]) != 1 {
+			t.Fatalf("bad: %#v", plan.NodeAllocation)
+		}
+		update := plan.NodeUpdate[node.ID]
+		if len(update) != 1 || update[0].ID != low.ID {
+			t.Fatalf("bad: %#v", plan.NodeUpdate)
+		}
+		if update[0].DesiredStatus != structs.AllocDesiredStatusEvict || update[0].DesiredDescription != allocPreempted {
+			t.Fatalf("bad: %#v", update[0])
+		}
+
+		// Ensure the plan applied
+		out, err := h.State.AllocsByNode(node.ID)
+		noErr(t, err)
+		running := 0
+		for _, alloc := range out {
+			if !alloc.TerminalStatus() {
+				running++
+			}
+		}
+		if running != 1 {
+			t.Fatalf("bad: %#v", out)
+		}
+
+		// Ensure the preempted job is evaluated to reschedule its alloc
+		if len(h.CreateEvals) != 1 {
+			t.Fatalf("bad: %#v", h.CreateEvals)
+		}
+		followup := h.CreateEvals[0]
+		if followup.JobID != low.JobID || followup.Priority != low.Job.Priority ||
+			followup.TriggeredBy != structs.EvalTriggerNodeUpdate || followup.NodeID != node.ID ||
+			followup.PreviousEval != eval.ID || followup.Status != structs.EvalStatusPending {
+			t.Fatalf("bad: %#v", followup)
+		}
+		h.AssertEvalStatus(t, structs.EvalStatusComplete)
+	}
+}
+
+func TestServiceSched_NodeRemoved_AttributeCache(t *testing.T) {
+	h := NewHarness(t)
+
+	// Register a node and cache its labels
+	node := mock.Node()
+	noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	cache, err := NewTopologyCache([]*TopologyRule{
+		{
+			Label:  "rack",
+			Target: "${node.unique.name}",
+			Regexp: ".+",
+		},
+	}, time.Hour)
+	noErr(t, err)
+	cache.Attributes(node)
+
+	job := mock.Job()
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetAttributeCache(cache)
+		return s
+	}
+
+	// Create a mock evaluation triggered by a node update
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerNodeUpdate,
+		JobID:       job.ID,
+		NodeID:      node.ID,
+	}
+
+	// The labels of a registered node are kept
+	if err := h.Process(factory, eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("bad: %d", cache.Len())
+	}
+
+	// The labels of a removed node are dropped
+	noErr(t, h.State.DeleteNode(h.NextIndex(), node.ID))
+	if err := h.Process(factory, eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("bad: %d", cache.Len())
+	}
+}
+
+func TestServiceSched_JobRegister_PlacementCache(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job
+	job := mock.Job()
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Reject every plan so each attempt computes the placements against
+	// unchanged state
+	h.Planner = &RejectPlan{h}
+
+	cache := NewPlacementCache()
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetPlacementCache(cache)
+		return s
+	}
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	hits, misses := placementCacheStats.hits.Value(), placementCacheStats.misses.Value()
+	if err := h.Process(factory, eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the first attempt computes the placements
+	if len(h.Plans) != maxServiceScheduleAttempts {
+		t.Fatalf("bad: %d plans", len(h.Plans))
+	}
+	if out := placementCacheStats.misses.Value() - misses; out != 1 {
+		t.Fatalf("bad: %d misses", out)
+	}
+	if out := placementCacheStats.hits.Value() - hits; out != int64(len(h.Plans)-1) {
+		t.Fatalf("bad: %d hits", out)
+	}
+
+	// Ensure the cached plans reuse the placements with new allocations
+	placements := func(plan *structs.Plan) map[string]string {
+		out := make(map[string]string)
+		for nodeID, allocList := range plan.NodeAllocation {
+			for _, alloc := range allocList {
+				out[alloc.Name] = nodeID
+			}
+		}
+		return out
+	}
+	expected := placements(h.Plans[0])
+	if len(expected) != 10 {
+		t.Fatalf("bad: %#v", h.Plans[0])
+	}
+	ids := make(map[string]struct{})
+	for _, plan := range h.Plans {
+		if !reflect.DeepEqual(placements(plan), expected) {
+			t.Fatalf("bad: %#v", plan)
+		}
+		for _, allocList := range plan.NodeAllocation {
+			for _, alloc := range allocList {
+				if alloc.EvalID != eval.ID {
+					t.Fatalf("bad: %#v", alloc)
+				}
+				ids[alloc.ID] = struct{}{}
+			}
+		}
+	}
+	if len(ids) != 10*len(h.Plans) {
+		t.Fatalf("allocation IDs reused")
+	}
+
+	// A state change forces the placements to be computed again
+	h.Planner = nil
+	h.Plans = nil
+	h.Evals = nil
+	noErr(t, h.State.UpsertNode(h.NextIndex(), mock.Node()))
+	eval.ID = structs.GenerateUUID()
+	misses = placementCacheStats.misses.Value()
+	if err := h.Process(factory, eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := placementCacheStats.misses.Value() - misses; out != 1 {
+		t.Fatalf("bad: %d misses", out)
+	}
+	if len(h.Plans) != 1 || len(placements(h.Plans[0])) != 10 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	h.AssertEvalStatus(t, structs.EvalStatusComplete)
+}
+
+func TestServiceSched_JobRegister_PlanVetoed(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job
+	job := mock.Job()
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Veto any plan that places more than five allocations
+	calls := 0
+	placed := 0
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetPlanValidator(func(plan *structs.Plan) error {
+			calls++
+			placed = 0
+			for _, allocs := range plan.NodeAllocation {
+				placed += len(allocs)
+			}
+			if placed > 5 {
+				return fmt.Errorf("too many placements: %d", placed)
+			}
+			return nil
+		})
+		return s
+	}
+
+	// Process the evaluation
+	err := h.Process(factory, eval)
+	if err == nil || !strings.Contains(err.Error(), "too many placements") {
+		t.Fatalf("expected veto, got: %v", err)
+	}
+
+	// Ensure the validator saw the full plan once
+	if calls != 1 || placed != 10 {
+		t.Fatalf("bad: calls %d placed %d", calls, placed)
+	}
+
+	// Ensure no plan was submitted
+	if len(h.Plans) != 0 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+
+	// Lookup the allocations by JobID
+	out, err := h.State.AllocsByJob(job.ID)
+	noErr(t, err)
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestServiceSched_JobRegister_PlanVetoed_NoEvals(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job with a task group that can't be placed, so the eval would
+	// block, and cap the placements, so the eval would be followed up
+	job := mock.Job()
+	unplaceable := job.TaskGroups[0].Copy()
+	unplaceable.Name = "unplaceable"
+	unplaceable.Constraints = append(unplaceable.Constraints, &structs.Constraint{
+		LTarget: "${attr.kernel.name}",
+		RTarget: "windows",
+		Operand: "=",
+	})
+	job.TaskGroups = append(job.TaskGroups, unplaceable)
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Veto every plan
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetPlacementCap(2)
+		s.SetPlanValidator(func(plan *structs.Plan) error {
+			return fmt.Errorf("vetoed")
+		})
+		return s
+	}
+
+	// Process the evaluation
+	if err := h.Process(factory, eval); err == nil || !strings.Contains(err.Error(), "vetoed") {
+		t.Fatalf("expected veto, got: %v", err)
+	}
+
+	// Ensure neither a blocked nor a follow-up eval was created for the
+	// vetoed plan
+	if len(h.CreateEvals) != 0 {
+		t.Fatalf("bad: %#v", h.CreateEvals)
+	}
+	if len(h.Plans) != 0 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+}
+
+func TestServiceSched_JobRegister_InvalidConstraint(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job with a malformed regexp constraint
+	job := mock.Job()
+	job.TaskGroups[0].Constraints = append(job.TaskGroups[0].Constraints, &structs.Constraint{
+		LTarget: "${attr.kernel.name}",
+		RTarget: "(foo",
+		Operand: structs.ConstraintRegex,
+	})
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Process the evaluation
+	err := h.Process(NewServiceScheduler, eval)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure no plan was submitted and no eval was created
+	if len(h.Plans) != 0 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	if len(h.CreateEvals) != 0 {
+		t.Fatalf("bad: %#v", h.CreateEvals)
+	}
+
+	// Ensure the eval failed with the malformed constraint
+	h.AssertEvalStatus(t, structs.EvalStatusFailed)
+	desc := h.Evals[0].StatusDescription
+	if !strings.Contains(desc, `group "web" constraint`) || !strings.Contains(desc, "invalid regexp") {
+		t.Fatalf("bad: %q", desc)
+	}
+}
+
+func TestServiceSched_JobRegister_RankingMode(t *testing.T) {
+	// placeAll registers the job using the ranking mode, returning the number
+	// of distinct nodes its allocations are placed on.
+	placeAll := func(mode RankingMode) int {
+		h := NewHarness(t)
+
+		// Create some nodes
+		for i := 0; i < 10; i++ {
+			node := mock.Node()
+			noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+		}
+
+		// Create a job
+		job := mock.Job()
+		noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+		// Create a mock evaluation to register the job
+		eval := &structs.Evaluation{
+			ID:          structs.GenerateUUID(),
+			Priority:    job.Priority,
+			TriggeredBy: structs.EvalTriggerJobRegister,
+			JobID:       job.ID,
+		}
+
+		factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+			s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+			s.SetRankingMode(mode)
+			return s
+		}
+
+		// Process the evaluation
+		if err := h.Process(factory, eval); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Ensure a single plan placing every alloc
+		if len(h.Plans) != 1 {
+			t.Fatalf("bad: %#v", h.Plans)
+		}
+		plan := h.Plans[0]
+		var planned []*structs.Allocation
+		for _, allocList := range plan.NodeAllocation {
+			planned = append(planned, allocList...)
+		}
+		if len(planned) != 10 {
+			t.Fatalf("bad: %#v", plan)
+		}
+
+		h.AssertEvalStatus(t, structs.EvalStatusComplete)
+		return len(plan.NodeAllocation)
+	}
+
+	// Each node fits seven allocs so consolidating needs two nodes
+	def := placeAll(RankingModeDefault)
+	cons := placeAll(RankingModeConsolidate)
+	if cons != 2 {
+		t.Fatalf("consolidate used %d nodes; want 2", cons)
+	}
+	if cons >= def {
+		t.Fatalf("consolidate used %d nodes; default used %d", cons, def)
+	}
+}
+
+func TestServiceSched_JobRegister_PlacementCap(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job
+	job := mock.Job()
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Only allow four placements per eval
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetPlacementCap(4)
+		return s
+	}
+
+	// Process the evaluation
+	err := h.Process(factory, eval)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure a single plan
+	if len(h.Plans) != 1 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	plan := h.Plans[0]
+
+	// Ensure the plan only allocated up to the cap
+	var planned []*structs.Allocation
+	for _, allocList := range plan.NodeAllocation {
+		planned = append(planned, allocList...)
+	}
+	if len(planned) != 4 {
+		t.Fatalf("bad: %#v", plan)
+	}
+
+	// Ensure a follow-up eval was created for the deferred placements
+	if len(h.CreateEvals) != 1 {
+		t.Fatalf("bad: %#v", h.CreateEvals)
+	}
+	if next := h.CreateEvals[0]; next.TriggeredBy != structs.EvalTriggerRollingUpdate || next.PreviousEval != eval.ID {
+		t.Fatalf("bad: %#v", next)
+	}
+
+	// Ensure the deferred placements are still queued
+	queued := h.Evals[0].QueuedAllocations["web"]
+	if queued != 6 {
+		t.Fatalf("expected queued: %v, actual: %v", 6, queued)
+	}
+
+	h.AssertEvalStatus(t, structs.EvalStatusComplete)
+}
+
+func TestServiceSched_JobRegister_PlacementCap_FailedPlacements(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job with task groups that can't be placed next to one that can
+	job := mock.Job()
+	job.TaskGroups[0].Count = 3
+	for i := 0; i < 8; i++ {
+		unplaceable := job.TaskGroups[0].Copy()
+		unplaceable.Name = fmt.Sprintf("unplaceable%d", i)
+		unplaceable.Count = 1
+		unplaceable.Constraints = append(unplaceable.Constraints, &structs.Constraint{
+			LTarget: "${attr.kernel.name}",
+			RTarget: "windows",
+			Operand: "=",
+		})
+		job.TaskGroups = append(job.TaskGroups, unplaceable)
+	}
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Only allow two placements per eval
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetPlacementCap(2)
+		return s
+	}
+
+	// Process the evaluation
+	err := h.Process(factory, eval)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure a single plan
+	if len(h.Plans) != 1 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	plan := h.Plans[0]
+
+	// Ensure the failed placements didn't count against the cap
+	var planned []*structs.Allocation
+	for _, allocList := range plan.NodeAllocation {
+		planned = append(planned, allocList...)
+	}
+	if len(planned) != 2 {
+		t.Fatalf("bad: %#v", plan)
+	}
+
+	// Ensure a follow-up eval was created for the deferred placements. The
+	// groups deferred rather than failed depend on the placement order, so
+	// a blocked eval may also have been created.
+	var next []*structs.Evaluation
+	for _, e := range h.CreateEvals {
+		if e.TriggeredBy == structs.EvalTriggerRollingUpdate {
+			next = append(next, e)
+		}
+	}
+	if len(next) != 1 || next[0].PreviousEval != eval.ID {
+		t.Fatalf("bad: %#v", h.CreateEvals)
+	}
+
+	h.AssertEvalStatus(t, structs.EvalStatusComplete)
+}
+
+func TestServiceSched_JobModify_PlacementCap(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	var nodes []*structs.Node
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		nodes = append(nodes, node)
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Generate a fake job with allocations
+	job := mock.Job()
+	job.TaskGroups[0].Count = 3
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	var allocs []*structs.Allocation
+	for i := 0; i < 3; i++ {
+		alloc := mock.Alloc()
+		alloc.Job = job
+		alloc.JobID = job.ID
+		alloc.NodeID = nodes[i].ID
+		alloc.Name = fmt.Sprintf("my-job.web[%d]", i)
+		allocs = append(allocs, alloc)
+	}
+	noErr(t, h.State.UpsertAllocs(h.NextIndex(), allocs))
+
+	// Update the job such that it cannot be done in-place and increase the
+	// count
+	job2 := mock.Job()
+	job2.ID = job.ID
+	job2.TaskGroups[0].Count = 6
+	job2.TaskGroups[0].Tasks[0].Config["command"] = "/bin/other"
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job2))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    50,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Only allow four placements per eval
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetPlacementCap(4)
+		return s
+	}
+
+	// Process the evaluation
+	err := h.Process(factory, eval)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure a single plan
+	if len(h.Plans) != 1 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	plan := h.Plans[0]
+
+	// Ensure every evicted alloc is replaced within the cap
+	var update []*structs.Allocation
+	for _, updateList := range plan.NodeUpdate {
+		update = append(update, updateList...)
+	}
+	if len(update) != 3 {
+		t.Fatalf("bad: %#v", plan)
+	}
+	placed := make(map[string]struct{})
+	for _, allocList := range plan.NodeAllocation {
+		for _, alloc := range allocList {
+			placed[alloc.Name] = struct{}{}
+		}
+	}
+	if len(placed) != 4 {
+		t.Fatalf("bad: %#v", plan)
+	}
+	for _, alloc := range update {
+		if _, ok := placed[alloc.Name]; !ok {
+			t.Fatalf("evicted alloc %q not replaced", alloc.Name)
+		}
+	}
+
+	// Ensure a follow-up eval was created for the deferred placements
+	if len(h.CreateEvals) != 1 {
+		t.Fatalf("bad: %#v", h.CreateEvals)
+	}
+
+	h.AssertEvalStatus(t, structs.EvalStatusComplete)
+}
+
+// stickyVolumeHarness returns a harness with a failed allocation of a task
+// group with a sticky volume on a drained node and a ready node it may be
+// replaced on, along with an evaluation to replace it.
+func stickyVolumeHarness(t *testing.T) (*Harness, *structs.Node, *structs.Node, *structs.Evaluation) {
+	h := NewHarness(t)
+
+	// Register the node holding the sticky data, which is being drained, and
+	// another node
+	prev := mock.Node()
+	prev.Drain = true
+	noErr(t, h.State.UpsertNode(h.NextIndex(), prev))
+	other := mock.Node()
+	noErr(t, h.State.UpsertNode(h.NextIndex(), other))
+
+	// Create a failed alloc on the drained node
+	job := mock.Job()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].EphemeralDisk.Sticky = true
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	alloc := mock.Alloc()
+	alloc.Job = job
+	alloc.JobID = job.ID
+	alloc.Name = "my-job.web[0]"
+	alloc.NodeID = prev.ID
+	alloc.ClientStatus = structs.AllocClientStatusFailed
+	noErr(t, h.State.UpsertAllocs(h.NextIndex(), []*structs.Allocation{alloc}))
+
+	// Create a mock evaluation to replace the alloc
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerNodeUpdate,
+		JobID:       job.ID,
+	}
+	return h, prev, other, eval
+}
+
+func TestServiceSched_StickyVolume_Preferred(t *testing.T) {
+	h, _, other, eval := stickyVolumeHarness(t)
+
+	// Process the evaluation
+	if err := h.Process(NewServiceScheduler, eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure the replacement is placed on the other node as the sticky node
+	// is only preferred
+	if len(h.Plans) != 1 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	planned := h.Plans[0].NodeAllocation[other.ID]
+	if len(planned) != 1 {
+		t.Fatalf("bad: %#v", h.Plans[0])
+	}
+
+	h.AssertEvalStatus(t, structs.EvalStatusComplete)
+}
+
+func TestServiceSched_StickyVolume_Preferred_Bonus(t *testing.T) {
+	cases := []struct {
+		sticky bool
+		bonus  float64
+		ranked bool
+	}{
+		// Bin-packing places the replacement when it isn't sticky
+		{false, 20.0, true},
+
+		// The sticky node is preferred whenever it fits
+		{true, 0, false},
+
+		// The sticky node is ranked with the other node and the bonus
+		// outweighs bin-packing
+		{true, 20.0, true},
+	}
+
+	for _, c := range cases {
+		h := NewHarness(t)
+
+		// Register the ready node the failed alloc ran on and a fuller node
+		// bin-packing prefers
+		prev := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), prev))
+		other := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), other))
+
+		filler := mock.Alloc()
+		filler.NodeID = other.ID
+		filler.Resources.CPU = 2000
+		filler.TaskResources["web"].CPU = 2000
+		noErr(t, h.State.UpsertJobSummary(h.NextIndex(), mock.JobSummary(filler.JobID)))
+		noErr(t, h.State.UpsertAllocs(h.NextIndex(), []*structs.Allocation{filler}))
+
+		// Create a failed alloc on the previous node
+		job := mock.Job()
+		job.TaskGroups[0].Count = 1
+		job.TaskGroups[0].EphemeralDisk.Sticky = c.sticky
+		noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+		alloc := mock.Alloc()
+		alloc.Job = job
+		alloc.JobID = job.ID
+		alloc.Name = "my-job.web[0]"
+		alloc.NodeID = prev.ID
+		alloc.ClientStatus = structs.AllocClientStatusFailed
+		noErr(t, h.State.UpsertAllocs(h.NextIndex(), []*structs.Allocation{alloc}))
+
+		// Create a mock evaluation to replace the alloc
+		eval := &structs.Evaluation{
+			ID:          structs.GenerateUUID(),
+			Priority:    job.Priority,
+			TriggeredBy: structs.EvalTriggerNodeUpdate,
+			JobID:       job.ID,
+		}
+		bonus := c.bonus
+		factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+			s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+			s.SetStickyVolumeBonus(bonus)
+			return s
+		}
+		if err := h.Process(factory, eval); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(h.Plans) != 1 {
+			t.Fatalf("bad: %#v", h.Plans)
+		}
+
+		expected := other
+		if c.sticky {
+			expected = prev
+		}
+		if len(h.Plans[0].NodeAllocation[expected.ID]) != 1 {
+			t.Fatalf("case %#v bad: %#v", c, h.Plans[0].NodeAllocation)
+		}
+
+		// Ensure the bonus was only applied to a sticky node with a bonus
+		// and the other node was only ranked when expected
+		metrics := h.Plans[0].NodeAllocation[expected.ID][0].Metrics
+		_, ok := metrics.Scores[fmt.Sprintf("%s.sticky-volume", prev.ID)]
+		if ok != (c.sticky && c.bonus != 0) {
+			t.Fatalf("case %#v bad: %#v", c, metrics.Scores)
+		}
+		if _, ok := metrics.Scores[fmt.Sprintf("%s.binpack", other.ID)]; ok != c.ranked {
+			t.Fatalf("case %#v bad: %#v", c, metrics.Scores)
+		}
+
+		h.AssertEvalStatus(t, structs.EvalStatusComplete)
+	}
+}
+
+func TestServiceSched_StickyVolume_Required(t *testing.T) {
+	h, _, _, eval := stickyVolumeHarness(t)
+
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetStickyVolumeRequired(true)
+		return s
+	}
+
+	// Process the evaluation
+	if err := h.Process(factory, eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure no plan as the sticky node can't be placed on
+	if len(h.Plans) != 0 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+
+	// Ensure the placement failed because of the sticky volume
+	if len(h.Evals) != 1 {
+		t.Fatalf("bad: %#v", h.Evals)
+	}
+	metric, ok := h.Evals[0].FailedTGAllocs["web"]
+	if !ok {
+		t.Fatalf("bad: %#v", h.Evals[0].FailedTGAllocs)
+	}
+	if metric.ConstraintFiltered["sticky volume on unavailable node"] != 1 {
+		t.Fatalf("bad: %#v", metric)
+	}
+
+	// Ensure a blocked eval was created to retry once the node is available
+	if len(h.CreateEvals) != 1 || h.CreateEvals[0].Status != structs.EvalStatusBlocked {
+		t.Fatalf("bad: %#v", h.CreateEvals)
+	}
+}
+
+func TestServiceSched_StickyVolume_Required_NodeGone(t *testing.T) {
+	h, prev, other, eval := stickyVolumeHarness(t)
+
+	// Remove the node holding the sticky data
+	noErr(t, h.State.DeleteNode(h.NextIndex(), prev.ID))
+
+	factory := func(logger *log.Logger, state State, planner Planner) Scheduler {
+		s := NewServiceScheduler(logger, state, planner).(*GenericScheduler)
+		s.SetStickyVolumeRequired(true)
+		return s
+	}
+
+	// Process the evaluation
+	if err := h.Process(factory, eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure the replacement is placed on the other node as the sticky data
+	// is gone with the node
+	if len(h.Plans) != 1 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+	if len(h.Plans[0].NodeAllocation[other.ID]) != 1 {
+		t.Fatalf("bad: %#v", h.Plans[0])
+	}
+
+	h.AssertEvalStatus(t, structs.EvalStatusComplete)
+}
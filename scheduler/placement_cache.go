@@ -0,0 +1,164 @@
+package scheduler
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// placementCacheStats tracks the placement cache
+var placementCacheStats = newCacheStats("placement")
+
+// PlacementCache caches the placement results of evaluations so an
+// evaluation of an unchanged job against unchanged state can reuse the prior
+// placement decision without running feasibility checking and ranking again.
+// Results are keyed by a hash of the job and the modify indexes of the nodes
+// and allocations the placements depend on, so any relevant state change
+// results in a miss. Only the latest result is kept per job.
+//
+// A cache is safe for concurrent use and may be shared between the schedulers
+// of several evaluations, as long as they are configured identically.
+type PlacementCache struct {
+	l       sync.Mutex
+	entries map[string]*placementResult
+}
+
+// placementResult is the cached result of computing the placements of a job.
+type placementResult struct {
+	// key is the hash the result was computed for
+	key uint64
+
+	// allocs are the placed allocations
+	allocs []*structs.Allocation
+
+	// failed is the metrics of the task groups that failed to place
+	failed map[string]*structs.AllocMetric
+
+	// limitReached is whether placements were deferred by the placement cap
+	limitReached bool
+}
+
+// NewPlacementCache returns an empty placement cache.
+func NewPlacementCache() *PlacementCache {
+	return &PlacementCache{
+		entries: make(map[string]*placementResult),
+	}
+}
+
+// Invalidate drops the cached result of the job.
+func (c *PlacementCache) Invalidate(jobID string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	delete(c.entries, jobID)
+}
+
+// lookup returns the result cached for the job if it was computed for the
+// key.
+func (c *PlacementCache) lookup(jobID string, key uint64) (*placementResult, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	result, ok := c.entries[jobID]
+	hit := ok && result.key == key
+	placementCacheStats.lookup(hit)
+	if !hit {
+		return nil, false
+	}
+	return result, true
+}
+
+// store caches the result of the job, replacing any previous result.
+func (c *PlacementCache) store(jobID string, result *placementResult) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	placementCacheStats.store()
+	c.entries[jobID] = result
+}
+
+// placementCacheKey returns the cache key of placing the allocations of the
+// job on the nodes and whether the placements can be cached at all. The key
+// covers the job spec, the placements and the modify indexes of the nodes and
+// of their allocations. Jobs with time window constraints are not cached since
+// their placements depend on the time of the evaluation.
+func placementCacheKey(state State, job *structs.Job, place []allocTuple, nodes []*structs.Node) (uint64, bool, error) {
+	if jobHasOperand(job, structs.ConstraintTimeWindow) {
+		return 0, false, nil
+	}
+
+	h := fnv.New64a()
+	hashString(h, job.ID)
+	hashUint64(h, job.JobModifyIndex)
+
+	// The placements are diffed from maps so their order isn't stable
+	names := make([]string, 0, len(place))
+	for _, missing := range place {
+		name := missing.Name + "\x00" + missing.TaskGroup.Name
+		if missing.Alloc != nil {
+			name += "\x00" + missing.Alloc.ID
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hashString(h, name)
+	}
+
+	for _, node := range nodes {
+		hashString(h, node.ID)
+		hashUint64(h, node.ModifyIndex)
+
+		allocs, err := state.AllocsByNode(node.ID)
+		if err != nil {
+			return 0, false, err
+		}
+		hashUint64(h, uint64(len(allocs)))
+		for _, alloc := range allocs {
+			hashString(h, alloc.ID)
+			hashUint64(h, alloc.ModifyIndex)
+		}
+	}
+	return h.Sum64(), true, nil
+}
+
+// jobHasOperand returns whether any constraint of the job, its task groups or
+// its tasks uses the operand.
+func jobHasOperand(job *structs.Job, operand string) bool {
+	if hasOperand(job.Constraints, operand) {
+		return true
+	}
+	for _, tg := range job.TaskGroups {
+		if hasOperand(tg.Constraints, operand) {
+			return true
+		}
+		for _, task := range tg.Tasks {
+			if hasOperand(task.Constraints, operand) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasOperand returns whether any of the constraints uses the operand.
+func hasOperand(constraints []*structs.Constraint, operand string) bool {
+	for _, c := range constraints {
+		if c.Operand == operand {
+			return true
+		}
+	}
+	return false
+}
+
+func hashString(h hash.Hash64, s string) {
+	h.Write([]byte(s))
+	h.Write([]byte{0})
+}
+
+func hashUint64(h hash.Hash64, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestPlacementCacheKey(t *testing.T) {
+	state, _ := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	for i, node := range nodes {
+		noErr(t, state.UpsertNode(uint64(1000+i), node))
+	}
+
+	job := mock.Job()
+	job.JobModifyIndex = 1000
+	place := []allocTuple{
+		{Name: "my-job.web[0]", TaskGroup: job.TaskGroups[0]},
+	}
+
+	key := func() uint64 {
+		k, ok, err := placementCacheKey(state, job, place, nodes)
+		if err != nil || !ok {
+			t.Fatalf("bad: %v %v", ok, err)
+		}
+		return k
+	}
+
+	// The key is stable for unchanged state
+	base := key()
+	if k := key(); k != base {
+		t.Fatalf("unstable key: %d %d", k, base)
+	}
+
+	// Modifying the allocations of a node changes the key
+	alloc := mock.Alloc()
+	alloc.NodeID = nodes[0].ID
+	noErr(t, state.UpsertAllocs(1010, []*structs.Allocation{alloc}))
+	allocKey := key()
+	if allocKey == base {
+		t.Fatalf("key not changed by alloc")
+	}
+
+	// Modifying a node changes the key
+	noErr(t, state.UpdateNodeDrain(1020, nodes[1].ID, true))
+	nodes[1], _ = state.NodeByID(nodes[1].ID)
+	nodeKey := key()
+	if nodeKey == allocKey {
+		t.Fatalf("key not changed by node")
+	}
+
+	// Modifying the job spec changes the key
+	job.JobModifyIndex = 1030
+	if key() == nodeKey {
+		t.Fatalf("key not changed by job")
+	}
+
+	// Time dependent placements are not cacheable
+	job.Constraints = append(job.Constraints, &structs.Constraint{
+		Operand: structs.ConstraintTimeWindow,
+		RTarget: "22:00-06:00",
+	})
+	if _, ok, err := placementCacheKey(state, job, place, nodes); ok || err != nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+}
+
+func TestPlacementCache(t *testing.T) {
+	stores := placementCacheStats.stores.Value()
+	cache := NewPlacementCache()
+	if _, ok := cache.lookup("foo", 1); ok {
+		t.Fatalf("unexpected hit")
+	}
+
+	result := &placementResult{key: 1}
+	cache.store("foo", result)
+	if out, ok := cache.lookup("foo", 1); !ok || out != result {
+		t.Fatalf("bad: %#v %v", out, ok)
+	}
+
+	// A different key misses
+	if _, ok := cache.lookup("foo", 2); ok {
+		t.Fatalf("unexpected hit")
+	}
+
+	// Storing replaces the result of the job
+	cache.store("foo", &placementResult{key: 2})
+	if _, ok := cache.lookup("foo", 1); ok {
+		t.Fatalf("unexpected hit")
+	}
+	if _, ok := cache.lookup("foo", 2); !ok {
+		t.Fatalf("expected hit")
+	}
+	if out := placementCacheStats.stores.Value() - stores; out != 2 {
+		t.Fatalf("bad: %d stores", out)
+	}
+
+	cache.Invalidate("foo")
+	if _, ok := cache.lookup("foo", 2); ok {
+		t.Fatalf("unexpected hit")
+	}
+}
@@ -2,6 +2,9 @@ package scheduler
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -17,6 +20,10 @@ type RankedNode struct {
 	// Allocs is used to cache the proposed allocations on the
 	// node. This can be shared between iterators that require it.
 	Proposed []*structs.Allocation
+
+	// Reclaim is the lower priority allocations that must be preempted
+	// for the placement to fit on the node.
+	Reclaim []*structs.Allocation
 }
 
 func (r *RankedNode) GoString() string {
@@ -134,6 +141,7 @@ type BinPackIterator struct {
 	ctx       Context
 	source    RankIterator
 	evict     bool
+	reclaim   bool
 	priority  int
 	taskGroup *structs.TaskGroup
 }
@@ -150,6 +158,14 @@ func NewBinPackIterator(ctx Context, source RankIterator, evict bool, priority i
 	return iter
 }
 
+// SetReclaim sets whether nodes that only fit the task group by preempting
+// lower priority allocations are feasible. The allocations to preempt are
+// returned in the Reclaim field of the ranked node and must be evicted by the
+// caller, otherwise the plan will be rejected.
+func (iter *BinPackIterator) SetReclaim(reclaim bool) {
+	iter.reclaim = reclaim
+}
+
 func (iter *BinPackIterator) SetPriority(p int) {
 	iter.priority = p
 }
@@ -170,9 +186,7 @@ OUTER:
 		// Get the proposed allocations
 		proposed, err := option.ProposedAllocs(iter.ctx)
 		if err != nil {
-			iter.ctx.Logger().Printf(
-				"[ERR] sched.binpack: failed to get proposed allocations: %v",
-				err)
+			iter.ctx.StateError(option.Node, "binpack", err)
 			continue
 		}
 
@@ -193,8 +207,9 @@ OUTER:
 				ask := taskResources.Networks[0]
 				offer, err := netIdx.AssignNetwork(ask)
 				if offer == nil {
-					iter.ctx.Metrics().ExhaustedNode(option.Node,
-						fmt.Sprintf("network: %s", err))
+					reason := fmt.Sprintf("network: %s", err)
+					iter.ctx.Metrics().ExhaustedNode(option.Node, reason)
+					iter.ctx.RejectNode(option.Node, "binpack", reason)
 					netIdx.Release()
 					continue OUTER
 				}
@@ -216,19 +231,21 @@ OUTER:
 		// Add the resources we are trying to fit
 		proposed = append(proposed, &structs.Allocation{Resources: total})
 
-		// Check if these allocations fit, if they do not, simply skip this node
+		// Check if these allocations fit, if they do not, check if they
+		// would by reclaiming the resources of lower priority allocations
+		// and otherwise skip this node
 		fit, dim, util, _ := structs.AllocsFit(option.Node, proposed, netIdx)
+		option.Reclaim = nil
+		if !fit && iter.reclaim {
+			fit, util = iter.reclaimFit(option, proposed, netIdx)
+		}
 		netIdx.Release()
 		if !fit {
 			iter.ctx.Metrics().ExhaustedNode(option.Node, dim)
+			iter.ctx.RejectNode(option.Node, "binpack", dim)
 			continue
 		}
 
-		// XXX: For now we completely ignore evictions. We should use that flag
-		// to determine if its possible to evict other lower priority allocations
-		// to make room. This explodes the search space, so it must be done
-		// carefully.
-
 		// Score the fit normally otherwise
 		fitness := structs.ScoreFit(option.Node, util)
 		option.Score += fitness
@@ -237,6 +254,94 @@ OUTER:
 	}
 }
 
+// reclaimFit checks if the proposed allocations fit on the node by preempting
+// reclaimable allocations. The lowest priority allocations are preempted first
+// until the allocations fit, after which any preempted allocation that isn't
+// needed for the fit is kept, so no allocation in the returned set can be left
+// running. The network index is not updated so reserved ports are never
+// reclaimed.
+func (iter *BinPackIterator) reclaimFit(option *RankedNode, proposed []*structs.Allocation,
+	netIdx *structs.NetworkIndex) (bool, *structs.Resources) {
+	reclaimable, err := iter.ctx.ReclaimableAllocs(option.Node.ID, iter.priority)
+	if err != nil {
+		iter.ctx.StateError(option.Node, "binpack", err)
+		return false, nil
+	}
+	if len(reclaimable) == 0 {
+		return false, nil
+	}
+	sort.Stable(allocsByPriority(reclaimable))
+
+	// Copy the proposed allocations as they are removed in place
+	remaining := make([]*structs.Allocation, len(proposed))
+	copy(remaining, proposed)
+
+	// Preempt allocations until the proposed allocations fit
+	var preempt []*structs.Allocation
+	fit := false
+	for _, alloc := range reclaimable {
+		preempt = append(preempt, alloc)
+		remaining = structs.RemoveAllocs(remaining, []*structs.Allocation{alloc})
+		if fit, _, _, _ = structs.AllocsFit(option.Node, remaining, netIdx); fit {
+			break
+		}
+	}
+	if !fit {
+		return false, nil
+	}
+
+	// Keep the preempted allocations that still fit, trying the higher
+	// priority allocations first
+	for i := len(preempt) - 1; i >= 0; i-- {
+		kept := append(remaining[:len(remaining):len(remaining)], preempt[i])
+		if fit, _, _, _ := structs.AllocsFit(option.Node, kept, netIdx); fit {
+			remaining = kept
+			preempt = append(preempt[:i], preempt[i+1:]...)
+		}
+	}
+	_, _, util, _ := structs.AllocsFit(option.Node, remaining, netIdx)
+
+	// Record the reclaimed resources
+	reclaimed := new(structs.Resources)
+	for _, alloc := range preempt {
+		reclaimed.Add(allocResources(alloc))
+	}
+	option.Reclaim = preempt
+	iter.ctx.Metrics().ReclaimNode(option.Node, reclaimed)
+	return true, util
+}
+
+// allocsByPriority sorts allocations by the priority of their job, lowest
+// first.
+type allocsByPriority []*structs.Allocation
+
+func (a allocsByPriority) Len() int {
+	return len(a)
+}
+
+func (a allocsByPriority) Less(i, j int) bool {
+	return a[i].Job.Priority < a[j].Job.Priority
+}
+
+func (a allocsByPriority) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+// allocResources returns the total resources of an allocation. Allocations
+// within the plan have the combined resources stripped, so the task and
+// shared resources are summed instead.
+func allocResources(alloc *structs.Allocation) *structs.Resources {
+	if alloc.Resources != nil {
+		return alloc.Resources
+	}
+	total := new(structs.Resources)
+	total.Add(alloc.SharedResources)
+	for _, r := range alloc.TaskResources {
+		total.Add(r)
+	}
+	return total
+}
+
 func (iter *BinPackIterator) Reset() {
 	iter.source.Reset()
 }
@@ -267,19 +372,21 @@ func (iter *JobAntiAffinityIterator) SetJob(jobID string) {
 	iter.jobID = jobID
 }
 
+func (iter *JobAntiAffinityIterator) SetPenalty(penalty float64) {
+	iter.penalty = penalty
+}
+
 func (iter *JobAntiAffinityIterator) Next() *RankedNode {
 	for {
 		option := iter.source.Next()
-		if option == nil {
-			return nil
+		if option == nil || iter.penalty == 0 {
+			return option
 		}
 
 		// Get the proposed allocations
 		proposed, err := option.ProposedAllocs(iter.ctx)
 		if err != nil {
-			iter.ctx.Logger().Printf(
-				"[ERR] sched.job-anti-aff: failed to get proposed allocations: %v",
-				err)
+			iter.ctx.StateError(option.Node, "job-anti-aff", err)
 			continue
 		}
 
@@ -304,3 +411,642 @@ func (iter *JobAntiAffinityIterator) Next() *RankedNode {
 func (iter *JobAntiAffinityIterator) Reset() {
 	iter.source.Reset()
 }
+
+// JobConsolidationIterator is used to apply an affinity to allocating along
+// side other allocations from this job. This is used to concentrate the
+// allocations of a job on as few nodes as possible.
+type JobConsolidationIterator struct {
+	ctx    Context
+	source RankIterator
+	bonus  float64
+	jobID  string
+}
+
+// NewJobConsolidationIterator is used to create a JobConsolidationIterator
+// that applies the given bonus for co-placement with allocs from this job. A
+// zero bonus disables the iterator.
+func NewJobConsolidationIterator(ctx Context, source RankIterator, bonus float64, jobID string) *JobConsolidationIterator {
+	iter := &JobConsolidationIterator{
+		ctx:    ctx,
+		source: source,
+		bonus:  bonus,
+		jobID:  jobID,
+	}
+	return iter
+}
+
+func (iter *JobConsolidationIterator) SetJob(jobID string) {
+	iter.jobID = jobID
+}
+
+func (iter *JobConsolidationIterator) SetBonus(bonus float64) {
+	iter.bonus = bonus
+}
+
+func (iter *JobConsolidationIterator) Next() *RankedNode {
+	for {
+		option := iter.source.Next()
+		if option == nil || iter.bonus == 0 {
+			return option
+		}
+
+		// Get the proposed allocations
+		proposed, err := option.ProposedAllocs(iter.ctx)
+		if err != nil {
+			iter.ctx.StateError(option.Node, "job-consolidate", err)
+			continue
+		}
+
+		// Apply the bonus if the node is already running an alloc of the job.
+		// The bonus is flat so that amongst the nodes already used by the job
+		// bin-packing still decides.
+		for _, alloc := range proposed {
+			if alloc.JobID == iter.jobID {
+				option.Score += iter.bonus
+				iter.ctx.Metrics().ScoreNode(option.Node, "job-consolidate", iter.bonus)
+				break
+			}
+		}
+		return option
+	}
+}
+
+func (iter *JobConsolidationIterator) Reset() {
+	iter.source.Reset()
+}
+
+// DecayingAffinityIterator is used to apply an affinity to placing the
+// allocations of a task group on the same node which decays with each
+// allocation of the group already on the node. The first allocation on a node
+// receives the full bonus and each following one the bonus multiplied by the
+// decay factor once more, which smooths between packing and spreading.
+type DecayingAffinityIterator struct {
+	ctx       Context
+	source    RankIterator
+	bonus     float64
+	decay     float64
+	jobID     string
+	taskGroup string
+}
+
+// NewDecayingAffinityIterator is used to create a DecayingAffinityIterator
+// that applies the given bonus decayed by the decay factor, which should be
+// between zero and one. A zero bonus disables the iterator.
+func NewDecayingAffinityIterator(ctx Context, source RankIterator, bonus, decay float64) *DecayingAffinityIterator {
+	iter := &DecayingAffinityIterator{
+		ctx:    ctx,
+		source: source,
+		bonus:  bonus,
+		decay:  decay,
+	}
+	return iter
+}
+
+func (iter *DecayingAffinityIterator) SetJob(jobID string) {
+	iter.jobID = jobID
+}
+
+func (iter *DecayingAffinityIterator) SetTaskGroup(tg string) {
+	iter.taskGroup = tg
+}
+
+func (iter *DecayingAffinityIterator) SetBonus(bonus float64) {
+	iter.bonus = bonus
+}
+
+func (iter *DecayingAffinityIterator) SetDecay(decay float64) {
+	iter.decay = decay
+}
+
+func (iter *DecayingAffinityIterator) Next() *RankedNode {
+	for {
+		option := iter.source.Next()
+		if option == nil || iter.bonus == 0 {
+			return option
+		}
+
+		// Get the proposed allocations
+		proposed, err := option.ProposedAllocs(iter.ctx)
+		if err != nil {
+			iter.ctx.StateError(option.Node, "decaying-affinity", err)
+			continue
+		}
+
+		// Determine the co-location of the task group on the node
+		collisions := 0
+		for _, alloc := range proposed {
+			if alloc.JobID == iter.jobID && alloc.TaskGroup == iter.taskGroup {
+				collisions++
+			}
+		}
+
+		// Apply the decayed bonus
+		applied := iter.bonus * math.Pow(iter.decay, float64(collisions))
+		option.Score += applied
+		iter.ctx.Metrics().ScoreNode(option.Node, "decaying-affinity", applied)
+		return option
+	}
+}
+
+func (iter *DecayingAffinityIterator) Reset() {
+	iter.source.Reset()
+}
+
+// DatacenterLocalityIterator is used to apply a bonus to nodes in the
+// datacenter an allocation was previously placed in. This is used to keep
+// rescheduled allocations close to their data.
+type DatacenterLocalityIterator struct {
+	ctx        Context
+	source     RankIterator
+	bonus      float64
+	datacenter string
+}
+
+// NewDatacenterLocalityIterator is used to create a DatacenterLocalityIterator
+// that applies the given bonus to nodes in the preferred datacenter.
+func NewDatacenterLocalityIterator(ctx Context, source RankIterator, bonus float64) *DatacenterLocalityIterator {
+	iter := &DatacenterLocalityIterator{
+		ctx:    ctx,
+		source: source,
+		bonus:  bonus,
+	}
+	return iter
+}
+
+// SetDatacenter sets the preferred datacenter. An empty datacenter disables
+// the bonus.
+func (iter *DatacenterLocalityIterator) SetDatacenter(dc string) {
+	iter.datacenter = dc
+}
+
+func (iter *DatacenterLocalityIterator) SetBonus(bonus float64) {
+	iter.bonus = bonus
+}
+
+func (iter *DatacenterLocalityIterator) Next() *RankedNode {
+	option := iter.source.Next()
+	if option == nil || iter.datacenter == "" || iter.bonus == 0 {
+		return option
+	}
+
+	if option.Node.Datacenter == iter.datacenter {
+		option.Score += iter.bonus
+		iter.ctx.Metrics().ScoreNode(option.Node, "datacenter-locality", iter.bonus)
+	}
+	return option
+}
+
+func (iter *DatacenterLocalityIterator) Reset() {
+	iter.source.Reset()
+}
+
+// PowerEfficiencyIterator is used to apply a bonus to nodes that consume less
+// power per core, read from a node attribute. The bonus is bounded by the
+// weight and shrinks as the power per core grows so that it biases between
+// otherwise equal nodes rather than overriding bin-packing. Nodes missing the
+// attribute, or with a value that isn't a non-negative number, receive no
+// bonus.
+type PowerEfficiencyIterator struct {
+	ctx    Context
+	source RankIterator
+	weight float64
+	target string
+}
+
+// NewPowerEfficiencyIterator is used to create a PowerEfficiencyIterator that
+// reads the power per core from the target, such as "${meta.power_per_core}",
+// and applies a bonus of up to the weight. A zero weight disables the
+// iterator.
+func NewPowerEfficiencyIterator(ctx Context, source RankIterator, weight float64, target string) *PowerEfficiencyIterator {
+	iter := &PowerEfficiencyIterator{
+		ctx:    ctx,
+		source: source,
+		weight: weight,
+		target: target,
+	}
+	return iter
+}
+
+func (iter *PowerEfficiencyIterator) SetWeight(weight float64) {
+	iter.weight = weight
+}
+
+func (iter *PowerEfficiencyIterator) SetTarget(target string) {
+	iter.target = target
+}
+
+func (iter *PowerEfficiencyIterator) Next() *RankedNode {
+	option := iter.source.Next()
+	if option == nil || iter.weight == 0 {
+		return option
+	}
+
+	val, ok := resolveNodeTarget(iter.ctx, iter.target, option.Node)
+	if !ok {
+		return option
+	}
+	str, ok := val.(string)
+	if !ok {
+		return option
+	}
+	power, err := strconv.ParseFloat(str, 64)
+	if err != nil || power < 0 {
+		return option
+	}
+
+	bonus := iter.weight / (1 + power)
+	option.Score += bonus
+	iter.ctx.Metrics().ScoreNode(option.Node, "power-efficiency", bonus)
+	return option
+}
+
+func (iter *PowerEfficiencyIterator) Reset() {
+	iter.source.Reset()
+}
+
+// ZoneDistanceIterator is used to apply a bonus to nodes in zones close to a
+// preferred zone, for latency sensitive placements. The zone of a node is read
+// from a node attribute and the distance between zones from a configured
+// matrix. The bonus is bounded by the weight and shrinks as the distance
+// grows. Nodes without a zone, or in a zone without a known distance to the
+// preferred zone, receive no bonus.
+type ZoneDistanceIterator struct {
+	ctx       Context
+	source    RankIterator
+	weight    float64
+	target    string
+	zone      string
+	distances map[string]map[string]float64
+}
+
+// NewZoneDistanceIterator is used to create a ZoneDistanceIterator that reads
+// the zone of nodes from the target, such as "${meta.zone}". A zero weight or
+// an empty preferred zone disables the iterator.
+func NewZoneDistanceIterator(ctx Context, source RankIterator, weight float64, target string) *ZoneDistanceIterator {
+	iter := &ZoneDistanceIterator{
+		ctx:    ctx,
+		source: source,
+		weight: weight,
+		target: target,
+	}
+	return iter
+}
+
+func (iter *ZoneDistanceIterator) SetWeight(weight float64) {
+	iter.weight = weight
+}
+
+// SetZone sets the preferred zone.
+func (iter *ZoneDistanceIterator) SetZone(zone string) {
+	iter.zone = zone
+}
+
+// SetDistances sets the distance matrix between zones. Distances are
+// symmetric so only one direction between two zones needs to be set.
+func (iter *ZoneDistanceIterator) SetDistances(distances map[string]map[string]float64) {
+	iter.distances = distances
+}
+
+// distance returns the distance between the preferred zone and the zone.
+func (iter *ZoneDistanceIterator) distance(zone string) (float64, bool) {
+	if zone == iter.zone {
+		return 0, true
+	}
+	if d, ok := iter.distances[iter.zone][zone]; ok {
+		return d, true
+	}
+	d, ok := iter.distances[zone][iter.zone]
+	return d, ok
+}
+
+func (iter *ZoneDistanceIterator) Next() *RankedNode {
+	option := iter.source.Next()
+	if option == nil || iter.weight == 0 || iter.zone == "" {
+		return option
+	}
+
+	val, ok := resolveNodeTarget(iter.ctx, iter.target, option.Node)
+	if !ok {
+		return option
+	}
+	zone, ok := val.(string)
+	if !ok {
+		return option
+	}
+	distance, ok := iter.distance(zone)
+	if !ok || distance < 0 {
+		return option
+	}
+
+	bonus := iter.weight / (1 + distance)
+	option.Score += bonus
+	iter.ctx.Metrics().ScoreNode(option.Node, "zone-distance", bonus)
+	return option
+}
+
+func (iter *ZoneDistanceIterator) Reset() {
+	iter.source.Reset()
+}
+
+// SoftConstraint is a constraint that nodes are preferred to meet rather than
+// required to. The weight is the credit given to a node meeting it relative to
+// the other soft constraints.
+type SoftConstraint struct {
+	Constraint *structs.Constraint
+	Weight     float64
+}
+
+// SoftConstraintIterator is used to give partial credit to nodes for the soft
+// constraints they meet. The bonus applied is the fraction of the total weight
+// of the soft constraints met by the node multiplied by the bonus, so a node
+// meeting all soft constraints receives the full bonus. Hard constraints are
+// still applied by the feasibility checks.
+type SoftConstraintIterator struct {
+	ctx         Context
+	source      RankIterator
+	bonus       float64
+	checker     *ConstraintChecker
+	constraints []*SoftConstraint
+	total       float64
+}
+
+// NewSoftConstraintIterator is used to create a SoftConstraintIterator that
+// applies up to the given bonus. A zero bonus or no soft constraints disables
+// the iterator.
+func NewSoftConstraintIterator(ctx Context, source RankIterator, bonus float64, constraints []*SoftConstraint) *SoftConstraintIterator {
+	iter := &SoftConstraintIterator{
+		ctx:     ctx,
+		source:  source,
+		bonus:   bonus,
+		checker: NewConstraintChecker(ctx, nil),
+	}
+	iter.SetConstraints(constraints)
+	return iter
+}
+
+func (iter *SoftConstraintIterator) SetBonus(bonus float64) {
+	iter.bonus = bonus
+}
+
+// SetConstraints sets the soft constraints. Constraints without a positive
+// weight are ignored.
+func (iter *SoftConstraintIterator) SetConstraints(constraints []*SoftConstraint) {
+	iter.constraints = nil
+	iter.total = 0
+	for _, c := range constraints {
+		if c.Weight <= 0 {
+			continue
+		}
+		iter.constraints = append(iter.constraints, c)
+		iter.total += c.Weight
+	}
+}
+
+// SetTaskGroup sets the task group being placed which task group aggregates,
+// such as "${group.cpu}", are resolved against.
+func (iter *SoftConstraintIterator) SetTaskGroup(tg *structs.TaskGroup) {
+	iter.checker.SetTaskGroup(tg)
+}
+
+func (iter *SoftConstraintIterator) Next() *RankedNode {
+	option := iter.source.Next()
+	if option == nil || iter.bonus == 0 || iter.total == 0 {
+		return option
+	}
+
+	satisfied := 0.0
+	for _, c := range iter.constraints {
+		if met, _ := iter.checker.meetsConstraint(c.Constraint, option.Node); met {
+			satisfied += c.Weight
+		}
+	}
+
+	// Normalize by the total weight so the bonus never exceeds the
+	// configured bonus however many soft constraints there are
+	bonus := iter.bonus * satisfied / iter.total
+	option.Score += bonus
+	iter.ctx.Metrics().ScoreNode(option.Node, "soft-constraint", bonus)
+	return option
+}
+
+func (iter *SoftConstraintIterator) Reset() {
+	iter.source.Reset()
+}
+
+// ResourceCliffIterator is used to penalize placements that would push the CPU
+// or memory utilization of a node past a threshold, such as 0.85, where
+// contention becomes likely. It is applied after bin-packing, using the
+// resources assigned to the placement, and only discourages such placements
+// rather than excluding the node. Only placements crossing the threshold are
+// penalized, nodes already past it are not penalized again. Utilization
+// includes the resources reserved on the node and dimensions the node has no
+// capacity for are ignored.
+type ResourceCliffIterator struct {
+	ctx       Context
+	source    RankIterator
+	threshold float64
+	penalty   float64
+}
+
+// NewResourceCliffIterator is used to create a ResourceCliffIterator that
+// applies the penalty to placements pushing a node above the utilization
+// threshold. A zero penalty disables the iterator.
+func NewResourceCliffIterator(ctx Context, source RankIterator, threshold, penalty float64) *ResourceCliffIterator {
+	iter := &ResourceCliffIterator{
+		ctx:       ctx,
+		source:    source,
+		threshold: threshold,
+		penalty:   penalty,
+	}
+	return iter
+}
+
+func (iter *ResourceCliffIterator) SetThreshold(threshold float64) {
+	iter.threshold = threshold
+}
+
+func (iter *ResourceCliffIterator) SetPenalty(penalty float64) {
+	iter.penalty = penalty
+}
+
+func (iter *ResourceCliffIterator) Next() *RankedNode {
+	for {
+		option := iter.source.Next()
+		if option == nil || iter.penalty == 0 {
+			return option
+		}
+
+		// Get the proposed allocations
+		proposed, err := option.ProposedAllocs(iter.ctx)
+		if err != nil {
+			iter.ctx.StateError(option.Node, "resource-cliff", err)
+			continue
+		}
+
+		// Compute the utilization before and after adding the resources of
+		// the placement
+		_, _, before, err := structs.AllocsFit(option.Node, proposed, nil)
+		if err != nil || before == nil {
+			iter.ctx.Logger().Printf(
+				"[ERR] sched.resource-cliff: failed to compute utilization: %v", err)
+			return option
+		}
+		total := new(structs.Resources)
+		for _, resources := range option.TaskResources {
+			total.Add(resources)
+		}
+		proposed = append(proposed, &structs.Allocation{Resources: total})
+		_, _, after, err := structs.AllocsFit(option.Node, proposed, nil)
+		if err != nil || after == nil {
+			iter.ctx.Logger().Printf(
+				"[ERR] sched.resource-cliff: failed to compute utilization: %v", err)
+			return option
+		}
+
+		node := option.Node.Resources
+		if iter.crosses(before.CPU, after.CPU, node.CPU) ||
+			iter.crosses(before.MemoryMB, after.MemoryMB, node.MemoryMB) {
+			option.Score -= iter.penalty
+			iter.ctx.Metrics().ScoreNode(option.Node, "resource-cliff", -iter.penalty)
+		}
+		return option
+	}
+}
+
+// crosses returns whether the utilization of a dimension with the given
+// capacity crosses the threshold from before to after the placement.
+func (iter *ResourceCliffIterator) crosses(before, after, capacity int) bool {
+	if capacity <= 0 {
+		return false
+	}
+	return float64(before)/float64(capacity) <= iter.threshold &&
+		float64(after)/float64(capacity) > iter.threshold
+}
+
+func (iter *ResourceCliffIterator) Reset() {
+	iter.source.Reset()
+}
+
+// AllocCountBalanceIterator is used to apply a bonus to nodes running fewer
+// allocations, independent of their resource fit, so that allocation counts
+// stay roughly equal across nodes. The bonus is bounded by the weight and
+// shrinks as the number of proposed allocations on the node grows.
+type AllocCountBalanceIterator struct {
+	ctx    Context
+	source RankIterator
+	weight float64
+}
+
+// NewAllocCountBalanceIterator is used to create an AllocCountBalanceIterator
+// that applies a bonus of up to the weight. A zero weight disables the
+// iterator.
+func NewAllocCountBalanceIterator(ctx Context, source RankIterator, weight float64) *AllocCountBalanceIterator {
+	iter := &AllocCountBalanceIterator{
+		ctx:    ctx,
+		source: source,
+		weight: weight,
+	}
+	return iter
+}
+
+func (iter *AllocCountBalanceIterator) SetWeight(weight float64) {
+	iter.weight = weight
+}
+
+func (iter *AllocCountBalanceIterator) Next() *RankedNode {
+	for {
+		option := iter.source.Next()
+		if option == nil || iter.weight == 0 {
+			return option
+		}
+
+		// Get the proposed allocations
+		proposed, err := option.ProposedAllocs(iter.ctx)
+		if err != nil {
+			iter.ctx.StateError(option.Node, "alloc-count-balance", err)
+			continue
+		}
+
+		bonus := iter.weight / float64(1+len(proposed))
+		option.Score += bonus
+		iter.ctx.Metrics().ScoreNode(option.Node, "alloc-count-balance", bonus)
+		return option
+	}
+}
+
+func (iter *AllocCountBalanceIterator) Reset() {
+	iter.source.Reset()
+}
+
+// StickyVolumeIterator is used to keep the allocations of task groups with
+// sticky volumes on the node holding their data when they are replaced. The
+// node of the allocation being replaced either receives a bonus or, if
+// required, is the only node that may be placed on.
+type StickyVolumeIterator struct {
+	ctx      Context
+	source   RankIterator
+	bonus    float64
+	required bool
+	node     *structs.Node
+}
+
+// NewStickyVolumeIterator is used to create a StickyVolumeIterator that
+// applies the bonus to the sticky node. The sticky node is set per placement.
+func NewStickyVolumeIterator(ctx Context, source RankIterator, bonus float64) *StickyVolumeIterator {
+	iter := &StickyVolumeIterator{
+		ctx:    ctx,
+		source: source,
+		bonus:  bonus,
+	}
+	return iter
+}
+
+func (iter *StickyVolumeIterator) SetBonus(bonus float64) {
+	iter.bonus = bonus
+}
+
+// SetRequired sets whether placements must be made on the sticky node rather
+// than only preferring it.
+func (iter *StickyVolumeIterator) SetRequired(required bool) {
+	iter.required = required
+}
+
+// SetNode sets the node holding the sticky data. A nil node means the
+// placement has no sticky node.
+func (iter *StickyVolumeIterator) SetNode(node *structs.Node) {
+	iter.node = node
+}
+
+func (iter *StickyVolumeIterator) Next() *RankedNode {
+	for {
+		option := iter.source.Next()
+		if option == nil || iter.node == nil {
+			return option
+		}
+
+		if option.Node.ID == iter.node.ID {
+			if iter.bonus != 0 {
+				option.Score += iter.bonus
+				iter.ctx.Metrics().ScoreNode(option.Node, "sticky-volume", iter.bonus)
+			}
+			return option
+		}
+
+		if iter.required {
+			// The sticky node is never ranked while it is down or draining,
+			// so say why placing on it isn't possible
+			reason := "sticky volume on another node"
+			if !iter.node.Ready() {
+				reason = "sticky volume on unavailable node"
+			}
+			iter.ctx.Metrics().FilterNode(option.Node, reason)
+			iter.ctx.RejectNode(option.Node, "sticky-volume", reason)
+			continue
+		}
+		return option
+	}
+}
+
+func (iter *StickyVolumeIterator) Reset() {
+	iter.source.Reset()
+}
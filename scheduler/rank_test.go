@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/hashicorp/nomad/nomad/mock"
@@ -259,6 +260,164 @@ func TestBinPackIterator_ExistingAlloc(t *testing.T) {
 	}
 }
 
+func TestBinPackIterator_Reclaim(t *testing.T) {
+	state, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				// Full with a low priority alloc
+				ID: structs.GenerateUUID(),
+				Resources: &structs.Resources{
+					CPU:      2048,
+					MemoryMB: 2048,
+				},
+			},
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				// Full with a high priority alloc
+				ID: structs.GenerateUUID(),
+				Resources: &structs.Resources{
+					CPU:      2048,
+					MemoryMB: 2048,
+				},
+			},
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	low := mock.Alloc()
+	low.NodeID = nodes[0].Node.ID
+	low.Job.Priority = 20
+	low.Resources = &structs.Resources{
+		CPU:      2048,
+		MemoryMB: 2048,
+	}
+	low.TaskResources = nil
+	high := mock.Alloc()
+	high.NodeID = nodes[1].Node.ID
+	high.Job.Priority = 80
+	high.Resources = &structs.Resources{
+		CPU:      2048,
+		MemoryMB: 2048,
+	}
+	high.TaskResources = nil
+	noErr(t, state.UpsertJobSummary(998, mock.JobSummary(low.JobID)))
+	noErr(t, state.UpsertJobSummary(999, mock.JobSummary(high.JobID)))
+	noErr(t, state.UpsertAllocs(1000, []*structs.Allocation{low, high}))
+
+	taskGroup := &structs.TaskGroup{
+		EphemeralDisk: &structs.EphemeralDisk{},
+		Tasks: []*structs.Task{
+			{
+				Name: "web",
+				Resources: &structs.Resources{
+					CPU:      1024,
+					MemoryMB: 1024,
+				},
+			},
+		},
+	}
+	binp := NewBinPackIterator(ctx, static, true, 50)
+	binp.SetTaskGroup(taskGroup)
+
+	// Both nodes are full without reclaiming
+	out := collectRanked(binp)
+	if len(out) != 0 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	// The node with the low priority alloc fits by reclaiming it
+	ctx.Reset()
+	binp.SetReclaim(true)
+	binp.Reset()
+	out = collectRanked(binp)
+	if len(out) != 1 || out[0] != nodes[0] {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if len(out[0].Reclaim) != 1 || out[0].Reclaim[0].ID != low.ID {
+		t.Fatalf("Bad: %#v", out[0].Reclaim)
+	}
+
+	reclaimed := ctx.Metrics().Reclaimable[nodes[0].Node.ID]
+	if reclaimed == nil || reclaimed.CPU != 2048 || reclaimed.MemoryMB != 2048 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Reclaimable)
+	}
+	if _, ok := ctx.Metrics().Reclaimable[nodes[1].Node.ID]; ok {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Reclaimable)
+	}
+	if ctx.Metrics().NodesExhausted != 1 {
+		t.Fatalf("Bad: %#v", ctx.Metrics())
+	}
+
+	// The cached proposed allocations are left intact
+	if len(nodes[0].Proposed) != 1 || nodes[0].Proposed[0].ID != low.ID {
+		t.Fatalf("Bad: %#v", nodes[0].Proposed)
+	}
+}
+
+func TestBinPackIterator_Reclaim_MinimalSet(t *testing.T) {
+	state, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				// Full with low priority allocs
+				ID: structs.GenerateUUID(),
+				Resources: &structs.Resources{
+					CPU:      4096,
+					MemoryMB: 4096,
+				},
+			},
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	var allocs []*structs.Allocation
+	for i, size := range []int{1024, 2048, 1024} {
+		alloc := mock.Alloc()
+		alloc.NodeID = nodes[0].Node.ID
+		alloc.Job.Priority = 10 * (i + 1)
+		alloc.Resources = &structs.Resources{
+			CPU:      size,
+			MemoryMB: size,
+		}
+		alloc.TaskResources = nil
+		noErr(t, state.UpsertJobSummary(uint64(990+i), mock.JobSummary(alloc.JobID)))
+		allocs = append(allocs, alloc)
+	}
+	noErr(t, state.UpsertAllocs(1000, allocs))
+
+	taskGroup := &structs.TaskGroup{
+		EphemeralDisk: &structs.EphemeralDisk{},
+		Tasks: []*structs.Task{
+			{
+				Name: "web",
+				Resources: &structs.Resources{
+					CPU:      2048,
+					MemoryMB: 2048,
+				},
+			},
+		},
+	}
+	binp := NewBinPackIterator(ctx, static, false, 50)
+	binp.SetTaskGroup(taskGroup)
+	binp.SetReclaim(true)
+
+	// Evicting the two lowest priority allocs fits, but the second alloc
+	// alone is enough so the lowest priority alloc is kept
+	out := collectRanked(binp)
+	if len(out) != 1 {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if len(out[0].Reclaim) != 1 || out[0].Reclaim[0].ID != allocs[1].ID {
+		t.Fatalf("Bad: %#v", out[0].Reclaim)
+	}
+	reclaimed := ctx.Metrics().Reclaimable[nodes[0].Node.ID]
+	if reclaimed == nil || reclaimed.CPU != 2048 || reclaimed.MemoryMB != 2048 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Reclaimable)
+	}
+}
+
 func TestBinPackIterator_ExistingAlloc_PlannedEvict(t *testing.T) {
 	state, ctx := testContext(t)
 	nodes := []*RankedNode{
@@ -408,6 +567,107 @@ func TestJobAntiAffinity_PlannedAlloc(t *testing.T) {
 	}
 }
 
+func TestJobConsolidation_PlannedAlloc(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+			},
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+			},
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	// Add two planned allocs of the job to node1
+	plan := ctx.Plan()
+	plan.NodeAllocation[nodes[0].Node.ID] = []*structs.Allocation{
+		&structs.Allocation{
+			ID:    structs.GenerateUUID(),
+			JobID: "foo",
+		},
+		&structs.Allocation{
+			ID:    structs.GenerateUUID(),
+			JobID: "foo",
+		},
+	}
+
+	// Add a planned alloc of another job to node2
+	plan.NodeAllocation[nodes[1].Node.ID] = []*structs.Allocation{
+		&structs.Allocation{
+			JobID: "bar",
+		},
+	}
+
+	consolidate := NewJobConsolidationIterator(ctx, static, 20.0, "foo")
+
+	out := collectRanked(consolidate)
+	if len(out) != 2 {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if out[0] != nodes[0] {
+		t.Fatalf("Bad: %v", out)
+	}
+	if out[0].Score != 20.0 {
+		t.Fatalf("Bad: %#v", out[0])
+	}
+
+	if out[1] != nodes[1] {
+		t.Fatalf("Bad: %v", out)
+	}
+	if out[1].Score != 0.0 {
+		t.Fatalf("Bad: %v", out[1])
+	}
+}
+
+func TestDatacenterLocality(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				ID:         structs.GenerateUUID(),
+				Datacenter: "dc1",
+			},
+			Score: 10,
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID:         structs.GenerateUUID(),
+				Datacenter: "dc2",
+			},
+			Score: 10,
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+	dc := NewDatacenterLocalityIterator(ctx, static, 5.0)
+
+	// No bonus without a preferred datacenter
+	out := collectRanked(dc)
+	if len(out) != 2 || out[0].Score != 10 || out[1].Score != 10 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	dc.SetDatacenter("dc2")
+	dc.Reset()
+	out = collectRanked(dc)
+	if len(out) != 2 {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if out[0].Score != 10 {
+		t.Fatalf("Bad: %#v", out[0])
+	}
+	if out[1].Score != 15 {
+		t.Fatalf("Bad: %#v", out[1])
+	}
+	if score := ctx.Metrics().Scores[nodes[1].Node.ID+".datacenter-locality"]; score != 5 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+}
+
 func collectRanked(iter RankIterator) (out []*RankedNode) {
 	for {
 		next := iter.Next()
@@ -418,3 +678,493 @@ func collectRanked(iter RankIterator) (out []*RankedNode) {
 	}
 	return
 }
+
+func TestDecayingAffinity(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+			},
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+			},
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+			},
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	// Add one planned alloc of the group to node2 and two to node3. An alloc
+	// of another group doesn't count.
+	plan := ctx.Plan()
+	plan.NodeAllocation[nodes[0].Node.ID] = []*structs.Allocation{
+		&structs.Allocation{
+			ID:        structs.GenerateUUID(),
+			JobID:     "foo",
+			TaskGroup: "other",
+		},
+	}
+	plan.NodeAllocation[nodes[1].Node.ID] = []*structs.Allocation{
+		&structs.Allocation{
+			ID:        structs.GenerateUUID(),
+			JobID:     "foo",
+			TaskGroup: "web",
+		},
+	}
+	plan.NodeAllocation[nodes[2].Node.ID] = []*structs.Allocation{
+		&structs.Allocation{
+			ID:        structs.GenerateUUID(),
+			JobID:     "foo",
+			TaskGroup: "web",
+		},
+		&structs.Allocation{
+			ID:        structs.GenerateUUID(),
+			JobID:     "foo",
+			TaskGroup: "web",
+		},
+	}
+
+	affinity := NewDecayingAffinityIterator(ctx, static, 8.0, 0.5)
+	affinity.SetJob("foo")
+	affinity.SetTaskGroup("web")
+
+	out := collectRanked(affinity)
+	if len(out) != 3 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	// The bonus shrinks with each alloc of the group on the node
+	for i, exp := range []float64{8.0, 4.0, 2.0} {
+		if out[i] != nodes[i] {
+			t.Fatalf("Bad: %v", out)
+		}
+		if out[i].Score != exp {
+			t.Fatalf("case(%d) bad score: got %v; want %v", i, out[i].Score, exp)
+		}
+		key := fmt.Sprintf("%s.decaying-affinity", nodes[i].Node.ID)
+		if score := ctx.Metrics().Scores[key]; score != exp {
+			t.Fatalf("case(%d) bad metadata: %#v", i, ctx.Metrics().Scores)
+		}
+	}
+}
+
+func TestDecayingAffinity_Disabled(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+			},
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	affinity := NewDecayingAffinityIterator(ctx, static, 0, 0.5)
+	out := collectRanked(affinity)
+	if len(out) != 1 || out[0].Score != 0 {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if len(ctx.Metrics().Scores) != 0 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+}
+
+func TestPowerEfficiency(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				ID:   structs.GenerateUUID(),
+				Meta: map[string]string{"power_per_core": "9"},
+			},
+			Score: 10,
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID:   structs.GenerateUUID(),
+				Meta: map[string]string{"power_per_core": "4"},
+			},
+			Score: 10,
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID:   structs.GenerateUUID(),
+				Meta: map[string]string{"power_per_core": "idle"},
+			},
+			Score: 10,
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+			},
+			Score: 10,
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	power := NewPowerEfficiencyIterator(ctx, static, 10.0, "${meta.power_per_core}")
+	out := collectRanked(power)
+	if len(out) != 4 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	// The more efficient node outranks the less efficient one at equal fit
+	if out[0].Score != 11.0 || out[1].Score != 12.0 {
+		t.Fatalf("Bad: %v %v", out[0].Score, out[1].Score)
+	}
+	key := fmt.Sprintf("%s.power-efficiency", nodes[1].Node.ID)
+	if score := ctx.Metrics().Scores[key]; score != 2.0 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+
+	// Unparseable and missing values get no bonus
+	if out[2].Score != 10.0 || out[3].Score != 10.0 {
+		t.Fatalf("Bad: %v %v", out[2].Score, out[3].Score)
+	}
+}
+
+func TestZoneDistance(t *testing.T) {
+	_, ctx := testContext(t)
+	zones := []string{"us-east-1a", "us-east-1b", "us-west-2a", "eu-west-1a", ""}
+	var nodes []*RankedNode
+	for _, zone := range zones {
+		node := &RankedNode{
+			Node: &structs.Node{
+				ID:   structs.GenerateUUID(),
+				Meta: map[string]string{},
+			},
+			Score: 10,
+		}
+		if zone != "" {
+			node.Node.Meta["zone"] = zone
+		}
+		nodes = append(nodes, node)
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	// Distances are only set in one direction
+	distances := map[string]map[string]float64{
+		"us-east-1a": {
+			"us-east-1b": 1,
+		},
+		"us-west-2a": {
+			"us-east-1a": 4,
+		},
+	}
+
+	zone := NewZoneDistanceIterator(ctx, static, 10.0, "${meta.zone}")
+	zone.SetZone("us-east-1a")
+	zone.SetDistances(distances)
+
+	out := collectRanked(zone)
+	if len(out) != 5 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	// The nearest zone wins and unknown distances get no bonus
+	for i, exp := range []float64{20.0, 15.0, 12.0, 10.0, 10.0} {
+		if out[i].Score != exp {
+			t.Fatalf("case(%d) bad score: got %v; want %v", i, out[i].Score, exp)
+		}
+	}
+	key := fmt.Sprintf("%s.zone-distance", nodes[1].Node.ID)
+	if score := ctx.Metrics().Scores[key]; score != 5.0 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+}
+
+func TestSoftConstraint(t *testing.T) {
+	_, ctx := testContext(t)
+	var nodes []*RankedNode
+	for i := 0; i < 4; i++ {
+		node := mock.Node()
+		nodes = append(nodes, &RankedNode{Node: node, Score: 10})
+	}
+	nodes[0].Node.Meta["ssd"] = "true"
+	nodes[0].Node.Meta["rack"] = "r1"
+	nodes[1].Node.Meta["ssd"] = "true"
+	nodes[2].Node.Meta["rack"] = "r1"
+	static := NewStaticRankIterator(ctx, nodes)
+
+	constraints := []*SoftConstraint{
+		&SoftConstraint{
+			Constraint: &structs.Constraint{
+				LTarget: "${meta.ssd}",
+				RTarget: "true",
+				Operand: "=",
+			},
+			Weight: 3,
+		},
+		&SoftConstraint{
+			Constraint: &structs.Constraint{
+				LTarget: "${meta.rack}",
+				RTarget: "r1",
+				Operand: "=",
+			},
+			Weight: 1,
+		},
+		&SoftConstraint{
+			// Ignored without a weight
+			Constraint: &structs.Constraint{
+				LTarget: "${meta.missing}",
+				RTarget: "foo",
+				Operand: "=",
+			},
+		},
+	}
+	soft := NewSoftConstraintIterator(ctx, static, 8.0, constraints)
+
+	out := collectRanked(soft)
+	if len(out) != 4 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	// Nodes meeting more of the weighted soft constraints rank higher
+	for i, exp := range []float64{18.0, 16.0, 12.0, 10.0} {
+		if out[i].Score != exp {
+			t.Fatalf("case(%d) bad score: got %v; want %v", i, out[i].Score, exp)
+		}
+	}
+	key := fmt.Sprintf("%s.soft-constraint", nodes[1].Node.ID)
+	if score := ctx.Metrics().Scores[key]; score != 6.0 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+
+	// Soft constraints don't filter
+	if ctx.Metrics().NodesFiltered != 0 {
+		t.Fatalf("Bad: %#v", ctx.Metrics())
+	}
+}
+
+func TestResourceCliff(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+				Resources: &structs.Resources{
+					CPU:      2048,
+					MemoryMB: 2048,
+				},
+			},
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+				Resources: &structs.Resources{
+					CPU:      2048,
+					MemoryMB: 2048,
+				},
+			},
+		},
+		&RankedNode{
+			Node: &structs.Node{
+				ID: structs.GenerateUUID(),
+				Resources: &structs.Resources{
+					CPU:      8192,
+					MemoryMB: 8192,
+				},
+			},
+		},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	// After the placement node1 is 75% utilized and node2 87.5%. Node3 is
+	// already 87.5% utilized before the placement.
+	plan := ctx.Plan()
+	plan.NodeAllocation[nodes[0].Node.ID] = []*structs.Allocation{
+		&structs.Allocation{
+			Resources: &structs.Resources{
+				CPU:      512,
+				MemoryMB: 512,
+			},
+		},
+	}
+	plan.NodeAllocation[nodes[1].Node.ID] = []*structs.Allocation{
+		&structs.Allocation{
+			Resources: &structs.Resources{
+				CPU:      768,
+				MemoryMB: 768,
+			},
+		},
+	}
+	plan.NodeAllocation[nodes[2].Node.ID] = []*structs.Allocation{
+		&structs.Allocation{
+			Resources: &structs.Resources{
+				CPU:      7168,
+				MemoryMB: 7168,
+			},
+		},
+	}
+
+	taskGroup := &structs.TaskGroup{
+		EphemeralDisk: &structs.EphemeralDisk{},
+		Tasks: []*structs.Task{
+			{
+				Name: "web",
+				Resources: &structs.Resources{
+					CPU:      1024,
+					MemoryMB: 1024,
+				},
+			},
+		},
+	}
+	binp := NewBinPackIterator(ctx, static, false, 0)
+	binp.SetTaskGroup(taskGroup)
+	cliff := NewResourceCliffIterator(ctx, binp, 0.85, 10.0)
+
+	out := collectRanked(cliff)
+	if len(out) != 3 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	// Bin-packing alone prefers the fuller node but the node pushed past the
+	// threshold is penalized
+	binpack := ctx.Metrics().Scores[fmt.Sprintf("%s.binpack", nodes[1].Node.ID)]
+	if binpack <= ctx.Metrics().Scores[fmt.Sprintf("%s.binpack", nodes[0].Node.ID)] {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+	if out[0].Score <= out[1].Score {
+		t.Fatalf("Bad: %v %v", out[0].Score, out[1].Score)
+	}
+	if _, ok := ctx.Metrics().Scores[fmt.Sprintf("%s.resource-cliff", nodes[0].Node.ID)]; ok {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+	if score := ctx.Metrics().Scores[fmt.Sprintf("%s.resource-cliff", nodes[1].Node.ID)]; score != -10.0 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+
+	// The node already past the threshold isn't penalized again
+	if _, ok := ctx.Metrics().Scores[fmt.Sprintf("%s.resource-cliff", nodes[2].Node.ID)]; ok {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+
+	// Dimensions without capacity never cross the threshold
+	if cliff.crosses(0, 1024, 0) || cliff.crosses(0, 0, 0) {
+		t.Fatalf("zero capacity crossed the threshold")
+	}
+}
+
+func TestAllocCountBalance(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{Node: mock.Node()},
+		&RankedNode{Node: mock.Node()},
+		&RankedNode{Node: mock.Node()},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	// Propose three allocations on the first node and one on the second
+	plan := ctx.Plan()
+	for i := 0; i < 3; i++ {
+		plan.NodeAllocation[nodes[0].Node.ID] = append(plan.NodeAllocation[nodes[0].Node.ID], mock.Alloc())
+	}
+	plan.NodeAllocation[nodes[1].Node.ID] = []*structs.Allocation{mock.Alloc()}
+
+	balance := NewAllocCountBalanceIterator(ctx, static, 10.0)
+	out := collectRanked(balance)
+	if len(out) != 3 {
+		t.Fatalf("Bad: %#v", out)
+	}
+
+	// The bonus shrinks with the number of allocations
+	for i, exp := range []float64{2.5, 5.0, 10.0} {
+		if out[i].Score != exp {
+			t.Fatalf("case(%d) Bad: %v", i, out[i].Score)
+		}
+		if score := ctx.Metrics().Scores[fmt.Sprintf("%s.alloc-count-balance", nodes[i].Node.ID)]; score != exp {
+			t.Fatalf("case(%d) Bad: %#v", i, ctx.Metrics().Scores)
+		}
+	}
+}
+
+func TestAllocCountBalance_Disabled(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{Node: mock.Node()},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+	ctx.Plan().NodeAllocation[nodes[0].Node.ID] = []*structs.Allocation{mock.Alloc()}
+
+	balance := NewAllocCountBalanceIterator(ctx, static, 0)
+	out := collectRanked(balance)
+	if len(out) != 1 || out[0].Score != 0 {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if len(ctx.Metrics().Scores) != 0 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+}
+
+func TestStickyVolume(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{Node: mock.Node()},
+		&RankedNode{Node: mock.Node()},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	sticky := NewStickyVolumeIterator(ctx, static, 20.0)
+	sticky.SetNode(nodes[1].Node)
+
+	out := collectRanked(sticky)
+	if len(out) != 2 {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if out[0].Score != 0 || out[1].Score != 20.0 {
+		t.Fatalf("Bad: %v %v", out[0].Score, out[1].Score)
+	}
+	if score := ctx.Metrics().Scores[fmt.Sprintf("%s.sticky-volume", nodes[1].Node.ID)]; score != 20.0 {
+		t.Fatalf("Bad: %#v", ctx.Metrics().Scores)
+	}
+}
+
+func TestStickyVolume_Required(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*RankedNode{
+		&RankedNode{Node: mock.Node()},
+		&RankedNode{Node: mock.Node()},
+		&RankedNode{Node: mock.Node()},
+	}
+	static := NewStaticRankIterator(ctx, nodes)
+
+	sticky := NewStickyVolumeIterator(ctx, static, 20.0)
+	sticky.SetRequired(true)
+	sticky.SetNode(nodes[1].Node)
+
+	// Only the sticky node remains
+	out := collectRanked(sticky)
+	if len(out) != 1 || out[0] != nodes[1] {
+		t.Fatalf("Bad: %#v", out)
+	}
+	if ctx.Metrics().NodesFiltered != 2 || ctx.Metrics().ConstraintFiltered["sticky volume on another node"] != 2 {
+		t.Fatalf("Bad: %#v", ctx.Metrics())
+	}
+
+	// Nodes are filtered because the sticky node is unavailable if it's down
+	// or draining
+	ctx.Reset()
+	down := mock.Node()
+	down.Status = structs.NodeStatusDown
+	sticky.SetNode(down)
+	sticky.Reset()
+	out = collectRanked(sticky)
+	if len(out) != 0 || ctx.Metrics().ConstraintFiltered["sticky volume on unavailable node"] != 3 {
+		t.Fatalf("Bad: %#v", ctx.Metrics())
+	}
+
+	// Without a sticky node nothing is filtered
+	ctx.Reset()
+	sticky.SetNode(nil)
+	sticky.Reset()
+	out = collectRanked(sticky)
+	if len(out) != 3 || ctx.Metrics().NodesFiltered != 0 {
+		t.Fatalf("Bad: %#v", out)
+	}
+}
@@ -16,6 +16,40 @@ const (
 	// batchJobAntiAffinityPenalty is the same as the
 	// serviceJobAntiAffinityPenalty but for batch type jobs.
 	batchJobAntiAffinityPenalty = 5.0
+
+	// jobConsolidationBonus is the bonus applied to the score for placing an
+	// alloc on a node that already has an alloc for this job when
+	// consolidating. It exceeds the maximum bin-packing score so that a new
+	// node is only used when no node running the job can fit the alloc.
+	jobConsolidationBonus = 20.0
+
+	// resourceCliffThreshold is the default utilization past which placements
+	// are penalized when resource cliff avoidance is enabled.
+	resourceCliffThreshold = 0.85
+
+	// datacenterLocalityBonus is the default bonus applied to the score of
+	// nodes in the datacenter of the allocation being replaced.
+	datacenterLocalityBonus = 5.0
+
+	// powerEfficiencyTarget is the default node attribute holding the power
+	// consumed per core by a node.
+	powerEfficiencyTarget = "${meta.power_per_core}"
+
+	// zoneTarget is the default node attribute holding the zone of a node.
+	zoneTarget = "${meta.zone}"
+)
+
+// RankingMode controls how the GenericStack ranks feasible nodes.
+type RankingMode int
+
+const (
+	// RankingModeDefault bin-packs allocations while spreading the
+	// allocations of a job using an anti-affinity.
+	RankingModeDefault RankingMode = iota
+
+	// RankingModeConsolidate concentrates the allocations of a job on as few
+	// nodes as possible, only spilling to new nodes when necessary.
+	RankingModeConsolidate
 )
 
 // Stack is a chained collection of iterators. The stack is used to
@@ -36,17 +70,32 @@ type Stack interface {
 // designed to make better placement decisions at the cost of performance.
 type GenericStack struct {
 	batch  bool
+	mode   RankingMode
 	ctx    Context
 	source *StaticIterator
 
+	nodeList            *NodeListIterator
+	cordon              *CordonIterator
 	wrappedChecks       *FeasibilityWrapper
 	jobConstraint       *ConstraintChecker
 	taskGroupDrivers    *DriverChecker
 	taskGroupConstraint *ConstraintChecker
+	checkerTimeouts     []*TimeoutChecker
+	nodeHealth          *NodeHealthIterator
+	fallback            *FallbackConstraintIterator
 
 	proposedAllocConstraint *ProposedAllocConstraintIterator
+	stickyVolume            *StickyVolumeIterator
 	binPack                 *BinPackIterator
+	resourceCliff           *ResourceCliffIterator
 	jobAntiAff              *JobAntiAffinityIterator
+	jobConsolidate          *JobConsolidationIterator
+	dcLocality              *DatacenterLocalityIterator
+	affinityDecay           *DecayingAffinityIterator
+	powerEfficiency         *PowerEfficiencyIterator
+	zoneDistance            *ZoneDistanceIterator
+	softConstraint          *SoftConstraintIterator
+	allocCountBalance       *AllocCountBalanceIterator
 	limit                   *LimitIterator
 	maxScore                *MaxScoreIterator
 }
@@ -64,25 +113,49 @@ func NewGenericStack(batch bool, ctx Context) *GenericStack {
 	// balancing across eligible nodes.
 	s.source = NewRandomIterator(ctx, nil)
 
-	// Attach the job constraints. The job is filled in later.
-	s.jobConstraint = NewConstraintChecker(ctx, nil)
+	// Filter out the nodes excluded by the node allow and deny lists and the
+	// nodes cordoned for the evaluation before anything else.
+	s.nodeList = NewNodeListIterator(ctx, s.source)
+	s.cordon = NewCordonIterator(ctx, s.nodeList)
+
+	// Attach the job constraints. The job is filled in later. Checkers that are
+	// bounded by a timeout use a checker context each, so a timed out check
+	// doesn't write to the evaluation.
+	jobCtx := newCheckerContext(ctx)
+	s.jobConstraint = NewConstraintChecker(jobCtx, nil)
 
 	// Filter on task group drivers first as they are faster
-	s.taskGroupDrivers = NewDriverChecker(ctx, nil)
+	driverCtx := newCheckerContext(ctx)
+	s.taskGroupDrivers = NewDriverChecker(driverCtx, nil)
 
 	// Filter on task group constraints second
-	s.taskGroupConstraint = NewConstraintChecker(ctx, nil)
+	tgCtx := newCheckerContext(ctx)
+	s.taskGroupConstraint = NewConstraintChecker(tgCtx, nil)
 
 	// Create the feasibility wrapper which wraps all feasibility checks in
 	// which feasibility checking can be skipped if the computed node class has
 	// previously been marked as eligible or ineligible. Generally this will be
 	// checks that only needs to examine the single node to determine feasibility.
-	jobs := []FeasibilityChecker{s.jobConstraint}
-	tgs := []FeasibilityChecker{s.taskGroupDrivers, s.taskGroupConstraint}
-	s.wrappedChecks = NewFeasibilityWrapper(ctx, s.source, jobs, tgs)
+	// Each check is bounded by a timeout, which is disabled unless set.
+	s.checkerTimeouts = []*TimeoutChecker{
+		NewTimeoutChecker(jobCtx, "job-constraint", s.jobConstraint, 0),
+		NewTimeoutChecker(driverCtx, "driver", s.taskGroupDrivers, 0),
+		NewTimeoutChecker(tgCtx, "constraint", s.taskGroupConstraint, 0),
+	}
+	jobs := []FeasibilityChecker{s.checkerTimeouts[0]}
+	tgs := []FeasibilityChecker{s.checkerTimeouts[1], s.checkerTimeouts[2]}
+	s.wrappedChecks = NewFeasibilityWrapper(ctx, s.cordon, jobs, tgs)
+
+	// Filter out nodes that have recently flapped. This is disabled unless a
+	// threshold is set.
+	s.nodeHealth = NewNodeHealthIterator(ctx, s.wrappedChecks, 0, 0)
+
+	// Filter on the first tier of fallback constraints met by any node. This
+	// is disabled unless tiers are set.
+	s.fallback = NewFallbackConstraintIterator(ctx, s.nodeHealth, nil)
 
 	// Filter on constraints that are affected by propsed allocations.
-	s.proposedAllocConstraint = NewProposedAllocConstraintIterator(ctx, s.wrappedChecks)
+	s.proposedAllocConstraint = NewProposedAllocConstraintIterator(ctx, s.fallback)
 
 	// Upgrade from feasible to rank iterator
 	rankSource := NewFeasibleRankIterator(ctx, s.proposedAllocConstraint)
@@ -93,6 +166,15 @@ func NewGenericStack(batch bool, ctx Context) *GenericStack {
 	evict := !batch
 	s.binPack = NewBinPackIterator(ctx, rankSource, evict, 0)
 
+	// Apply a bonus to, or require, the node holding the sticky data of the
+	// allocation being replaced. The node is set per placement and the bonus
+	// is disabled unless set.
+	s.stickyVolume = NewStickyVolumeIterator(ctx, s.binPack, 0)
+
+	// Penalize placements pushing a node past a comfortable utilization.
+	// This is disabled unless a penalty is set.
+	s.resourceCliff = NewResourceCliffIterator(ctx, s.stickyVolume, resourceCliffThreshold, 0)
+
 	// Apply the job anti-affinity iterator. This is to avoid placing
 	// multiple allocations on the same node for this job. The penalty
 	// is less for batch jobs as it matters less.
@@ -100,10 +182,38 @@ func NewGenericStack(batch bool, ctx Context) *GenericStack {
 	if batch {
 		penalty = batchJobAntiAffinityPenalty
 	}
-	s.jobAntiAff = NewJobAntiAffinityIterator(ctx, s.binPack, penalty, "")
+	s.jobAntiAff = NewJobAntiAffinityIterator(ctx, s.resourceCliff, penalty, "")
+
+	// Apply the job consolidation iterator. This is disabled unless the stack
+	// is consolidating placements.
+	s.jobConsolidate = NewJobConsolidationIterator(ctx, s.jobAntiAff, 0, "")
+
+	// Apply a bonus to nodes in the datacenter of the allocation being
+	// replaced. The datacenter is set per placement.
+	s.dcLocality = NewDatacenterLocalityIterator(ctx, s.jobConsolidate, datacenterLocalityBonus)
+
+	// Apply a decaying affinity to co-locating the allocations of a task
+	// group. This is disabled unless a bonus is set.
+	s.affinityDecay = NewDecayingAffinityIterator(ctx, s.dcLocality, 0, 0)
+
+	// Apply a bonus to nodes consuming less power per core. This is disabled
+	// unless a weight is set.
+	s.powerEfficiency = NewPowerEfficiencyIterator(ctx, s.affinityDecay, 0, powerEfficiencyTarget)
+
+	// Apply a bonus to nodes close to the preferred zone. This is disabled
+	// unless a weight and zone are set.
+	s.zoneDistance = NewZoneDistanceIterator(ctx, s.powerEfficiency, 0, zoneTarget)
+
+	// Give partial credit to nodes for the soft constraints they meet. This
+	// is disabled unless soft constraints are set.
+	s.softConstraint = NewSoftConstraintIterator(ctx, s.zoneDistance, 0, nil)
+
+	// Apply a bonus to nodes running fewer allocations. This is disabled
+	// unless a weight is set.
+	s.allocCountBalance = NewAllocCountBalanceIterator(ctx, s.softConstraint, 0)
 
 	// Apply a limit function. This is to avoid scanning *every* possible node.
-	s.limit = NewLimitIterator(ctx, s.jobAntiAff, 2)
+	s.limit = NewLimitIterator(ctx, s.allocCountBalance, 2)
 
 	// Select the node with the maximum score for placement
 	s.maxScore = NewMaxScoreIterator(ctx, s.limit)
@@ -112,10 +222,23 @@ func NewGenericStack(batch bool, ctx Context) *GenericStack {
 
 func (s *GenericStack) SetNodes(baseNodes []*structs.Node) {
 	// Shuffle base nodes
-	shuffleNodes(baseNodes)
+	s.ctx.ShuffleNodes(baseNodes)
 
 	// Update the set of base nodes
 	s.source.SetNodes(baseNodes)
+	s.setLimit()
+}
+
+// setLimit updates the scan limit based on the number of base nodes and the
+// ranking mode.
+func (s *GenericStack) setLimit() {
+	// Consolidation must find the nodes already running the job so every
+	// node has to be scanned.
+	n := len(s.source.nodes)
+	if s.mode == RankingModeConsolidate {
+		s.limit.SetLimit(n)
+		return
+	}
 
 	// Apply a limit function. This is to avoid scanning *every* possible node.
 	// For batch jobs we only need to evaluate 2 options and depend on the
@@ -123,7 +246,7 @@ func (s *GenericStack) SetNodes(baseNodes []*structs.Node) {
 	// Using a log of the total number of nodes is a good restriction, with
 	// at least 2 as the floor
 	limit := 2
-	if n := len(baseNodes); !s.batch && n > 0 {
+	if !s.batch && n > 0 {
 		logLimit := int(math.Ceil(math.Log2(float64(n))))
 		if logLimit > limit {
 			limit = logLimit
@@ -132,11 +255,149 @@ func (s *GenericStack) SetNodes(baseNodes []*structs.Node) {
 	s.limit.SetLimit(limit)
 }
 
+// SetRankingMode is used to change how feasible nodes are ranked.
+func (s *GenericStack) SetRankingMode(mode RankingMode) {
+	s.mode = mode
+	switch mode {
+	case RankingModeConsolidate:
+		s.jobAntiAff.SetPenalty(0)
+		s.jobConsolidate.SetBonus(jobConsolidationBonus)
+	default:
+		penalty := serviceJobAntiAffinityPenalty
+		if s.batch {
+			penalty = batchJobAntiAffinityPenalty
+		}
+		s.jobAntiAff.SetPenalty(penalty)
+		s.jobConsolidate.SetBonus(0)
+	}
+	s.setLimit()
+}
+
+// SetPreferredDatacenter sets the datacenter whose nodes receive a ranking
+// bonus for the following placements. An empty datacenter removes the
+// preference.
+func (s *GenericStack) SetPreferredDatacenter(dc string) {
+	s.dcLocality.SetDatacenter(dc)
+}
+
+// SetDatacenterLocalityBonus sets the ranking bonus applied to nodes in the
+// preferred datacenter. A zero bonus disables the preference.
+func (s *GenericStack) SetDatacenterLocalityBonus(bonus float64) {
+	s.dcLocality.SetBonus(bonus)
+}
+
+// SetNodeHealth filters out nodes with more than the threshold of failures
+// within the window. A zero threshold disables the filter.
+func (s *GenericStack) SetNodeHealth(window time.Duration, threshold int) {
+	s.nodeHealth.SetHealth(window, threshold)
+}
+
+// SetResourceCliff sets the penalty applied to placements that would push the
+// CPU or memory utilization of a node past the threshold. A zero threshold
+// uses the default threshold and a zero penalty disables the penalty.
+func (s *GenericStack) SetResourceCliff(threshold, penalty float64) {
+	if threshold == 0 {
+		threshold = resourceCliffThreshold
+	}
+	s.resourceCliff.SetThreshold(threshold)
+	s.resourceCliff.SetPenalty(penalty)
+}
+
+// SetAffinityDecay sets the bonus applied to co-locating the allocations of a
+// task group and the factor it decays by with each allocation of the group
+// already on a node. A decay of one packs the group while a decay of zero
+// spreads it. A zero bonus disables the affinity.
+func (s *GenericStack) SetAffinityDecay(bonus, decay float64) {
+	s.affinityDecay.SetBonus(bonus)
+	s.affinityDecay.SetDecay(decay)
+}
+
+// SetPowerEfficiency sets the weight of the bonus applied to nodes consuming
+// less power per core and the node attribute the power is read from. An empty
+// target uses the default attribute and a zero weight disables the bonus.
+func (s *GenericStack) SetPowerEfficiency(weight float64, target string) {
+	if target == "" {
+		target = powerEfficiencyTarget
+	}
+	s.powerEfficiency.SetWeight(weight)
+	s.powerEfficiency.SetTarget(target)
+}
+
+// SetZoneDistances sets the weight of the bonus applied to nodes close to the
+// preferred zone and the distance matrix between zones. A zero weight disables
+// the bonus.
+func (s *GenericStack) SetZoneDistances(weight float64, distances map[string]map[string]float64) {
+	s.zoneDistance.SetWeight(weight)
+	s.zoneDistance.SetDistances(distances)
+}
+
+// SetPreferredZone sets the zone whose nearby nodes receive a ranking bonus.
+// An empty zone removes the preference.
+func (s *GenericStack) SetPreferredZone(zone string) {
+	s.zoneDistance.SetZone(zone)
+}
+
+// SetSoftConstraints sets the soft constraints nodes are preferred to meet and
+// the bonus applied to a node meeting all of them. A zero bonus disables the
+// preference.
+func (s *GenericStack) SetSoftConstraints(bonus float64, constraints []*SoftConstraint) {
+	s.softConstraint.SetBonus(bonus)
+	s.softConstraint.SetConstraints(constraints)
+}
+
+// SetStickyVolume sets the node holding the sticky data of the allocation being
+// replaced. A nil node removes the preference.
+func (s *GenericStack) SetStickyVolume(node *structs.Node) {
+	s.stickyVolume.SetNode(node)
+}
+
+// SetStickyVolumeBonus sets the ranking bonus applied to the node holding the
+// sticky data of the allocation being replaced. A zero bonus disables it.
+func (s *GenericStack) SetStickyVolumeBonus(bonus float64) {
+	s.stickyVolume.SetBonus(bonus)
+}
+
+// SetStickyVolumeRequired sets whether allocations with a sticky node must be
+// placed on it rather than only preferring it.
+func (s *GenericStack) SetStickyVolumeRequired(required bool) {
+	s.stickyVolume.SetRequired(required)
+}
+
+// SetReclaim sets whether nodes that only fit a task group by preempting lower
+// priority allocations are selected. The allocations to preempt are returned
+// in the Reclaim field of the selected node.
+func (s *GenericStack) SetReclaim(reclaim bool) {
+	s.binPack.SetReclaim(reclaim)
+}
+
+// SetFallbackConstraints sets ordered tiers of constraints. Nodes are
+// filtered by the first tier met by any node. Nil tiers remove the fallback.
+func (s *GenericStack) SetFallbackConstraints(tiers [][]*structs.Constraint) {
+	s.fallback.SetTiers(tiers)
+}
+
+// SetCheckerTimeout sets the time each feasibility checker may spend on a
+// node before the node is treated as infeasible. A zero timeout disables the
+// timeout.
+func (s *GenericStack) SetCheckerTimeout(timeout time.Duration) {
+	for _, checker := range s.checkerTimeouts {
+		checker.SetTimeout(timeout)
+	}
+}
+
+// SetAllocCountBalance sets the weight of the bonus applied to nodes running
+// fewer allocations. A zero weight disables the bonus.
+func (s *GenericStack) SetAllocCountBalance(weight float64) {
+	s.allocCountBalance.SetWeight(weight)
+}
+
 func (s *GenericStack) SetJob(job *structs.Job) {
 	s.jobConstraint.SetConstraints(job.Constraints)
 	s.proposedAllocConstraint.SetJob(job)
 	s.binPack.SetPriority(job.Priority)
 	s.jobAntiAff.SetJob(job.ID)
+	s.jobConsolidate.SetJob(job.ID)
+	s.affinityDecay.SetJob(job.ID)
 	s.ctx.Eligibility().SetJob(job)
 }
 
@@ -152,9 +413,14 @@ func (s *GenericStack) Select(tg *structs.TaskGroup) (*RankedNode, *structs.Reso
 	// Update the parameters of iterators
 	s.taskGroupDrivers.SetDrivers(tgConstr.drivers)
 	s.taskGroupConstraint.SetConstraints(tgConstr.constraints)
+	s.jobConstraint.SetTaskGroup(tg)
+	s.taskGroupConstraint.SetTaskGroup(tg)
+	s.fallback.SetTaskGroup(tg)
 	s.proposedAllocConstraint.SetTaskGroup(tg)
 	s.wrappedChecks.SetTaskGroup(tg.Name)
 	s.binPack.SetTaskGroup(tg)
+	s.softConstraint.SetTaskGroup(tg)
+	s.affinityDecay.SetTaskGroup(tg.Name)
 
 	// Find the node with the max score
 	option := s.maxScore.Next()
@@ -166,11 +432,45 @@ func (s *GenericStack) Select(tg *structs.TaskGroup) (*RankedNode, *structs.Reso
 		}
 	}
 
+	// Record how fragmented the job is across nodes
+	if option != nil && s.mode == RankingModeConsolidate {
+		s.ctx.Metrics().JobFragmentation = s.jobFragmentation(option.Node)
+	}
+
+	// Store the effectiveness of the computed class optimization
+	s.ctx.Metrics().EligibilityEffectiveness = s.ctx.Eligibility().Effectiveness()
+
 	// Store the compute time
 	s.ctx.Metrics().AllocationTime = time.Since(start)
 	return option, tgConstr.size
 }
 
+// jobFragmentation returns the number of distinct base nodes that would be
+// running allocations of the job once an allocation is placed on the selected
+// node.
+func (s *GenericStack) jobFragmentation(selected *structs.Node) int {
+	used := 1
+	for _, node := range s.source.nodes {
+		if node.ID == selected.ID {
+			continue
+		}
+
+		proposed, err := s.ctx.ProposedAllocs(node.ID)
+		if err != nil {
+			s.ctx.Logger().Printf(
+				"[ERR] sched: failed to get proposed allocations: %v", err)
+			continue
+		}
+		for _, alloc := range proposed {
+			if alloc.JobID == s.jobConsolidate.jobID {
+				used++
+				break
+			}
+		}
+	}
+	return used
+}
+
 // SelectPreferredNode returns a node where an allocation of the task group can
 // be placed, the node passed to it is preferred over the other available nodes
 func (s *GenericStack) SelectPreferringNodes(tg *structs.TaskGroup, nodes []*structs.Node) (*RankedNode, *structs.Resources) {
@@ -184,11 +484,38 @@ func (s *GenericStack) SelectPreferringNodes(tg *structs.TaskGroup, nodes []*str
 	return s.Select(tg)
 }
 
+// SelectRankingNodes is used to select a node for the task group, ranking the
+// given nodes ahead of the nodes normally considered. Unlike
+// SelectPreferringNodes the given nodes compete with the other candidates, so
+// they are chosen by the bonuses they receive rather than merely fitting.
+func (s *GenericStack) SelectRankingNodes(tg *structs.TaskGroup, nodes []*structs.Node) (*RankedNode, *structs.Resources) {
+	ranked := make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		ranked[node.ID] = struct{}{}
+	}
+
+	originalNodes := s.source.nodes
+	candidates := make([]*structs.Node, 0, len(originalNodes)+len(nodes))
+	candidates = append(candidates, nodes...)
+	for _, node := range originalNodes {
+		if _, ok := ranked[node.ID]; !ok {
+			candidates = append(candidates, node)
+		}
+	}
+
+	s.source.SetNodes(candidates)
+	option, resources := s.Select(tg)
+	s.source.SetNodes(originalNodes)
+	return option, resources
+}
+
 // SystemStack is the Stack used for the System scheduler. It is designed to
 // attempt to make placements on all nodes.
 type SystemStack struct {
 	ctx                 Context
 	source              *StaticIterator
+	nodeList            *NodeListIterator
+	cordon              *CordonIterator
 	wrappedChecks       *FeasibilityWrapper
 	jobConstraint       *ConstraintChecker
 	taskGroupDrivers    *DriverChecker
@@ -205,6 +532,11 @@ func NewSystemStack(ctx Context) *SystemStack {
 	// have to evaluate on all nodes.
 	s.source = NewStaticIterator(ctx, nil)
 
+	// Filter out the nodes excluded by the node allow and deny lists and the
+	// nodes cordoned for the evaluation before anything else.
+	s.nodeList = NewNodeListIterator(ctx, s.source)
+	s.cordon = NewCordonIterator(ctx, s.nodeList)
+
 	// Attach the job constraints. The job is filled in later.
 	s.jobConstraint = NewConstraintChecker(ctx, nil)
 
@@ -220,7 +552,7 @@ func NewSystemStack(ctx Context) *SystemStack {
 	// checks that only needs to examine the single node to determine feasibility.
 	jobs := []FeasibilityChecker{s.jobConstraint}
 	tgs := []FeasibilityChecker{s.taskGroupDrivers, s.taskGroupConstraint}
-	s.wrappedChecks = NewFeasibilityWrapper(ctx, s.source, jobs, tgs)
+	s.wrappedChecks = NewFeasibilityWrapper(ctx, s.cordon, jobs, tgs)
 
 	// Upgrade from feasible to rank iterator
 	rankSource := NewFeasibleRankIterator(ctx, s.wrappedChecks)
@@ -255,6 +587,8 @@ func (s *SystemStack) Select(tg *structs.TaskGroup) (*RankedNode, *structs.Resou
 	// Update the parameters of iterators
 	s.taskGroupDrivers.SetDrivers(tgConstr.drivers)
 	s.taskGroupConstraint.SetConstraints(tgConstr.constraints)
+	s.jobConstraint.SetTaskGroup(tg)
+	s.taskGroupConstraint.SetTaskGroup(tg)
 	s.binPack.SetTaskGroup(tg)
 	s.wrappedChecks.SetTaskGroup(tg.Name)
 
@@ -268,6 +602,9 @@ func (s *SystemStack) Select(tg *structs.TaskGroup) (*RankedNode, *structs.Resou
 		}
 	}
 
+	// Store the effectiveness of the computed class optimization
+	s.ctx.Metrics().EligibilityEffectiveness = s.ctx.Eligibility().Effectiveness()
+
 	// Store the compute time
 	s.ctx.Metrics().AllocationTime = time.Since(start)
 	return option, tgConstr.size
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/nomad/nomad/mock"
 	"github.com/hashicorp/nomad/nomad/structs"
@@ -302,6 +304,183 @@ func TestServiceStack_Select_BinPack_Overflow(t *testing.T) {
 	}
 }
 
+func TestServiceStack_Select_Consolidate(t *testing.T) {
+	// placeAll places count allocs of the job, returning the number of
+	// distinct nodes used.
+	placeAll := func(mode RankingMode, count int) (int, *EvalContext) {
+		_, ctx := testContext(t)
+		var nodes []*structs.Node
+		for i := 0; i < 10; i++ {
+			nodes = append(nodes, mock.Node())
+		}
+		stack := NewGenericStack(false, ctx)
+		stack.SetRankingMode(mode)
+		stack.SetNodes(nodes)
+
+		job := mock.Job()
+		stack.SetJob(job)
+		tg := job.TaskGroups[0]
+		for i := 0; i < count; i++ {
+			option, size := stack.Select(tg)
+			if option == nil {
+				t.Fatalf("missing node %#v", ctx.Metrics())
+			}
+			ctx.Plan().AppendAlloc(&structs.Allocation{
+				ID:            structs.GenerateUUID(),
+				JobID:         job.ID,
+				TaskGroup:     tg.Name,
+				NodeID:        option.Node.ID,
+				Resources:     size,
+				TaskResources: option.TaskResources,
+			})
+		}
+		return len(ctx.Plan().NodeAllocation), ctx
+	}
+
+	def, _ := placeAll(RankingModeDefault, 10)
+	cons, ctx := placeAll(RankingModeConsolidate, 10)
+
+	// Each node fits seven allocs so two nodes are needed
+	if cons != 2 {
+		t.Fatalf("consolidate used %d nodes; want 2", cons)
+	}
+	if cons >= def {
+		t.Fatalf("consolidate used %d nodes; default used %d", cons, def)
+	}
+	if frag := ctx.Metrics().JobFragmentation; frag != cons {
+		t.Fatalf("bad fragmentation %d; want %d", frag, cons)
+	}
+}
+
+func TestServiceStack_Select_PowerEfficiency(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Meta["power_per_core"] = "12"
+	nodes[1].Meta["power_per_core"] = "3"
+	expected := nodes[1]
+
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+	stack.SetPowerEfficiency(10.0, "")
+
+	job := mock.Job()
+	stack.SetJob(job)
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if node.Node != expected {
+		t.Fatalf("bad: %#v", node.Node)
+	}
+}
+
+func TestServiceStack_Select_ZoneDistance(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Meta["zone"] = "far"
+	nodes[1].Meta["zone"] = "near"
+	expected := nodes[1]
+
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+	stack.SetZoneDistances(10.0, map[string]map[string]float64{
+		"home": {"near": 1, "far": 9},
+	})
+	stack.SetPreferredZone("home")
+
+	job := mock.Job()
+	stack.SetJob(job)
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if node.Node != expected {
+		t.Fatalf("bad: %#v", node.Node)
+	}
+}
+
+func TestServiceStack_Select_SoftConstraint_GroupAggregate(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Attributes["cpu.numcores"] = "2"
+	nodes[1].Attributes["cpu.numcores"] = "8"
+	expected := nodes[1]
+
+	// Prefer a core per 100 MHz requested by the task group
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+	stack.SetSoftConstraints(10.0, []*SoftConstraint{
+		&SoftConstraint{
+			Constraint: &structs.Constraint{
+				Operand: ">=",
+				LTarget: "${attr.cpu.numcores}",
+				RTarget: "${group.cpu} * 0.01",
+			},
+			Weight: 1,
+		},
+	})
+
+	job := mock.Job()
+	stack.SetJob(job)
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if node.Node != expected {
+		t.Fatalf("bad: %#v", node.Node)
+	}
+	key := fmt.Sprintf("%s.soft-constraint", expected.ID)
+	if score := ctx.Metrics().Scores[key]; score != 10.0 {
+		t.Fatalf("bad: %#v", ctx.Metrics().Scores)
+	}
+}
+
+func TestServiceStack_Select_AllocCountBalance(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	expected := nodes[1]
+
+	// Propose allocations without resources so both nodes fit equally
+	plan := ctx.Plan()
+	for i := 0; i < 3; i++ {
+		alloc := mock.Alloc()
+		alloc.Resources = &structs.Resources{}
+		plan.NodeAllocation[nodes[0].ID] = append(plan.NodeAllocation[nodes[0].ID], alloc)
+	}
+
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+	stack.SetAllocCountBalance(10.0)
+
+	job := mock.Job()
+	stack.SetJob(job)
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if node.Node != expected {
+		t.Fatalf("bad: %#v", node.Node)
+	}
+
+	// Both nodes have the same bin packing score
+	scores := ctx.Metrics().Scores
+	if scores[nodes[0].ID+".binpack"] != scores[nodes[1].ID+".binpack"] {
+		t.Fatalf("bad: %#v", scores)
+	}
+}
+
 func TestSystemStack_SetNodes(t *testing.T) {
 	_, ctx := testContext(t)
 	stack := NewSystemStack(ctx)
@@ -517,3 +696,330 @@ func TestSystemStack_Select_BinPack_Overflow(t *testing.T) {
 		t.Fatalf("bad: %#v", met)
 	}
 }
+
+func TestSystemStack_Select_InfeasibleNodes(t *testing.T) {
+	_, ctx := testContext(t)
+	ctx.SetRejectionDetail(true)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+
+	// Missing the driver
+	delete(nodes[0].Attributes, "driver.exec")
+	nodes[0].ComputeClass()
+
+	// Failing the job constraint, the second node shares the computed class
+	nodes[1].Attributes["kernel.name"] = "windows"
+	nodes[1].ComputeClass()
+	nodes[2].Attributes["kernel.name"] = "windows"
+	nodes[2].ComputeClass()
+
+	// Exhausted
+	nodes[3].Reserved.CPU = nodes[3].Resources.CPU
+
+	stack := NewSystemStack(ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	stack.SetJob(job)
+
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if node.Node != nodes[4] {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	expected := []NodeRejection{
+		{NodeID: nodes[0].ID, Checker: "driver", Reason: "missing drivers"},
+		{NodeID: nodes[1].ID, Checker: "constraint", Reason: "${attr.kernel.name} = linux"},
+		{NodeID: nodes[2].ID, Checker: "computed-class", Reason: "computed class ineligible"},
+		{NodeID: nodes[3].ID, Checker: "binpack", Reason: "cpu exhausted"},
+	}
+	if act := ctx.InfeasibleNodes(); !reflect.DeepEqual(act, expected) {
+		t.Fatalf("bad: %#v", act)
+	}
+
+	// Resetting clears the rejections
+	ctx.Reset()
+	if act := ctx.InfeasibleNodes(); len(act) != 0 {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+func TestSystemStack_Select_InfeasibleNodes_Disabled(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	delete(nodes[0].Attributes, "driver.exec")
+	nodes[0].ComputeClass()
+
+	stack := NewSystemStack(ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	stack.SetJob(job)
+
+	if node, _ := stack.Select(job.TaskGroups[0]); node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if act := ctx.InfeasibleNodes(); len(act) != 0 {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+func TestSystemStack_Select_ConsideredNodes(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+
+	// Filtered nodes are still considered. Filter all but the last node so
+	// that every node is visited.
+	for _, node := range nodes[:2] {
+		delete(node.Attributes, "driver.exec")
+		node.ComputeClass()
+	}
+
+	stack := NewSystemStack(ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	stack.SetJob(job)
+	if node, _ := stack.Select(job.TaskGroups[0]); node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+
+	var expected []string
+	for _, node := range nodes {
+		expected = append(expected, node.ID)
+	}
+	if act := ctx.ConsideredNodes(); !reflect.DeepEqual(act, expected) {
+		t.Fatalf("bad: %#v; want %#v", act, expected)
+	}
+
+	// Reset clears the considered nodes
+	ctx.Reset()
+	if act := ctx.ConsideredNodes(); len(act) != 0 {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+func TestServiceStack_Select_EligibilityEffectiveness(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	stack.SetJob(job)
+
+	// The first node has an unknown class so only the second is resolved
+	if node, _ := stack.Select(job.TaskGroups[0]); node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	met := ctx.Metrics()
+	if met.EligibilityEffectiveness != 0.5 {
+		t.Fatalf("bad: %#v", met)
+	}
+}
+
+func TestServiceStack_Select_Cordon(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Meta["maintenance"] = "true"
+	nodes[1].Meta["maintenance"] = "true"
+	expected := nodes[2]
+	ctx.SetCordon(func(n *structs.Node) bool {
+		return n.Meta["maintenance"] == "true"
+	})
+
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	stack.SetJob(job)
+
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if node.Node != expected {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	met := ctx.Metrics()
+	if met.NodesCordoned != 2 || met.NodesFiltered != 0 || met.NodesEvaluated != 3 {
+		t.Fatalf("bad: %#v", met)
+	}
+}
+
+func TestServiceStack_Select_PreferredDatacenter(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[1].Datacenter = "dc2"
+	expected := nodes[1]
+
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	job.Datacenters = []string{"dc1", "dc2"}
+	stack.SetJob(job)
+
+	// The nodes are an equal fit so the previous datacenter wins
+	stack.SetPreferredDatacenter("dc2")
+	for i := 0; i < 5; i++ {
+		node, _ := stack.Select(job.TaskGroups[0])
+		if node == nil {
+			t.Fatalf("missing node %#v", ctx.Metrics())
+		}
+		if node.Node != expected {
+			t.Fatalf("bad: %#v", node)
+		}
+	}
+
+	// Disabling the bonus leaves the nodes tied
+	stack.SetDatacenterLocalityBonus(0)
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	for key := range ctx.Metrics().Scores {
+		if strings.HasSuffix(key, ".datacenter-locality") {
+			t.Fatalf("unexpected score %q", key)
+		}
+	}
+}
+
+func TestServiceStack_Select_StickyVolume_BinPack(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	zero := nodes[0]
+	one := nodes[1]
+	one.Reserved = one.Resources
+
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	stack.SetJob(job)
+
+	// The sticky node is exhausted so bin-packing rejects it
+	stack.SetStickyVolumeBonus(20.0)
+	stack.SetStickyVolume(one)
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if node.Node != zero {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	// Ensure the bonus is only recorded for nodes bin-packing accepts
+	if _, ok := ctx.Metrics().Scores[fmt.Sprintf("%s.sticky-volume", one.ID)]; ok {
+		t.Fatalf("bad: %#v", ctx.Metrics().Scores)
+	}
+}
+
+func TestServiceStack_Select_CheckerTimeout(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+	}
+
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+
+	// Checking the constraint can't complete within the timeout
+	job := mock.Job()
+	job.Constraints = append(job.Constraints, &structs.Constraint{
+		LTarget: "${attr.kernel.name}",
+		RTarget: "^(l|i|n|u|x)+$",
+		Operand: structs.ConstraintRegex,
+	})
+	stack.SetJob(job)
+	stack.SetCheckerTimeout(time.Nanosecond)
+
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node != nil {
+		t.Fatalf("bad: %#v", node)
+	}
+	if ctx.Metrics().CheckerTimeouts["job-constraint"] != 1 {
+		t.Fatalf("bad: %#v", ctx.Metrics())
+	}
+
+	// Disabling the timeout makes the node feasible again
+	stack.SetCheckerTimeout(0)
+	node, _ = stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+}
+
+func TestServiceStack_Select_FallbackConstraints(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+	}
+	small := nodes[1]
+	small.NodeClass = "small"
+
+	stack := NewGenericStack(false, ctx)
+	stack.SetNodes(nodes)
+
+	job := mock.Job()
+	stack.SetJob(job)
+
+	// No node has the large class so the small node is used
+	stack.SetFallbackConstraints([][]*structs.Constraint{
+		{
+			&structs.Constraint{
+				Operand: "=",
+				LTarget: "${node.class}",
+				RTarget: "large",
+			},
+		},
+		{
+			&structs.Constraint{
+				Operand: "=",
+				LTarget: "${node.class}",
+				RTarget: "small",
+			},
+		},
+	})
+
+	node, _ := stack.Select(job.TaskGroups[0])
+	if node == nil {
+		t.Fatalf("missing node %#v", ctx.Metrics())
+	}
+	if node.Node != small {
+		t.Fatalf("bad: %#v", node)
+	}
+	if ctx.Metrics().FallbackTier != 2 {
+		t.Fatalf("bad: %#v", ctx.Metrics())
+	}
+}
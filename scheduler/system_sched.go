@@ -39,6 +39,23 @@ type SystemScheduler struct {
 
 	failedTGAllocs map[string]*structs.AllocMetric
 	queuedAllocs   map[string]int
+
+	planValidator func(*structs.Plan) error
+
+	failOnStateError bool
+}
+
+// SetPlanValidator sets a callback used to veto the proposed plan before it is
+// submitted. See EvalContext.SetPlanValidator.
+func (s *SystemScheduler) SetPlanValidator(validator func(*structs.Plan) error) {
+	s.planValidator = validator
+}
+
+// SetFailOnStateError sets whether an error reading the state of a node fails
+// the evaluation rather than only skipping the node. See
+// EvalContext.SetFailOnStateError.
+func (s *SystemScheduler) SetFailOnStateError(fail bool) {
+	s.failOnStateError = fail
 }
 
 // NewSystemScheduler is a factory function to instantiate a new system
@@ -70,6 +87,10 @@ func (s *SystemScheduler) Process(eval *structs.Evaluation) error {
 	// Retry up to the maxSystemScheduleAttempts and reset if progress is made.
 	progress := func() bool { return progressMade(s.planResult) }
 	if err := retryMax(maxSystemScheduleAttempts, s.process, progress); err != nil {
+		if _, ok := err.(*invalidJobError); ok {
+			return setStatus(s.logger, s.planner, s.eval, s.nextEval, nil, s.failedTGAllocs, structs.EvalStatusFailed, err.Error(),
+				s.queuedAllocs)
+		}
 		if statusErr, ok := err.(*SetStatusError); ok {
 			return setStatus(s.logger, s.planner, s.eval, s.nextEval, nil, s.failedTGAllocs, statusErr.EvalStatus, err.Error(),
 				s.queuedAllocs)
@@ -114,11 +135,20 @@ func (s *SystemScheduler) process() (bool, error) {
 
 	// Create an evaluation context
 	s.ctx = NewEvalContext(s.state, s.plan, s.logger)
+	s.ctx.SetPlanValidator(s.planValidator)
+	s.ctx.SetFailOnStateError(s.failOnStateError)
 
 	// Construct the placement stack
 	s.stack = NewSystemStack(s.ctx)
 	if s.job != nil {
 		s.stack.SetJob(s.job)
+
+		// Fail the evaluation of a job with malformed constraints rather
+		// than filtering every node
+		if err := s.ctx.ValidateJobConstraints(s.job); err != nil {
+			s.logger.Printf("[DEBUG] sched: %#v: %v", s.eval, err)
+			return false, &invalidJobError{Err: err}
+		}
 	}
 
 	// Compute the target job allocations
@@ -127,6 +157,15 @@ func (s *SystemScheduler) process() (bool, error) {
 		return false, err
 	}
 
+	// Give the plan validator a chance to veto a plan that will be submitted
+	// before any evaluation is created for it
+	if !s.plan.IsNoOp() || s.eval.AnnotatePlan {
+		if err := s.ctx.ValidatePlan(); err != nil {
+			s.logger.Printf("[DEBUG] sched: %#v: plan vetoed: %v", s.eval, err)
+			return false, fmt.Errorf("plan vetoed: %v", err)
+		}
+	}
+
 	// If the plan is a no-op, we can bail. If AnnotatePlan is set submit the plan
 	// anyways to get the annotations.
 	if s.plan.IsNoOp() && !s.eval.AnnotatePlan {
@@ -271,6 +310,9 @@ func (s *SystemScheduler) computePlacements(place []allocTuple) error {
 
 		// Attempt to match the task group
 		option, _ := s.stack.Select(missing.TaskGroup)
+		if err := s.ctx.StateErr(); err != nil {
+			return err
+		}
 
 		if option == nil {
 			// If nodes were filtered because of constain mismatches and we
@@ -3,6 +3,7 @@ package scheduler
 import (
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -150,6 +151,51 @@ func TestSystemeSched_JobRegister_StickyAllocs(t *testing.T) {
 	}
 }
 
+func TestSystemSched_JobRegister_InvalidConstraint(t *testing.T) {
+	h := NewHarness(t)
+
+	// Create some nodes
+	for i := 0; i < 10; i++ {
+		node := mock.Node()
+		noErr(t, h.State.UpsertNode(h.NextIndex(), node))
+	}
+
+	// Create a job with a malformed regexp constraint
+	job := mock.SystemJob()
+	job.Constraints = append(job.Constraints, &structs.Constraint{
+		LTarget: "${attr.kernel.name}",
+		RTarget: "(foo",
+		Operand: structs.ConstraintRegex,
+	})
+	noErr(t, h.State.UpsertJob(h.NextIndex(), job))
+
+	// Create a mock evaluation to register the job
+	eval := &structs.Evaluation{
+		ID:          structs.GenerateUUID(),
+		Priority:    job.Priority,
+		TriggeredBy: structs.EvalTriggerJobRegister,
+		JobID:       job.ID,
+	}
+
+	// Process the evaluation
+	err := h.Process(NewSystemScheduler, eval)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure no plan was submitted
+	if len(h.Plans) != 0 {
+		t.Fatalf("bad: %#v", h.Plans)
+	}
+
+	// Ensure the eval failed with the malformed constraint
+	h.AssertEvalStatus(t, structs.EvalStatusFailed)
+	desc := h.Evals[0].StatusDescription
+	if !strings.Contains(desc, "constraint") || !strings.Contains(desc, "invalid regexp") {
+		t.Fatalf("bad: %q", desc)
+	}
+}
+
 func TestSystemSched_JobRegister_EphemeralDiskConstraint(t *testing.T) {
 	h := NewHarness(t)
 
@@ -214,3 +214,59 @@ func (h *Harness) AssertEvalStatus(t *testing.T, state string) {
 		t.Fatalf("bad: %#v", update)
 	}
 }
+
+// PlansEquivalent returns whether two plans make the same placements and
+// updates. The allocations of each node are compared as a set, ignoring their
+// order and identifiers such as the allocation and evaluation IDs that are
+// generated for every evaluation and don't affect placement. Nodes without
+// allocations are treated as absent.
+func PlansEquivalent(a, b *structs.Plan) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return nodeAllocsEquivalent(a.NodeAllocation, b.NodeAllocation) &&
+		nodeAllocsEquivalent(a.NodeUpdate, b.NodeUpdate)
+}
+
+// nodeAllocsEquivalent returns whether the per node allocations are the same
+// sets of placements.
+func nodeAllocsEquivalent(a, b map[string][]*structs.Allocation) bool {
+	nodes := make(map[string]struct{})
+	for node := range a {
+		nodes[node] = struct{}{}
+	}
+	for node := range b {
+		nodes[node] = struct{}{}
+	}
+
+	for node := range nodes {
+		allocs := a[node]
+		if len(allocs) != len(b[node]) {
+			return false
+		}
+
+		// Count the placements on the node in a and remove those in b
+		counts := make(map[string]int, len(allocs))
+		for _, alloc := range allocs {
+			counts[placementKey(alloc)]++
+		}
+		for _, alloc := range b[node] {
+			key := placementKey(alloc)
+			if counts[key] == 0 {
+				return false
+			}
+			counts[key]--
+		}
+	}
+	return true
+}
+
+// placementKey returns a key identifying an allocation by the fields that
+// affect placement.
+func placementKey(alloc *structs.Allocation) string {
+	key := fmt.Sprintf("%s/%s/%s/%s", alloc.JobID, alloc.TaskGroup, alloc.Name, alloc.DesiredStatus)
+	if r := alloc.Resources; r != nil {
+		key += fmt.Sprintf("/%d/%d/%d/%d", r.CPU, r.MemoryMB, r.DiskMB, r.IOPS)
+	}
+	return key
+}
@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// testPlans returns two plans making the same placements with different
+// allocation IDs and orderings.
+func testPlans() (*structs.Plan, *structs.Plan) {
+	a := &structs.Plan{
+		NodeUpdate:     make(map[string][]*structs.Allocation),
+		NodeAllocation: make(map[string][]*structs.Allocation),
+	}
+	b := &structs.Plan{
+		NodeUpdate:     make(map[string][]*structs.Allocation),
+		NodeAllocation: make(map[string][]*structs.Allocation),
+	}
+
+	var allocs []*structs.Allocation
+	for i := 0; i < 3; i++ {
+		alloc := mock.Alloc()
+		alloc.NodeID = "node1"
+		alloc.Name = fmt.Sprintf("%s.%s[%d]", alloc.JobID, alloc.TaskGroup, i)
+		allocs = append(allocs, alloc)
+	}
+	evict := mock.Alloc()
+	evict.NodeID = "node2"
+	evict.DesiredStatus = structs.AllocDesiredStatusStop
+
+	a.NodeAllocation["node1"] = allocs
+	a.NodeUpdate["node2"] = []*structs.Allocation{evict}
+
+	// Copy the allocations with new IDs and shuffle them
+	for _, i := range []int{2, 0, 1} {
+		alloc := allocs[i].Copy()
+		alloc.ID = structs.GenerateUUID()
+		alloc.EvalID = structs.GenerateUUID()
+		b.NodeAllocation["node1"] = append(b.NodeAllocation["node1"], alloc)
+	}
+	evictCopy := evict.Copy()
+	evictCopy.EvalID = structs.GenerateUUID()
+	b.NodeUpdate["node2"] = []*structs.Allocation{evictCopy}
+
+	// An empty node is the same as an absent one
+	b.NodeAllocation["node3"] = nil
+	return a, b
+}
+
+func TestPlansEquivalent(t *testing.T) {
+	a, b := testPlans()
+	if !PlansEquivalent(a, b) || !PlansEquivalent(b, a) {
+		t.Fatalf("plans should be equivalent")
+	}
+	if !PlansEquivalent(nil, nil) {
+		t.Fatalf("nil plans should be equivalent")
+	}
+}
+
+func TestPlansEquivalent_Different(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Modify func(p *structs.Plan)
+	}{
+		{
+			Name: "different node",
+			Modify: func(p *structs.Plan) {
+				p.NodeAllocation["node4"] = p.NodeAllocation["node1"]
+				delete(p.NodeAllocation, "node1")
+			},
+		},
+		{
+			Name: "missing placement",
+			Modify: func(p *structs.Plan) {
+				p.NodeAllocation["node1"] = p.NodeAllocation["node1"][1:]
+			},
+		},
+		{
+			Name: "duplicate placement",
+			Modify: func(p *structs.Plan) {
+				allocs := p.NodeAllocation["node1"]
+				allocs[1] = allocs[0]
+			},
+		},
+		{
+			Name: "different resources",
+			Modify: func(p *structs.Plan) {
+				alloc := p.NodeAllocation["node1"][0].Copy()
+				alloc.Resources.CPU += 100
+				p.NodeAllocation["node1"][0] = alloc
+			},
+		},
+		{
+			Name: "missing update",
+			Modify: func(p *structs.Plan) {
+				delete(p.NodeUpdate, "node2")
+			},
+		},
+	}
+
+	for _, c := range cases {
+		a, b := testPlans()
+		c.Modify(b)
+		if PlansEquivalent(a, b) || PlansEquivalent(b, a) {
+			t.Fatalf("%s: plans should differ", c.Name)
+		}
+	}
+	if PlansEquivalent(&structs.Plan{}, nil) {
+		t.Fatalf("nil plan should differ")
+	}
+}
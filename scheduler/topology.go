@@ -0,0 +1,143 @@
+package scheduler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// topologyPrefix is the prefix of targets referencing a topology label derived
+// from the node, such as "${topology.rack}".
+const topologyPrefix = "${topology."
+
+// TopologyRule derives a topology label, such as the rack, row or pod of a
+// node, from a value of the node. For example a rack label can be derived from
+// the first two octets of the IP address of the node or from a naming
+// convention of the node names.
+type TopologyRule struct {
+	// Label is the name of the derived label, referenced by constraints as
+	// "${topology.<label>}".
+	Label string
+
+	// Target is the node value the label is derived from, such as
+	// "${attr.unique.network.ip-address}".
+	Target string
+
+	// Regexp extracts the label from the value of the target. The capture
+	// group named "value" is used, or else the first group, or else the whole
+	// match.
+	Regexp string
+
+	re *regexp.Regexp
+}
+
+// compile validates the rule and compiles its regular expression.
+func (r *TopologyRule) compile() error {
+	if r.Label == "" {
+		return fmt.Errorf("missing topology label")
+	}
+	if !strings.HasPrefix(r.Target, "${") || strings.HasPrefix(r.Target, topologyPrefix) {
+		return fmt.Errorf("topology label %q has invalid target %q", r.Label, r.Target)
+	}
+	re, err := regexp.Compile(r.Regexp)
+	if err != nil {
+		return fmt.Errorf("topology label %q has invalid regexp %q: %v", r.Label, r.Regexp, err)
+	}
+	r.re = re
+	return nil
+}
+
+// derive returns the label derived from the node and whether the rule
+// applied to the node.
+func (r *TopologyRule) derive(node *structs.Node) (string, bool) {
+	val, ok := resolveConstraintTarget(r.Target, node)
+	if !ok {
+		return "", false
+	}
+	str, ok := val.(string)
+	if !ok {
+		return "", false
+	}
+
+	matches := r.re.FindStringSubmatch(str)
+	if matches == nil {
+		return "", false
+	}
+
+	// Find the group to extract
+	group := 0
+	if r.re.NumSubexp() > 0 {
+		group = 1
+	}
+	for idx, name := range r.re.SubexpNames() {
+		if name == regexpExtractGroup {
+			group = idx
+			break
+		}
+	}
+	return matches[group], true
+}
+
+// compileTopologyRules returns compiled copies of the rules so the rules may
+// be shared. An error is returned if a rule is invalid.
+func compileTopologyRules(rules []*TopologyRule) ([]*TopologyRule, error) {
+	compiled := make([]*TopologyRule, len(rules))
+	for i, rule := range rules {
+		c := *rule
+		if err := c.compile(); err != nil {
+			return nil, err
+		}
+		compiled[i] = &c
+	}
+	return compiled, nil
+}
+
+// NewTopologyCache returns an AttributeCache caching the topology labels
+// derived from nodes by the rules for the given TTL. Sharing the cache
+// between evaluations, see GenericScheduler.SetAttributeCache, avoids deriving
+// the labels of every node for each evaluation. An error is returned if a
+// rule is invalid.
+func NewTopologyCache(rules []*TopologyRule, ttl time.Duration) (*AttributeCache, error) {
+	compiled, err := compileTopologyRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	resolver := func(node *structs.Node) map[string]string {
+		return deriveTopologyLabels(compiled, node)
+	}
+	return NewAttributeCache(resolver, ttl), nil
+}
+
+// deriveTopologyLabels returns the topology labels of the node. If several
+// rules derive the same label, the first rule applying to the node is used.
+func deriveTopologyLabels(rules []*TopologyRule, node *structs.Node) map[string]string {
+	labels := make(map[string]string)
+	for _, rule := range rules {
+		if _, ok := labels[rule.Label]; ok {
+			continue
+		}
+		if label, ok := rule.derive(node); ok {
+			labels[rule.Label] = label
+		}
+	}
+	return labels
+}
+
+// resolveNodeTarget resolves a target against the node like
+// resolveConstraintTarget, additionally resolving topology labels derived by
+// the context.
+func resolveNodeTarget(ctx Context, target string, node *structs.Node) (interface{}, bool) {
+	if !strings.HasPrefix(target, topologyPrefix) {
+		return resolveConstraintTarget(target, node)
+	}
+
+	label := strings.TrimSuffix(strings.TrimPrefix(target, topologyPrefix), "}")
+	val, ok := ctx.TopologyLabel(node, label)
+	if !ok {
+		return nil, false
+	}
+	return val, true
+}
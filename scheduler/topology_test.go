@@ -0,0 +1,235 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestTopologyRule_Derive(t *testing.T) {
+	node := mock.Node()
+	node.Name = "dc1-r12-n07"
+	node.Attributes["unique.network.ip-address"] = "10.3.7.21"
+
+	cases := []struct {
+		Rule  *TopologyRule
+		Label string
+		Ok    bool
+	}{
+		// The first group
+		{
+			Rule: &TopologyRule{
+				Label:  "rack",
+				Target: "${attr.unique.network.ip-address}",
+				Regexp: `^(\d+\.\d+)\.`,
+			},
+			Label: "10.3",
+			Ok:    true,
+		},
+		// The named group
+		{
+			Rule: &TopologyRule{
+				Label:  "rack",
+				Target: "${node.unique.name}",
+				Regexp: `^(dc\d+)-(?P<value>r\d+)-`,
+			},
+			Label: "r12",
+			Ok:    true,
+		},
+		// The whole match
+		{
+			Rule: &TopologyRule{
+				Label:  "row",
+				Target: "${node.unique.name}",
+				Regexp: `^dc\d+-r\d`,
+			},
+			Label: "dc1-r1",
+			Ok:    true,
+		},
+		// No match
+		{
+			Rule: &TopologyRule{
+				Label:  "rack",
+				Target: "${node.unique.name}",
+				Regexp: `^rack-`,
+			},
+		},
+		// Missing target
+		{
+			Rule: &TopologyRule{
+				Label:  "rack",
+				Target: "${meta.rack}",
+				Regexp: `.*`,
+			},
+		},
+	}
+
+	for i, c := range cases {
+		if err := c.Rule.compile(); err != nil {
+			t.Fatalf("case(%d) err: %v", i, err)
+		}
+		label, ok := c.Rule.derive(node)
+		if label != c.Label || ok != c.Ok {
+			t.Fatalf("case(%d) bad: %q %v", i, label, ok)
+		}
+	}
+}
+
+func TestTopologyRule_Compile(t *testing.T) {
+	cases := []*TopologyRule{
+		{Target: "${node.unique.name}", Regexp: ".*"},
+		{Label: "rack", Target: "node", Regexp: ".*"},
+		{Label: "rack", Target: "${topology.row}", Regexp: ".*"},
+		{Label: "rack", Target: "${node.unique.name}", Regexp: "(foo"},
+	}
+	for i, rule := range cases {
+		if err := rule.compile(); err == nil {
+			t.Fatalf("case(%d) expected error", i)
+		}
+	}
+}
+
+func TestEvalContext_TopologyLabels(t *testing.T) {
+	_, ctx := testContext(t)
+	node := mock.Node()
+	node.Name = "dc1-r12-n07"
+	node.Attributes["unique.network.ip-address"] = "10.3.7.21"
+
+	// Rules for the same label are applied in order
+	rules := []*TopologyRule{
+		{
+			Label:  "rack",
+			Target: "${meta.rack}",
+			Regexp: ".+",
+		},
+		{
+			Label:  "rack",
+			Target: "${attr.unique.network.ip-address}",
+			Regexp: `^(\d+\.\d+)\.`,
+		},
+		{
+			Label:  "row",
+			Target: "${node.unique.name}",
+			Regexp: `^dc\d+-(r\d)`,
+		},
+	}
+	noErr(t, ctx.SetTopologyRules(rules))
+
+	labels := ctx.TopologyLabels(node)
+	if len(labels) != 2 || labels["rack"] != "10.3" || labels["row"] != "r1" {
+		t.Fatalf("bad: %#v", labels)
+	}
+
+	// The labels are cached per node
+	node.Attributes["unique.network.ip-address"] = "10.4.7.21"
+	if label, ok := ctx.TopologyLabel(node, "rack"); !ok || label != "10.3" {
+		t.Fatalf("bad: %q %v", label, ok)
+	}
+	if _, ok := ctx.TopologyLabel(node, "pod"); ok {
+		t.Fatalf("unexpected pod label")
+	}
+
+	// The targets resolve the labels
+	if val, ok := resolveNodeTarget(ctx, "${topology.row}", node); !ok || val != "r1" {
+		t.Fatalf("bad: %v %v", val, ok)
+	}
+	if _, ok := resolveNodeTarget(ctx, "${topology.pod}", node); ok {
+		t.Fatalf("unexpected pod label")
+	}
+
+	// Setting the rules resets the cache, invalid rules are rejected
+	noErr(t, ctx.SetTopologyRules(rules))
+	if label, _ := ctx.TopologyLabel(node, "rack"); label != "10.4" {
+		t.Fatalf("bad: %q", label)
+	}
+	invalid := []*TopologyRule{{Label: "rack", Target: "${node.unique.name}", Regexp: "(foo"}}
+	if err := ctx.SetTopologyRules(invalid); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The rules are not modified
+	if rules[0].re != nil {
+		t.Fatalf("rules modified")
+	}
+
+	// Without rules there are no labels
+	noErr(t, ctx.SetTopologyRules(nil))
+	if labels := ctx.TopologyLabels(node); len(labels) != 0 {
+		t.Fatalf("bad: %#v", labels)
+	}
+}
+
+func TestEvalContext_AttributeCache(t *testing.T) {
+	node := mock.Node()
+	node.Name = "dc1-r12-n07"
+	rules := []*TopologyRule{
+		{
+			Label:  "row",
+			Target: "${node.unique.name}",
+			Regexp: `^dc\d+-(r\d)`,
+		},
+	}
+	cache, err := NewTopologyCache(rules, time.Minute)
+	noErr(t, err)
+
+	// The labels are derived once across evaluations
+	for i := 0; i < 2; i++ {
+		_, ctx := testContext(t)
+		ctx.SetAttributeCache(cache)
+		if label, ok := ctx.TopologyLabel(node, "row"); !ok || label != "r1" {
+			t.Fatalf("bad: %q %v", label, ok)
+		}
+		node.Name = "dc1-r27-n07"
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("bad: %d", cache.Len())
+	}
+
+	// Updating the node derives the labels again
+	node.ModifyIndex++
+	_, ctx := testContext(t)
+	ctx.SetAttributeCache(cache)
+	if label, _ := ctx.TopologyLabel(node, "row"); label != "r2" {
+		t.Fatalf("bad: %q", label)
+	}
+
+	// Invalid rules are rejected
+	invalid := []*TopologyRule{{Label: "rack", Target: "${node.unique.name}", Regexp: "(foo"}}
+	if _, err := NewTopologyCache(invalid, time.Minute); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestConstraintChecker_Topology(t *testing.T) {
+	_, ctx := testContext(t)
+	nodes := []*structs.Node{
+		mock.Node(),
+		mock.Node(),
+		mock.Node(),
+	}
+	nodes[0].Attributes["unique.network.ip-address"] = "10.1.0.5"
+	nodes[1].Attributes["unique.network.ip-address"] = "10.2.0.5"
+	delete(nodes[2].Attributes, "unique.network.ip-address")
+
+	noErr(t, ctx.SetTopologyRules([]*TopologyRule{
+		{
+			Label:  "rack",
+			Target: "${attr.unique.network.ip-address}",
+			Regexp: `^(\d+\.\d+)\.`,
+		},
+	}))
+
+	constraint := &structs.Constraint{
+		Operand: "=",
+		LTarget: "${topology.rack}",
+		RTarget: "10.1",
+	}
+	checker := NewConstraintChecker(ctx, []*structs.Constraint{constraint})
+	for i, exp := range []bool{true, false, false} {
+		if act := checker.Feasible(nodes[i]); act != exp {
+			t.Fatalf("case(%d) failed: got %v; want %v", i, act, exp)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package scheduler
 
 import (
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math/rand"
 	"reflect"
@@ -327,6 +328,24 @@ func shuffleNodes(nodes []*structs.Node) {
 	}
 }
 
+// shuffleNodesRand randomizes the slice order with the Fisher-Yates algorithm
+// using the given source of randomness.
+func shuffleNodesRand(r *rand.Rand, nodes []*structs.Node) {
+	n := len(nodes)
+	for i := n - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+}
+
+// evalShuffleSeed returns the seed used to shuffle the nodes for the
+// evaluation, derived from its ID.
+func evalShuffleSeed(evalID string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(evalID))
+	return int64(h.Sum64())
+}
+
 // tasksUpdated does a diff between task groups to see if the
 // tasks, their drivers, environment variables or config have updated.
 func tasksUpdated(a, b *structs.TaskGroup) bool {